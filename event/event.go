@@ -4,6 +4,7 @@ import (
 	"fmt"
 	connector "github.com/ayhanozemre/fs-shadow/path"
 	"github.com/fsnotify/fsnotify"
+	"time"
 )
 
 type EventHandler interface {
@@ -33,12 +34,25 @@ const (
 	Create Type = "create"
 	Rename Type = "rename"
 	Move   Type = "move"
+	// Chmod is a change of the permission or ownership of a file without a change of its content.
+	Chmod Type = "chmod"
+	// SumUpdated carries the sum of a file that was created or written without one, see filenode.Options.DeferSums,
+	// or the full sum that replaced a weak one, see filenode.MetaData.WeakSum.
+	SumUpdated Type = "sum_updated"
+	// Overflow tells that transactions were dropped because they weren't read in time, the consumer has to resync.
+	Overflow Type = "overflow"
+	// ScanComplete follows the Create transactions of the nodes found by the initial scan, see
+	// watcher.WithScanTransactions.
+	ScanComplete Type = "scan_complete"
 )
 
 type Event struct {
 	Type     Type
 	FromPath connector.Path
 	ToPath   connector.Path
+	// Time is when the event happened, the EventManager sets it to when the first of the OS events it is made of was
+	// appended. The zero time stands for when it is handled.
+	Time time.Time
 }
 
 func (e Event) String() string {
@@ -27,6 +27,8 @@ func (e *EventManager) Append(event fsnotify.Event, sum string) {
 }
 
 func (e *EventManager) StackLength() int {
+	e.Lock()
+	defer e.Unlock()
 	return len(e.stack)
 }
 
@@ -5,7 +5,9 @@ import (
 	"github.com/fsnotify/fsnotify"
 	log "github.com/sirupsen/logrus"
 	"os"
+	"path/filepath"
 	"sync"
+	"time"
 )
 
 /*
@@ -15,6 +17,8 @@ import (
 type EventManager struct {
 	stack    []fsnotify.Event
 	sumStack []string
+	// timeStack holds the time each event of the stack was appended at.
+	timeStack []time.Time
 	sync.Mutex
 }
 
@@ -26,10 +30,13 @@ func (e *EventManager) Append(event fsnotify.Event, sum string) {
 	e.Lock()
 	e.stack = append(e.stack, event)
 	e.sumStack = append(e.sumStack, sum)
+	e.timeStack = append(e.timeStack, time.Now())
 	e.Unlock()
 }
 
 func (e *EventManager) StackLength() int {
+	e.Lock()
+	defer e.Unlock()
 	return len(e.stack)
 }
 
@@ -109,6 +116,18 @@ func (e *EventManager) isRename(e1, e2, e3, _, _ *fsnotify.Event) (*Event, int)
 	return nil, 0
 }
 
+func (e *EventManager) isRetarget(e1, e2, e3 *fsnotify.Event) (*Event, int) {
+	// ln -sfn creates the new link under a temporary name and renames it over the old one.
+	if e1.Op == fsnotify.Create && e2 != nil && e2.Op == fsnotify.Rename && e1.Name == e2.Name &&
+		e3 != nil && e3.Op == fsnotify.Create && e3.Name != e1.Name && filepath.Dir(e1.Name) == filepath.Dir(e3.Name) {
+		if info, err := os.Lstat(e3.Name); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			log.Debug("retarget-case-1")
+			return &Event{FromPath: connector.NewFSPath(e3.Name), Type: Write}, 3
+		}
+	}
+	return nil, 0
+}
+
 func (e *EventManager) isWrite(e1 *fsnotify.Event) (*Event, int) {
 	if e1.Op == fsnotify.Write {
 		log.Debug("write-case-1")
@@ -117,6 +136,14 @@ func (e *EventManager) isWrite(e1 *fsnotify.Event) (*Event, int) {
 	return nil, 0
 }
 
+func (e *EventManager) isChmod(e1 *fsnotify.Event) (*Event, int) {
+	if e1.Op == fsnotify.Chmod {
+		log.Debug("chmod-case-1")
+		return &Event{FromPath: connector.NewFSPath(e1.Name), Type: Chmod}, 1
+	}
+	return nil, 0
+}
+
 // This is where Event Manager processes the events in the main bus.Stack piece by piece.
 // Determining the maximum number of events to be processed;
 //  It is determined by how many events the operating system will send for a file transaction.
@@ -134,6 +161,8 @@ func (e *EventManager) Process() []Event {
 		}
 		e1 = &e.stack[cursor]
 		e1Sum = e.sumStack[cursor]
+		// the event is as old as the first of the events it is made of
+		at := e.timeStack[cursor]
 		if cursor+1 < sl {
 			e2 = &e.stack[cursor+1]
 			e2Sum = e.sumStack[cursor+1]
@@ -142,24 +171,37 @@ func (e *EventManager) Process() []Event {
 			e3 = &e.stack[cursor+2]
 		}
 
-		if e1.Op == fsnotify.Chmod {
-			cursor += 1
+		if event, nc := e.isChmod(e1); event != nil {
+			cursor += nc
+			event.Time = at
+			newEvents = append(newEvents, *event)
+			log.Debug(event.String())
 			continue
 		}
 
 		if event, nc := e.isWrite(e1); event != nil {
 			cursor += nc
+			event.Time = at
 			newEvents = append(newEvents, *event)
 			continue
 		}
 		if event, nc := e.isRemove(e1, e2, e1Sum, e2Sum); event != nil {
 			cursor += nc
+			event.Time = at
+			newEvents = append(newEvents, *event)
+			log.Debug(event.String())
+			continue
+		}
+		if event, nc := e.isRetarget(e1, e2, e3); event != nil {
+			cursor += nc
+			event.Time = at
 			newEvents = append(newEvents, *event)
 			log.Debug(event.String())
 			continue
 		}
 		if event, nc := e.isCreate(e1, e2, e3, e4, e5, e6, e1Sum, e2Sum); event != nil {
 			cursor += nc
+			event.Time = at
 			newEvents = append(newEvents, *event)
 			log.Debug(event.String())
 			// break and generate sum for nodeTree
@@ -167,6 +209,7 @@ func (e *EventManager) Process() []Event {
 		}
 		if event, nc := e.isRename(e1, e2, e3, e4, e5); event != nil {
 			cursor += nc
+			event.Time = at
 			newEvents = append(newEvents, *event)
 			log.Debug(event.String())
 			continue
@@ -176,9 +219,11 @@ func (e *EventManager) Process() []Event {
 	if cursor == sl {
 		e.stack = []fsnotify.Event{}
 		e.sumStack = []string{}
+		e.timeStack = []time.Time{}
 	} else {
 		e.stack = e.stack[sl-(sl-cursor):]
 		e.sumStack = e.sumStack[sl-(sl-cursor):]
+		e.timeStack = e.timeStack[sl-(sl-cursor):]
 	}
 	return newEvents
 }
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func checkSingleEventResult(t *testing.T, name string, expect Event, result []Event) {
@@ -156,3 +157,61 @@ func Test_EventQueue(t *testing.T) {
 		}
 	}
 }
+
+func Test_RetargetEvent(t *testing.T) {
+	handler := newEventHandler()
+	testFolder := t.TempDir()
+	link := filepath.Join(testFolder, "link")
+	tmp := filepath.Join(testFolder, "link.tmp")
+
+	// ln -sfn target link
+	_ = os.Symlink("old-target", link)
+	_ = os.Symlink("target", tmp)
+	handler.Append(fsnotify.Event{Name: tmp, Op: fsnotify.Create}, "")
+	_ = os.Rename(tmp, link)
+	handler.Append(fsnotify.Event{Name: tmp, Op: fsnotify.Rename}, "")
+	handler.Append(fsnotify.Event{Name: link, Op: fsnotify.Create}, "")
+
+	result := handler.Process()
+	if len(result) != 1 {
+		t.Fatalf("[retarget link] expected 1 event, got %d", len(result))
+	}
+	checkSingleEventResult(t, "[retarget link]", Event{FromPath: connector.NewFSPath(link), Type: Write}, result)
+}
+
+func Test_ChmodEvent(t *testing.T) {
+	handler := newEventHandler()
+	file := filepath.Join(t.TempDir(), "test.txt")
+	_ = os.WriteFile(file, []byte("test"), 0644)
+
+	// chmod 600 test.txt; echo test >> test.txt
+	handler.Append(fsnotify.Event{Name: file, Op: fsnotify.Chmod}, "")
+	handler.Append(fsnotify.Event{Name: file, Op: fsnotify.Write}, "")
+	result := handler.Process()
+	if len(result) != 2 {
+		t.Fatalf("[chmod file] expected 2 events, got %d", len(result))
+	}
+	checkSingleEventResult(t, "[chmod file]", Event{FromPath: connector.NewFSPath(file), Type: Chmod}, result)
+	checkSingleEventResult(t, "[chmod file]", Event{FromPath: connector.NewFSPath(file), Type: Write}, result[1:])
+}
+
+func Test_EventTime(t *testing.T) {
+	handler := newEventHandler()
+	file := filepath.Join(t.TempDir(), "test.txt")
+	_ = os.WriteFile(file, []byte("test"), 0644)
+
+	handler.Append(fsnotify.Event{Name: file, Op: fsnotify.Write}, "")
+	appended := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	handler.Append(fsnotify.Event{Name: file, Op: fsnotify.Chmod}, "")
+	result := handler.Process()
+	if len(result) != 2 {
+		t.Fatalf("[event time] expected 2 events, got %d", len(result))
+	}
+	if result[0].Time.IsZero() || result[0].Time.After(appended) {
+		t.Fatalf("[event time] write stamped at %s, appended before %s", result[0].Time, appended)
+	}
+	if !result[1].Time.After(appended) {
+		t.Fatalf("[event time] chmod stamped at %s, appended after %s", result[1].Time, appended)
+	}
+}
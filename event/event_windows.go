@@ -5,11 +5,14 @@ import (
 	"github.com/fsnotify/fsnotify"
 	log "github.com/sirupsen/logrus"
 	"sync"
+	"time"
 )
 
 type EventManager struct {
 	stack    []fsnotify.Event
 	sumStack []string
+	// timeStack holds the time each event of the stack was appended at.
+	timeStack []time.Time
 	sync.Mutex
 }
 
@@ -21,10 +24,13 @@ func (e *EventManager) Append(event fsnotify.Event, sum string) {
 	e.Lock()
 	e.stack = append(e.stack, event)
 	e.sumStack = append(e.sumStack, sum)
+	e.timeStack = append(e.timeStack, time.Now())
 	e.Unlock()
 }
 
 func (e *EventManager) StackLength() int {
+	e.Lock()
+	defer e.Unlock()
 	return len(e.stack)
 }
 
@@ -148,6 +154,8 @@ func (e *EventManager) Process() []Event {
 		}
 		e1 = &e.stack[cursor]
 		e1Sum = e.sumStack[cursor]
+		// the event is as old as the first of the events it is made of
+		at := e.timeStack[cursor]
 		if cursor+1 < sl {
 			e2 = &e.stack[cursor+1]
 			e2Sum = e.sumStack[cursor+1]
@@ -178,22 +186,26 @@ func (e *EventManager) Process() []Event {
 
 		if event, nc := e.isWrite(e1); event != nil {
 			cursor += nc
+			event.Time = at
 			newEvents = append(newEvents, *event)
 			continue
 		}
 		if event, nc := e.isRemove(e1, e2, e1Sum, e2Sum); event != nil {
 			cursor += nc
+			event.Time = at
 			newEvents = append(newEvents, *event)
 			continue
 		}
 		if event, nc := e.isCreate(e1, e2, e3, e4, e5, e6, e1Sum, e2Sum); event != nil {
 			cursor += nc
+			event.Time = at
 			newEvents = append(newEvents, *event)
 			// break and generate sum for nodeTree
 			break
 		}
 		if event, nc := e.isRename(e1, e2, e3, e4, e5); event != nil {
 			cursor += nc
+			event.Time = at
 			newEvents = append(newEvents, *event)
 			continue
 		}
@@ -202,9 +214,11 @@ func (e *EventManager) Process() []Event {
 	if cursor == sl {
 		e.stack = []fsnotify.Event{}
 		e.sumStack = []string{}
+		e.timeStack = []time.Time{}
 	} else {
 		e.stack = e.stack[sl-(sl-cursor):]
 		e.sumStack = e.sumStack[sl-(sl-cursor):]
+		e.timeStack = e.timeStack[sl-(sl-cursor):]
 	}
 	return newEvents
 }
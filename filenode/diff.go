@@ -0,0 +1,309 @@
+package filenode
+
+import (
+	"fmt"
+	"github.com/ayhanozemre/fs-shadow/event"
+	connector "github.com/ayhanozemre/fs-shadow/path"
+	"path/filepath"
+)
+
+// MetaField selects fields of MetaData, it is used as a bit mask.
+type MetaField uint
+
+const (
+	MetaSum MetaField = 1 << iota
+	MetaSize
+	// MetaCreatedAt covers CreatedAt, ModifiedAt and BornAt.
+	MetaCreatedAt
+	// MetaPermission covers Permission and Mode.
+	MetaPermission
+	MetaLink
+	// MetaOwner covers Uid, Gid, User and Group.
+	MetaOwner
+	// MetaInode covers Inode, Device and Nlink, which change when a file is replaced rather than written.
+	MetaInode
+)
+
+type DiffOptions struct {
+	// Ignore lists the metadata fields whose changes should not produce Write events.
+	Ignore MetaField
+}
+
+/*
+	Diff returns the events that turn oldTree into newTree when they are applied in order.
+	Nodes are matched by UUID first, then by Meta.Sum (which is how renames and moves between two scans are recognised,
+	since every scan generates new UUIDs) and finally by their path. Sums are only compared when they were computed with
+	the same hasher and are both full or both quick sums, pending sums are never compared. Paths of the events are in
+	the form Search expects, so they can be passed to the Handler of a virtual watcher holding oldTree.
+*/
+func Diff(oldTree, newTree *FileNode, opts DiffOptions) []event.Event {
+	d := differ{
+		opts:    opts,
+		matches: make(map[*FileNode]*FileNode),
+		matched: make(map[*FileNode]bool),
+		current: make(map[*FileNode]*FileNode),
+		kept:    make(map[*FileNode]bool),
+	}
+	d.match(oldTree, newTree)
+	d.apply(oldTree, newTree)
+	return d.events
+}
+
+type differ struct {
+	opts   DiffOptions
+	events []event.Event
+
+	// matches maps nodes of the new tree to the nodes of the old tree.
+	matches map[*FileNode]*FileNode
+	matched map[*FileNode]bool
+
+	// the events are applied to a copy of the old tree, so each one is built with the paths of the previous state.
+	work    *FileNode
+	clones  map[*FileNode]*FileNode
+	origins map[*FileNode]*FileNode
+	current map[*FileNode]*FileNode
+	kept    map[*FileNode]bool
+	temp    int
+}
+
+type diffEntry struct {
+	path   string
+	node   *FileNode
+	parent *FileNode
+}
+
+// sortedNodes lists the subs of root in pre-order with their paths relative to root.
+func sortedNodes(root *FileNode) []diffEntry {
+	var entries []diffEntry
+	it := NewIterator(root)
+	for it.Next() {
+		if it.Node() != root {
+			entries = append(entries, diffEntry{path: it.Path(), node: it.Node(), parent: it.Parent()})
+		}
+	}
+	return entries
+}
+
+func (d *differ) pair(o, n *FileNode) {
+	d.matches[n] = o
+	d.matched[o] = true
+}
+
+func (d *differ) match(oldTree, newTree *FileNode) {
+	d.pair(oldTree, newTree)
+	oldEntries := sortedNodes(oldTree)
+	newEntries := sortedNodes(newTree)
+
+	byUUID := make(map[string]*FileNode)
+	byPath := make(map[string]*FileNode)
+	bySum := make(map[string][]*FileNode)
+	for _, e := range oldEntries {
+		if e.node.UUID != "" {
+			byUUID[e.node.UUID] = e.node
+		}
+		byPath[e.path] = e.node
+		if e.node.Meta.Sum != "" {
+			bySum[sumKey(e.node.Meta)] = append(bySum[sumKey(e.node.Meta)], e.node)
+		}
+	}
+	free := func(o *FileNode, n *FileNode) bool {
+		return o != nil && !d.matched[o] && o.Meta.IsDir == n.Meta.IsDir
+	}
+
+	// uuid
+	for _, e := range newEntries {
+		if o := byUUID[e.node.UUID]; e.node.UUID != "" && free(o, e.node) {
+			d.pair(o, e.node)
+		}
+	}
+	// path and sum
+	for _, e := range newEntries {
+		if _, ok := d.matches[e.node]; ok {
+			continue
+		}
+		if o := byPath[e.path]; free(o, e.node) && sumKey(o.Meta) == sumKey(e.node.Meta) {
+			d.pair(o, e.node)
+		}
+	}
+	// sum, the candidates with the same name come first
+	for _, e := range newEntries {
+		if _, ok := d.matches[e.node]; ok || e.node.Meta.Sum == "" {
+			continue
+		}
+		var candidate *FileNode
+		for _, o := range bySum[sumKey(e.node.Meta)] {
+			if !free(o, e.node) {
+				continue
+			}
+			if candidate == nil || (o.Name == e.node.Name && candidate.Name != e.node.Name) {
+				candidate = o
+			}
+		}
+		if candidate != nil {
+			d.pair(candidate, e.node)
+		}
+	}
+	// path
+	for _, e := range newEntries {
+		if _, ok := d.matches[e.node]; ok {
+			continue
+		}
+		if o := byPath[e.path]; free(o, e.node) {
+			d.pair(o, e.node)
+		}
+	}
+}
+
+func (d *differ) clone(node *FileNode) *FileNode {
+	c := &FileNode{Name: node.Name, UUID: node.UUID, Meta: node.Meta}
+	d.clones[node] = c
+	d.origins[c] = node
+	for _, sub := range node.Subs {
+		c.addSub(d.clone(sub))
+	}
+	return c
+}
+
+func (d *differ) emit(t event.Type, from *FileNode, to string) {
+	e := event.Event{Type: t, FromPath: connector.NewVirtualPath(from.Path(), from.Meta.IsDir)}
+	if to != "" {
+		e.ToPath = connector.NewVirtualPath(to, t == event.Move || from.Meta.IsDir)
+	}
+	d.events = append(d.events, e)
+}
+
+// release makes sure the given name is available under parent before a node takes it.
+func (d *differ) release(parent *FileNode, name string) {
+	occupant := parent.sub(name)
+	if occupant == nil {
+		return
+	}
+	if !d.holdsMatches(occupant) {
+		d.emit(event.Remove, occupant, "")
+		parent.removeSub(occupant)
+		return
+	}
+	// the occupant, or something below it, is still waiting for its own event, so it is parked under a temporary name.
+	var tempName string
+	for tempName == "" || parent.sub(tempName) != nil {
+		d.temp++
+		tempName = fmt.Sprintf(".%s.fs-shadow-%d", name, d.temp)
+	}
+	d.emit(event.Rename, occupant, filepath.Join(parent.Path(), tempName))
+	parent.renameSub(occupant, tempName)
+}
+
+func (d *differ) holdsMatches(workNode *FileNode) bool {
+	if d.kept[workNode] || d.matched[d.origins[workNode]] {
+		return true
+	}
+	for _, sub := range workNode.Subs {
+		if d.holdsMatches(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *differ) apply(oldTree, newTree *FileNode) {
+	d.clones = make(map[*FileNode]*FileNode)
+	d.origins = make(map[*FileNode]*FileNode)
+	d.work = d.clone(oldTree)
+	d.current[newTree] = d.work
+	d.kept[d.work] = true
+
+	if d.work.Name != newTree.Name {
+		d.emit(event.Rename, d.work, newTree.Name)
+		d.work.Name = newTree.Name
+	}
+	if d.metaChanged(oldTree.Meta, newTree.Meta) {
+		d.emit(event.Write, d.work, "")
+	}
+
+	for _, e := range sortedNodes(newTree) {
+		n := e.node
+		parent := d.current[e.parent]
+
+		o, ok := d.matches[n]
+		if !ok {
+			d.release(parent, n.Name)
+			w := &FileNode{Name: n.Name, UUID: n.UUID, Meta: n.Meta}
+			parent.addSub(w)
+			d.emit(event.Create, w, "")
+			d.current[n] = w
+			d.kept[w] = true
+			continue
+		}
+
+		w := d.clones[o]
+		d.kept[w] = true
+		if w.parent != parent {
+			d.release(parent, w.Name)
+			d.emit(event.Move, w, parent.Path())
+			w.parent.removeSub(w)
+			parent.addSub(w)
+		}
+		if w.Name != n.Name {
+			d.release(parent, n.Name)
+			d.emit(event.Rename, w, filepath.Join(parent.Path(), n.Name))
+			parent.renameSub(w, n.Name)
+		}
+		if d.metaChanged(o.Meta, n.Meta) {
+			d.emit(event.Write, w, "")
+		}
+		d.current[n] = w
+	}
+
+	for _, e := range sortedNodes(d.work) {
+		if !d.kept[e.node] && d.kept[e.parent] {
+			d.emit(event.Remove, e.node, "")
+		}
+	}
+}
+
+// sumKind tells sums of different hashers apart, and full sums from quick ones. Pending sums can't be compared at all.
+func sumKind(m MetaData) string {
+	if m.SumPending {
+		return "pending"
+	}
+	if m.WeakSum {
+		return "quick-" + m.SumAlgorithm()
+	}
+	return m.SumAlgorithm()
+}
+
+func sumKey(m MetaData) string {
+	return sumKind(m) + ":" + m.Sum
+}
+
+func (d *differ) metaChanged(o, n MetaData) bool {
+	ignore := d.opts.Ignore
+	if o.IsDir != n.IsDir {
+		return true
+	}
+	// the sum of a folder follows the names of its subs, those changes are reported by their own events. Sums of
+	// different hashers or of a quick and a full sum can't be compared, the other fields have to tell.
+	if ignore&MetaSum == 0 && !n.IsDir && sumKind(o) == sumKind(n) && o.Sum != n.Sum {
+		return true
+	}
+	if ignore&MetaSize == 0 && o.Size != n.Size {
+		return true
+	}
+	// access and change times follow reads and the changes compared below, they never produce events by themselves.
+	if ignore&MetaCreatedAt == 0 && (o.CreatedAt != n.CreatedAt || o.ModifiedAt != n.ModifiedAt || o.BornAt != n.BornAt) {
+		return true
+	}
+	if ignore&MetaPermission == 0 && (o.Permission != n.Permission || o.FileMode() != n.FileMode()) {
+		return true
+	}
+	if ignore&MetaLink == 0 && (o.Type != n.Type || o.LinkTarget != n.LinkTarget) {
+		return true
+	}
+	if ignore&MetaOwner == 0 && (o.Uid != n.Uid || o.Gid != n.Gid || o.User != n.User || o.Group != n.Group) {
+		return true
+	}
+	if ignore&MetaInode == 0 && (o.Inode != n.Inode || o.Device != n.Device || o.Nlink != n.Nlink) {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+package filenode
+
+import (
+	"github.com/ayhanozemre/fs-shadow/event"
+	connector "github.com/ayhanozemre/fs-shadow/path"
+	"github.com/ayhanozemre/fs-shadow/utils"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"testing"
+)
+
+func makeDiffTree(sums map[string]string) *FileNode {
+	root := &FileNode{Name: "root", UUID: "root", Meta: MetaData{IsDir: true}}
+	var paths []string
+	for p := range sums {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		isDir := sums[p] == ""
+		_, _ = root.Create(connector.NewVirtualPath("root/"+p, isDir), connector.NewVirtualPath("root/"+p, isDir))
+		node := root.Search("root/" + p)
+		node.Meta.Sum = sums[p]
+		node.Meta.IsDir = isDir
+	}
+	return root
+}
+
+func treeShape(root *FileNode) map[string]string {
+	shape := make(map[string]string)
+	for _, e := range sortedNodes(root) {
+		shape[e.path] = e.node.Meta.Sum
+	}
+	return shape
+}
+
+func replay(t *testing.T, tree *FileNode, events []event.Event) {
+	for _, e := range events {
+		var err error
+		switch e.Type {
+		case event.Create:
+			_, err = tree.Create(e.FromPath, e.FromPath)
+		case event.Remove:
+			_, err = tree.Remove(e.FromPath)
+		case event.Rename:
+			_, err = tree.Rename(e.FromPath, e.ToPath)
+		case event.Move:
+			_, err = tree.Move(e.FromPath, e.ToPath)
+		case event.Write:
+			continue
+		}
+		assert.Equal(t, nil, err, "replay error: %s", e.String())
+	}
+}
+
+func Test_Diff(t *testing.T) {
+	oldTree := makeDiffTree(map[string]string{
+		"docs":           "",
+		"docs/a.txt":     "sum-a",
+		"docs/b.txt":     "sum-b",
+		"src":            "",
+		"src/main.go":    "sum-main",
+		"tmp":            "",
+		"tmp/cache.bin":  "sum-cache",
+		"notes.txt":      "sum-notes",
+		"readme.md":      "sum-readme",
+		"src/remove.txt": "sum-remove",
+	})
+	newTree := makeDiffTree(map[string]string{
+		"docs":          "",
+		"docs/a-2.txt":  "sum-a",
+		"src":           "",
+		"src/main.go":   "sum-main-2",
+		"src/b.txt":     "sum-b",
+		"notes.txt":     "",
+		"notes.txt/new": "sum-new",
+		"readme.md":     "sum-readme",
+	})
+
+	events := Diff(oldTree, newTree, DiffOptions{})
+	var types []event.Type
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	assert.Contains(t, types, event.Rename, "rename not detected")
+	assert.Contains(t, types, event.Move, "move not detected")
+	assert.Contains(t, types, event.Write, "write not detected")
+
+	replay(t, oldTree, events)
+	newShape := treeShape(newTree)
+	for p := range treeShape(oldTree) {
+		_, ok := newShape[p]
+		assert.True(t, ok, "unexpected node after replay: %s", p)
+	}
+	for p := range newShape {
+		assert.NotNil(t, oldTree.Search("root/"+p), "missing node after replay: %s", p)
+	}
+}
+
+func Test_DiffMatchesByUUID(t *testing.T) {
+	oldTree := makeDummyTree()
+	newTree := makeDummyTree()
+	newTree.UUID = oldTree.UUID
+	for i, sub := range newTree.Subs {
+		sub.UUID = oldTree.Subs[i].UUID
+	}
+	newTree.Subs[0].Name = "a-2"
+	newTree.Subs[1].Meta.CreatedAt = 10
+
+	events := Diff(oldTree, newTree, DiffOptions{Ignore: MetaCreatedAt})
+	assert.Equal(t, 1, len(events), "unexpected events")
+	assert.Equal(t, "event alphabet/a -> alphabet/a-2 [rename]", events[0].String(), "rename not detected")
+
+	events = Diff(oldTree, newTree, DiffOptions{})
+	assert.Equal(t, 2, len(events), "metadata change not detected")
+	assert.Equal(t, event.Write, events[1].Type, "metadata change not detected")
+}
+
+func Test_DiffSwap(t *testing.T) {
+	oldTree := makeDiffTree(map[string]string{"x": "sum-x", "y": "sum-y"})
+	newTree := makeDiffTree(map[string]string{"x": "sum-y", "y": "sum-x"})
+
+	events := Diff(oldTree, newTree, DiffOptions{})
+	replay(t, oldTree, events)
+	assert.Equal(t, treeShape(newTree), treeShape(oldTree), "swap replay error")
+}
+
+func Test_DiffOwnership(t *testing.T) {
+	oldTree := makeDummyTree()
+	newTree := makeDummyTree()
+	newTree.UUID = oldTree.UUID
+	for i, sub := range newTree.Subs {
+		sub.UUID = oldTree.Subs[i].UUID
+	}
+	newTree.Subs[2].Meta.Uid = 1000
+	newTree.Subs[2].Meta.User = "user"
+
+	events := Diff(oldTree, newTree, DiffOptions{})
+	assert.Equal(t, 1, len(events), "ownership change not detected")
+	assert.Equal(t, "event alphabet/c [write]", events[0].String(), "ownership change not detected")
+
+	events = Diff(oldTree, newTree, DiffOptions{Ignore: MetaOwner})
+	assert.Equal(t, 0, len(events), "ignored ownership change detected")
+}
+
+func Test_DiffHashers(t *testing.T) {
+	oldTree := makeDiffTree(map[string]string{"a": "sum-a", "b": "sum-b"})
+	newTree := makeDiffTree(map[string]string{"a": "sum-x", "c": "sum-b"})
+	for _, sub := range newTree.Subs {
+		sub.Meta.SumAlgo = utils.MD5
+	}
+
+	// the sums of a can't be compared and b can't be recognised as c by its sum
+	events := Diff(oldTree, newTree, DiffOptions{})
+	var types []event.Type
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	assert.ElementsMatch(t, []event.Type{event.Create, event.Remove}, types, "sums of different hashers compared")
+
+	for _, sub := range newTree.Subs {
+		sub.Meta.SumAlgo = utils.DefaultHasher
+	}
+	events = Diff(oldTree, newTree, DiffOptions{})
+	types = nil
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	assert.ElementsMatch(t, []event.Type{event.Write, event.Rename}, types, "sums of the same hasher not compared")
+}
@@ -0,0 +1,56 @@
+package filenode
+
+import "errors"
+
+// The reasons an operation on a tree fails, the operations return them wrapped in an OpError so they can be
+// checked with errors.Is.
+var (
+	ErrNotFound      = errors.New("FileNode not found")
+	ErrAlreadyExists = errors.New("FileNode already exists")
+	ErrNotDirectory  = errors.New("FileNode is not a directory")
+	ErrRootOperation = errors.New("operation not allowed on the root FileNode")
+	ErrMoveIntoSelf  = errors.New("FileNode can't be moved into itself")
+)
+
+// OpError records the operation that failed, the path and the uuid of the node it was called with and the reason.
+// Path is relative to the tree like in Search and either of Path and UUID may be empty.
+type OpError struct {
+	Op   string
+	Path string
+	UUID string
+	Err  error
+}
+
+func (e *OpError) Error() string {
+	s := e.Op
+	if e.Path != "" {
+		s += " " + e.Path
+	}
+	if e.UUID != "" {
+		s += " (" + e.UUID + ")"
+	}
+	return s + ": " + e.Err.Error()
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+func pathError(op string, path string, err error) error {
+	return &OpError{Op: op, Path: path, Err: err}
+}
+
+func uuidError(op string, uuid string, err error) error {
+	return &OpError{Op: op, UUID: uuid, Err: err}
+}
+
+// notDirectory tells whether the node is known to be something other than a folder, nodes built without metadata
+// can hold subs.
+func (fn *FileNode) notDirectory() bool {
+	return fn.Meta.Type != "" && !fn.Meta.IsDir
+}
+
+// isRoot tells whether the node is the root of its tree.
+func (fn *FileNode) isRoot() bool {
+	return fn.parent == nil && fn.tree != nil
+}
@@ -0,0 +1,57 @@
+package filenode
+
+import (
+	"errors"
+	connector "github.com/ayhanozemre/fs-shadow/path"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_OpErrors(t *testing.T) {
+	tree := makeDummyTree()
+	path := func(p string) connector.Path { return connector.NewVirtualPath(p, false) }
+
+	_, err := tree.Remove(path("alphabet/z"))
+	assert.True(t, errors.Is(err, ErrNotFound), "invalid error: %v", err)
+	var opErr *OpError
+	assert.True(t, errors.As(err, &opErr), "not an OpError")
+	assert.Equal(t, "remove", opErr.Op, "invalid op")
+	assert.Equal(t, "alphabet/z", opErr.Path, "invalid path")
+	assert.Equal(t, "remove alphabet/z: FileNode not found", err.Error(), "invalid message")
+
+	_, err = tree.RemoveByUUID("missing", tree.UUID)
+	assert.True(t, errors.As(err, &opErr) && opErr.UUID == "missing", "invalid uuid error: %v", err)
+	assert.True(t, errors.Is(err, ErrNotFound), "invalid error: %v", err)
+
+	_, err = tree.Remove(path("alphabet"))
+	assert.True(t, errors.Is(err, ErrRootOperation), "root removed: %v", err)
+	_, err = tree.RemoveByUUID(tree.UUID, "")
+	assert.True(t, errors.Is(err, ErrRootOperation), "root removed by uuid: %v", err)
+	_, err = tree.MoveByUUID(tree.UUID, tree.Subs[0].UUID)
+	assert.True(t, errors.Is(err, ErrRootOperation), "root moved: %v", err)
+
+	_, err = tree.Rename(path("alphabet/a"), path("alphabet/b"))
+	assert.True(t, errors.Is(err, ErrAlreadyExists), "invalid error: %v", err)
+	_, err = tree.Create(path("alphabet/missing/e"), path("alphabet/missing/e"))
+	assert.True(t, errors.Is(err, ErrNotFound), "created without a parent: %v", err)
+
+	file := tree.Search("alphabet/c").SetMeta(MetaData{Type: TypeRegular})
+	_, err = tree.Move(path("alphabet/a"), path("alphabet/c"))
+	assert.True(t, errors.Is(err, ErrNotDirectory), "moved into a file: %v", err)
+	assert.True(t, errors.Is(file.AddSub(&FileNode{Name: "e"}), ErrNotDirectory), "added to a file")
+	_, err = tree.Create(path("alphabet/c/e"), path("alphabet/c/e"))
+	assert.True(t, errors.Is(err, ErrNotDirectory), "created in a file: %v", err)
+
+	folder := tree.Search("alphabet/a")
+	inner := &FileNode{Name: "inner", UUID: "inner"}
+	assert.Equal(t, nil, folder.AddSub(inner), "add error")
+	_, err = tree.MoveByUUID(folder.UUID, inner.UUID)
+	assert.True(t, errors.Is(err, ErrMoveIntoSelf), "moved into its own subtree: %v", err)
+	_, err = tree.Move(path("alphabet/a"), path("alphabet/a/inner"))
+	assert.True(t, errors.Is(err, ErrMoveIntoSelf), "moved into its own subtree: %v", err)
+	_, err = tree.MoveByUUID(folder.UUID, folder.UUID)
+	assert.True(t, errors.Is(err, ErrMoveIntoSelf), "moved into itself: %v", err)
+	assert.Equal(t, "alphabet/a/inner", tree.SearchByUUID("inner").Path(), "moved node changed")
+
+	assert.Equal(t, 4, len(tree.Subs), "tree changed by failed operations")
+}
@@ -1,13 +1,10 @@
 package filenode
 
 import (
-	"errors"
-	"fmt"
 	"github.com/ayhanozemre/fs-shadow/path"
 	"github.com/ayhanozemre/fs-shadow/utils"
 	"github.com/google/uuid"
-	log "github.com/sirupsen/logrus"
-	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -19,131 +16,419 @@ type FileNode struct {
 	UUID       string      `json:"uuid"`
 	ParentUUID string      `json:"parent_uuid"`
 	Meta       MetaData    `json:"meta"`
+	Stats      Stats       `json:"stats"`
+	// Chunks is the chunk manifest of a file larger than the maximum chunk size, when the tree chunks files. It
+	// changes together with Meta.Sum.
+	Chunks []utils.Chunk `json:"chunks,omitempty"`
+
+	// subIndex maps the names of Subs to their nodes so lookups don't have to scan the slice.
+	subIndex map[string]*FileNode
+	// parent is not serialized, it is rebuilt by Reindex.
+	parent *FileNode
+	// tree is only set on the root node.
+	tree *tree
+	// gen is the generation of the tree the node was created or copied in, see Snapshot.
+	gen uint64
+	// counted is the share of the node in the stats of its parent, see propagate.
+	counted Stats
 }
 
 func (fn *FileNode) Move(fromPath connector.Path, toPath connector.Path) (*FileNode, error) {
 	// /home/test/folder1/folder2 ->  /home/test = /home/test/folder2
+	if _, err := fn.writable(); err != nil {
+		return nil, err
+	}
 	toNode := fn.Search(toPath.String())
 	if toNode == nil {
-		return nil, errors.New("to FileNode not found")
+		return nil, pathError("move", toPath.String(), ErrNotFound)
 	}
-	for _, subNode := range toNode.Subs {
-		if fromPath.Name() == subNode.Name {
-			return nil, errors.New("FileNode already exists")
+	if toNode.notDirectory() {
+		return nil, pathError("move", toPath.String(), ErrNotDirectory)
+	}
+	if toNode.sub(fromPath.Name()) != nil {
+		return nil, pathError("move", toPath.String()+connector.Separator+fromPath.Name(), ErrAlreadyExists)
+	}
+
+	parentNode := fn.Search(fromPath.ParentPath().String())
+	if parentNode == nil {
+		if node := fn.Search(fromPath.String()); node != nil && node.isRoot() {
+			return nil, pathError("move", fromPath.String(), ErrRootOperation)
 		}
+		return nil, pathError("move", fromPath.String(), ErrNotFound)
+	}
+	node := parentNode.sub(fromPath.Name())
+	if node == nil {
+		return nil, pathError("move", fromPath.String(), ErrNotFound)
+	}
+	if toNode.isWithin(node) {
+		return nil, pathError("move", toPath.String(), ErrMoveIntoSelf)
 	}
+	return node.moveTo(toNode), nil
+}
 
-	node, err := fn.Remove(fromPath)
-	if err != nil {
+func (fn *FileNode) MoveByUUID(uuid string, parentUUID string) (*FileNode, error) {
+	if _, err := fn.writable(); err != nil {
 		return nil, err
 	}
-	node.ParentUUID = toNode.UUID
-	toNode.Subs = append(toNode.Subs, node)
-	return node, nil
+	node := fn.SearchByUUID(uuid)
+	if node == nil {
+		return nil, uuidError("move", uuid, ErrNotFound)
+	}
+	if node.isRoot() {
+		return nil, uuidError("move", uuid, ErrRootOperation)
+	}
+	toNode := fn.SearchByUUID(parentUUID)
+	if toNode == nil {
+		return nil, uuidError("move", parentUUID, ErrNotFound)
+	}
+	if node.parent == toNode {
+		return node, nil
+	}
+	if toNode.notDirectory() {
+		return nil, uuidError("move", parentUUID, ErrNotDirectory)
+	}
+	if toNode.sub(node.Name) != nil {
+		return nil, uuidError("move", uuid, ErrAlreadyExists)
+	}
+	if toNode.isWithin(node) {
+		return nil, uuidError("move", parentUUID, ErrMoveIntoSelf)
+	}
+	return node.moveTo(toNode), nil
+}
+
+func (fn *FileNode) moveTo(toNode *FileNode) *FileNode {
+	// the node stays in the same tree, so the uuid index doesn't change.
+	t := toNode.state()
+	toNode = toNode.mutable(t)
+	fn = fn.mutable(t)
+	fromNode := fn.parent
+	fromNode.removeSub(fn)
+	fn.ParentUUID = toNode.UUID
+	toNode.addSub(fn)
+	fromNode.propagate(t)
+	fn.propagate(t)
+	return fn
 }
 
 func (fn *FileNode) Rename(fromPath connector.Path, toPath connector.Path) (*FileNode, error) {
+	t, err := fn.writable()
+	if err != nil {
+		return nil, err
+	}
 	parentNode := fn.Search(fromPath.ParentPath().String())
 	if parentNode == nil {
-		return nil, errors.New("FileNode not found")
+		if node := fn.Search(fromPath.String()); node != nil && node.isRoot() {
+			return nil, pathError("rename", fromPath.String(), ErrRootOperation)
+		}
+		return nil, pathError("rename", fromPath.String(), ErrNotFound)
 	}
 
-	for _, subNode := range parentNode.Subs {
-		if toPath.Name() == subNode.Name {
-			return nil, errors.New("FileNode already exists")
-		}
+	if parentNode.sub(toPath.Name()) != nil {
+		return nil, pathError("rename", toPath.String(), ErrAlreadyExists)
 	}
 
-	node := fn.Search(fromPath.String())
+	node := parentNode.sub(fromPath.Name())
 	if node == nil {
-		return nil, errors.New("FileNode not found")
+		return nil, pathError("rename", fromPath.String(), ErrNotFound)
 	}
 
-	node.Name = toPath.Name()
+	node = node.mutable(t)
+	parentNode = node.parent
+	parentNode.renameSub(node, toPath.Name())
+	parentNode.propagate(t)
+	return node, nil
+}
+
+func (fn *FileNode) RenameByUUID(uuid string, name string) (*FileNode, error) {
+	t, err := fn.writable()
+	if err != nil {
+		return nil, err
+	}
+	node := fn.SearchByUUID(uuid)
+	if node == nil {
+		return nil, uuidError("rename", uuid, ErrNotFound)
+	}
+	node = node.mutable(t)
+	if node.parent == nil {
+		node.Name = name
+		return node, nil
+	}
+	if node.parent.sub(name) != nil {
+		return nil, uuidError("rename", uuid, ErrAlreadyExists)
+	}
+	parent := node.parent
+	parent.renameSub(node, name)
+	parent.propagate(t)
 	return node, nil
 }
 
 func (fn *FileNode) Remove(fromPath connector.Path) (deletedNode *FileNode, err error) {
+	if _, err = fn.writable(); err != nil {
+		return nil, err
+	}
+	if node := fn.Search(fromPath.String()); node != nil && node.isRoot() {
+		return nil, pathError("remove", fromPath.String(), ErrRootOperation)
+	}
 	fileName := fromPath.Name()
 	parentNode := fn.Search(fromPath.ParentPath().String())
 	return fn._remove(parentNode, fileName)
 }
 
 func (fn *FileNode) RemoveByUUID(uuid string, parentUUID string) (*FileNode, error) {
+	if _, err := fn.writable(); err != nil {
+		return nil, err
+	}
+	if node := fn.SearchByUUID(uuid); node != nil && node.isRoot() {
+		return nil, uuidError("remove", uuid, ErrRootOperation)
+	}
 	parentNode := fn.SearchByUUID(parentUUID)
 	return fn._remove(parentNode, uuid, "uuid")
 }
 
+// _remove takes the sub of parentNode with the name uniq, or with the uuid uniq when searchField is "uuid", out of
+// the tree.
 func (fn *FileNode) _remove(parentNode *FileNode, uniq string, searchField ...string) (deletedNode *FileNode, err error) {
-	if parentNode == nil {
-		return nil, errors.New("FileNode not found")
-	}
-	if len(parentNode.Subs) == 0 {
-		return nil, errors.New("subs nodes not found")
+	byUUID := len(searchField) > 0 && searchField[0] == "uuid"
+	if parentNode != nil && byUUID {
+		for _, sub := range parentNode.Subs {
+			if sub.UUID == uniq {
+				deletedNode = sub
+				break
+			}
+		}
+	} else if parentNode != nil {
+		deletedNode = parentNode.sub(uniq)
 	}
-	for nodeIndex, sub := range parentNode.Subs {
-		var lookupValue string
-		if len(searchField) > 0 && searchField[0] == "uuid" {
-			lookupValue = sub.UUID
-		} else {
-			lookupValue = sub.Name
+	if deletedNode == nil {
+		if byUUID {
+			return nil, uuidError("remove", uniq, ErrNotFound)
 		}
-		if lookupValue == uniq {
-			deletedNode = parentNode.Subs[nodeIndex]
-			parentNode.Subs = append(parentNode.Subs[:nodeIndex], parentNode.Subs[nodeIndex+1:]...)
-			return deletedNode, nil
+		if parentNode != nil {
+			uniq = parentNode.Path() + connector.Separator + uniq
 		}
+		return nil, pathError("remove", uniq, ErrNotFound)
 	}
-	return nil, err
+	t := parentNode.indexed()
+	if t != nil {
+		parentNode = parentNode.mutable(t)
+	}
+	parentNode.removeSub(deletedNode)
+	if t != nil {
+		t.unregister(deletedNode)
+		parentNode.propagate(t)
+	}
+	return deletedNode, nil
 }
 
-func (fn *FileNode) Update(fromPath connector.Path, absolutePath connector.Path) (*FileNode, error) {
+// Update refreshes the sum and metadata of the node at fromPath, ch is only used when a followed symlink has to
+// be rescanned.
+func (fn *FileNode) Update(fromPath connector.Path, absolutePath connector.Path, ch ...chan connector.Path) (*FileNode, error) {
+	t, err := fn.writable()
+	if err != nil {
+		return nil, err
+	}
 	node := fn.Search(fromPath.String())
 	if node == nil {
-		return nil, errors.New("FileNode not found")
+		return nil, pathError("update", fromPath.String(), ErrNotFound)
+	}
+	node = node.mutable(t)
+	if node.Meta.Type == TypeSymlink && t.opts.Links == LinkFollow && !absolutePath.IsVirtual() {
+		return node.relink(t, absolutePath, ch...)
 	}
-	err := node.SumUpdate(absolutePath)
+	err = node.SumUpdate(absolutePath)
 	if err != nil {
 		return node, err
 	}
 	return node, nil
 }
 
-func (fn *FileNode) UpdateWithExtra(extra ExtraPayload) {
+// UpgradeSum replaces the weak sum of the node at fromPath with the sum of its whole content, see MetaData.WeakSum.
+// Nodes with a full sum are returned unchanged.
+func (fn *FileNode) UpgradeSum(fromPath connector.Path, absolutePath connector.Path) (*FileNode, error) {
+	t, err := fn.writable()
+	if err != nil {
+		return nil, err
+	}
+	node := fn.Search(fromPath.String())
+	if node == nil {
+		return nil, pathError("upgrade sum", fromPath.String(), ErrNotFound)
+	}
+	if !node.Meta.WeakSum || absolutePath.IsVirtual() {
+		return node, nil
+	}
+	info, err := os.Lstat(absolutePath.String())
+	if err != nil {
+		return nil, err
+	}
+	w := newFsWalk(fn, absolutePath.ParentPath().String())
+	w.quick = utils.QuickSampling{}
+	w.deferred = false
+	meta, chunks, _, _, err := w.stat(absolutePath.String(), info)
+	if err != nil {
+		return nil, err
+	}
+	node = node.mutable(t)
+	node.Meta = meta
+	node.Chunks = chunks
+	node.propagate(t)
+	return node, nil
+}
+
+// ComputeSum reads the file at absolutePath and returns its metadata with the sum a scan with opts would give it,
+// without deferring. It doesn't touch any tree, so a deferred sum can be computed without holding the lock of the tree
+// and stored with ResolveSum.
+func ComputeSum(opts Options, absolutePath connector.Path) (MetaData, []utils.Chunk, error) {
+	info, err := os.Lstat(absolutePath.String())
+	if err != nil {
+		return MetaData{}, nil, err
+	}
+	w := walkWith(opts, absolutePath.ParentPath().String())
+	w.deferred = false
+	meta, chunks, _, _, err := w.stat(absolutePath.String(), info)
+	return meta, chunks, err
+}
+
+// ResolveSum stores meta, computed by ComputeSum, in the node identified by uuid when its sum is still pending, or weak
+// while meta has a full one, and meta describes the same version of the file. It returns the node of the live tree and
+// whether meta was stored, a file that changed since is left for the sum of its newer version.
+func (fn *FileNode) ResolveSum(uuid string, meta MetaData, chunks []utils.Chunk) (*FileNode, bool) {
+	t, err := fn.writable()
+	if err != nil {
+		return nil, false
+	}
+	node := fn.SearchByUUID(uuid)
+	if node == nil || !(node.Meta.SumPending || node.Meta.WeakSum && !meta.WeakSum) {
+		return node, false
+	}
+	if node.Meta.Inode != meta.Inode || node.Meta.Size != meta.Size || node.Meta.ModifiedAt != meta.ModifiedAt {
+		return node, false
+	}
+	node = node.mutable(t)
+	meta.IsDir = node.Meta.IsDir
+	node.Meta = meta
+	node.Chunks = chunks
+	node.propagate(t)
+	return node, true
+}
+
+// UpdateAttrs refreshes the permission, ownership and timestamps of the node at fromPath, its content isn't read.
+// Virtual nodes are returned unchanged.
+func (fn *FileNode) UpdateAttrs(fromPath connector.Path, absolutePath connector.Path) (*FileNode, error) {
+	t, err := fn.writable()
+	if err != nil {
+		return nil, err
+	}
+	node := fn.Search(fromPath.String())
+	if node == nil {
+		return nil, pathError("update attrs", fromPath.String(), ErrNotFound)
+	}
+	if absolutePath.IsVirtual() {
+		return node, nil
+	}
+	info, err := os.Lstat(absolutePath.String())
+	if err != nil {
+		return nil, err
+	}
+	node = node.mutable(t)
+	w := fsWalk{links: t.opts.Links}
+	node.Meta.setAttrs(absolutePath.String(), w.attrs(absolutePath.String(), info))
+	node.propagate(t)
+	return node, nil
+}
+
+// UpdateWithExtra replaces the uuid and the metadata of the node and returns the node of the live tree that holds
+// them, which is a copy of fn when fn was shared with a snapshot.
+func (fn *FileNode) UpdateWithExtra(extra ExtraPayload) *FileNode {
+	t := fn.indexed()
+	if t != nil {
+		if t.frozen {
+			return fn
+		}
+		fn = fn.mutable(t)
+		if fn.UUID != extra.UUID {
+			t.unregister(fn)
+			defer t.register(fn)
+		}
+	}
 	fn.UUID = extra.UUID
 	fn.Meta.IsDir = extra.IsDir
 	fn.Meta.Size = extra.Size
 	fn.Meta.Sum = extra.Sum
+	fn.Meta.SumAlgo = extra.SumAlgo
+	fn.Meta.WeakSum = extra.WeakSum
+	fn.Meta.SumPending = extra.SumPending
 	fn.Meta.CreatedAt = extra.CreatedAt
 	fn.Meta.Permission = extra.Permission
+	fn.Meta.Type = extra.Type
+	fn.Meta.LinkTarget = extra.LinkTarget
+	fn.Meta.Uid = extra.Uid
+	fn.Meta.Gid = extra.Gid
+	fn.Meta.User = extra.User
+	fn.Meta.Group = extra.Group
+	fn.Meta.Inode = extra.Inode
+	fn.Meta.Device = extra.Device
+	fn.Meta.Nlink = extra.Nlink
+	fn.Meta.ModifiedAt = extra.ModifiedAt
+	fn.Meta.ChangedAt = extra.ChangedAt
+	fn.Meta.AccessedAt = extra.AccessedAt
+	fn.Meta.BornAt = extra.BornAt
+	fn.Meta.Mode = extra.Mode
+	if t != nil {
+		fn.propagate(t)
+	}
+	return fn
 }
 
-func (fn *FileNode) Create(fromPath connector.Path, absolutePath connector.Path, ch ...chan connector.Path) (*FileNode, error) {
-	var sum string
-	var err error
+// SetChunks replaces the chunk manifest of the node and returns the node of the live tree like SetMeta.
+func (fn *FileNode) SetChunks(chunks []utils.Chunk) *FileNode {
+	t, err := fn.writable()
+	if err != nil {
+		return fn
+	}
+	fn = fn.mutable(t)
+	fn.Chunks = chunks
+	return fn
+}
 
-	if !absolutePath.IsVirtual() {
-		sum, err = utils.Sum(absolutePath)
-		if err != nil {
-			return nil, err
-		}
+// SetMeta replaces the metadata of the node and updates the sums that depend on it, like UpdateWithExtra it
+// returns the node of the live tree.
+func (fn *FileNode) SetMeta(meta MetaData) *FileNode {
+	t, err := fn.writable()
+	if err != nil {
+		return fn
 	}
+	fn = fn.mutable(t)
+	fn.Meta = meta
+	fn.propagate(t)
+	return fn
+}
 
+func (fn *FileNode) Create(fromPath connector.Path, absolutePath connector.Path, ch ...chan connector.Path) (*FileNode, error) {
+	t, err := fn.writable()
+	if err != nil {
+		return nil, err
+	}
 	parentNode := fn.Search(fromPath.ParentPath().String())
 	if parentNode == nil {
+		if fromPath.String() != fn.Name {
+			return nil, pathError("create", fromPath.ParentPath().String(), ErrNotFound)
+		}
 		if !fromPath.IsVirtual() {
+			fn = fn.mutable(t)
 			var wg sync.WaitGroup
 			WalkOnFsPath(fn, absolutePath, &wg, ch[0])
 			wg.Wait()
+			fn.Reindex()
 		}
 		return fn, nil
 	}
 
 	// validation
-	for _, subNode := range parentNode.Subs {
-		if subNode.Name == fromPath.Name() {
-			return nil, errors.New("this file already exist")
-		}
+	if parentNode.notDirectory() {
+		return nil, pathError("create", fromPath.ParentPath().String(), ErrNotDirectory)
+	}
+	if parentNode.sub(fromPath.Name()) != nil {
+		return nil, pathError("create", fromPath.String(), ErrAlreadyExists)
 	}
 
 	var _uuid string
@@ -153,120 +438,215 @@ func (fn *FileNode) Create(fromPath connector.Path, absolutePath connector.Path,
 	absolutePathInfo := absolutePath.Info()
 	meta := MetaData{
 		IsDir:      absolutePath.IsDir(),
-		Sum:        sum,
 		Size:       absolutePathInfo.Size,
 		CreatedAt:  absolutePathInfo.CreatedAt,
 		Permission: absolutePathInfo.Permission,
 	}
+	descend := false
+	var chunks []utils.Chunk
+	if !absolutePath.IsVirtual() {
+		info, err := os.Lstat(absolutePath.String())
+		if err != nil {
+			return nil, err
+		}
+		meta, chunks, descend, _, err = newFsWalk(fn, absolutePath.ParentPath().String()).stat(absolutePath.String(), info)
+		if err != nil {
+			return nil, err
+		}
+	}
 	node := FileNode{
 		Name:       fromPath.Name(),
 		UUID:       _uuid,
 		ParentUUID: parentNode.UUID,
 		Meta:       meta,
+		Chunks:     chunks,
 		Subs:       []*FileNode{},
 	}
-	parentNode.Subs = append(parentNode.Subs, &node)
-	if absolutePath.IsDir() && !absolutePath.IsVirtual() {
+	parentNode = parentNode.mutable(t)
+	parentNode.addSub(&node)
+	if descend {
 		var wg sync.WaitGroup
 		WalkOnFsPath(&node, absolutePath, &wg, ch[0])
 		wg.Wait()
 	}
+	t.adopt(&node)
+	node.reindexSubs(t)
+	t.register(&node)
+	node.recompute(t)
+	node.propagate(t)
 	return &node, nil
 }
 
 func (fn *FileNode) SumUpdate(absolutePath connector.Path) error {
-	sum, err := utils.Sum(absolutePath)
+	t, err := fn.writable()
 	if err != nil {
 		return err
 	}
-	fn.Meta.Sum = sum
+	fn = fn.mutable(t)
+	if fn.Meta.IsDir && t.opts.Merkle {
+		fn.propagate(t)
+		return nil
+	}
+	if absolutePath.IsVirtual() {
+		sum, err := utils.SumWith(absolutePath, t.opts.hasher())
+		if err != nil {
+			return err
+		}
+		fn.Meta.Sum = sum
+		fn.Meta.SumAlgo = t.opts.hasher()
+		fn.Meta.WeakSum = false
+		fn.Meta.SumPending = false
+		fn.propagate(t)
+		return nil
+	}
+	info, err := os.Lstat(absolutePath.String())
+	if err != nil {
+		return err
+	}
+	meta, chunks, _, _, err := newFsWalk(fn, absolutePath.ParentPath().String()).stat(absolutePath.String(), info)
+	if err != nil {
+		return err
+	}
+	meta.IsDir = fn.Meta.IsDir
+	fn.Meta = meta
+	if !meta.SumPending {
+		// a pending sum keeps the manifest of the last one, the chunks are compared when it is resolved
+		fn.Chunks = chunks
+	}
+	fn.propagate(t)
 	return nil
 }
 
+// relink rescans a followed symlink whose target has changed, the folder it pointed to may have been replaced by
+// another one or by a file. The folders found are sent to ch like in Create.
+func (fn *FileNode) relink(t *tree, absolutePath connector.Path, ch ...chan connector.Path) (*FileNode, error) {
+	info, err := os.Lstat(absolutePath.String())
+	if err != nil {
+		return fn, err
+	}
+	meta, chunks, descend, _, err := newFsWalk(fn, absolutePath.ParentPath().String()).stat(absolutePath.String(), info)
+	if err != nil {
+		return fn, err
+	}
+	for _, sub := range fn.Subs {
+		t.unregister(sub)
+	}
+	fn.Subs = []*FileNode{}
+	fn.buildSubIndex()
+	fn.Meta = meta
+	if !meta.SumPending {
+		fn.Chunks = chunks
+	}
+	if descend {
+		var links chan connector.Path
+		if len(ch) > 0 {
+			links = ch[0]
+		}
+		var wg sync.WaitGroup
+		WalkOnFsPath(fn, absolutePath, &wg, links)
+		wg.Wait()
+		t.adopt(fn)
+		fn.reindexSubs(t)
+		t.register(fn)
+	}
+	fn.recompute(t)
+	fn.propagate(t)
+	return fn, nil
+}
+
+// Search resolves a path such as "root/folder/file.txt" relative to the node's parent.
+// Every level is a single map lookup, so the cost only depends on the depth of the path.
 func (fn *FileNode) Search(path string) *FileNode {
 	pathExp := strings.Split(path, connector.Separator)
-	if fn.Name == pathExp[0] && len(pathExp) == 1 {
-		return fn
+	if fn.Name != pathExp[0] {
+		return nil
 	}
-	if fn.Name == pathExp[0] && len(pathExp) != 1 {
-		newPath := filepath.Join(pathExp[1:]...)
-		var wg sync.WaitGroup
-		var wantedNode *FileNode
-		for _, sub := range fn.Subs {
-			wg.Add(1)
-			go func(sub *FileNode) {
-				node := sub.Search(newPath)
-				if node != nil {
-					wantedNode = node
-				}
-				wg.Done()
-			}(sub)
+	node := fn
+	for _, name := range pathExp[1:] {
+		if name == "" {
+			continue
 		}
-		wg.Wait()
-		if wantedNode != nil {
-			return wantedNode
+		node = node.sub(name)
+		if node == nil {
+			return nil
 		}
 	}
-
-	return nil
+	return fn.frozen().view(node)
 }
 
 func (fn *FileNode) SearchByUUID(uuid string) *FileNode {
-	if fn.UUID == uuid {
-		return fn
+	t := fn.state()
+	if t.frozen {
+		return t.view(fn.searchSnapshot(uuid))
 	}
-	if len(fn.Subs) == 0 {
+	node := t.uuids[uuid]
+	if node == nil || !node.isWithin(fn) {
 		return nil
 	}
-	var wantedNode *FileNode
-	var wg sync.WaitGroup
-	for _, sn := range fn.Subs {
-		wg.Add(1)
-		go func(sn *FileNode) {
-			node := sn.SearchByUUID(uuid)
-			if node != nil {
-				wantedNode = node
-			}
-			wg.Done()
-		}(sn)
+	return node
+}
+
+// Path rebuilds the path of the node from the root of its tree, in the same form Search expects.
+// It relies on parent pointers, so it is meant for the nodes of the live tree and not for the ones of a snapshot.
+func (fn *FileNode) Path() string {
+	var names []string
+	for node := fn; node != nil; node = node.parent {
+		names = append(names, node.Name)
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
 	}
-	wg.Wait()
-	return wantedNode
+	return strings.Join(names, connector.Separator)
 }
 
-func WalkOnFsPath(root *FileNode, absolutePath connector.Path, wg *sync.WaitGroup, ch chan connector.Path) {
-	ch <- absolutePath
-	files, _ := ioutil.ReadDir(absolutePath.String())
-	for _, path := range files {
-		newAbsolutePath := connector.NewFSPath(filepath.Join(absolutePath.String(), path.Name()))
-		mode := fmt.Sprintf("%d", path.Mode())
+// relPath is the path of the node relative to the root of its tree with slashes, empty for the root.
+func relPath(fn *FileNode) string {
+	p := filepath.ToSlash(fn.Path())
+	if i := strings.Index(p, "/"); i >= 0 {
+		return p[i+1:]
+	}
+	return ""
+}
 
-		sum, err := utils.Sum(newAbsolutePath)
-		if err != nil {
-			log.Error("sum error:", newAbsolutePath, err)
-		}
+// AddSub appends node, together with its own subs, to the subs of fn.
+func (fn *FileNode) AddSub(node *FileNode) error {
+	t, err := fn.writable()
+	if err != nil {
+		return err
+	}
+	if fn.notDirectory() {
+		return uuidError("add", fn.UUID, ErrNotDirectory)
+	}
+	if fn.sub(node.Name) != nil {
+		return uuidError("add", node.UUID, ErrAlreadyExists)
+	}
+	fn = fn.mutable(t)
+	node.ParentUUID = fn.UUID
+	fn.addSub(node)
+	t.adopt(node)
+	node.reindexSubs(t)
+	t.register(node)
+	node.recompute(t)
+	node.propagate(t)
+	return nil
+}
 
-		newNode := FileNode{
-			Name:       path.Name(),
-			UUID:       uuid.NewString(),
-			ParentUUID: root.UUID,
-			Subs:       []*FileNode{},
-			Meta: MetaData{
-				IsDir:      path.IsDir(),
-				Sum:        sum,
-				Size:       path.Size(),
-				CreatedAt:  path.ModTime().Unix(),
-				Permission: mode,
-			},
-		}
-		root.Subs = append(root.Subs, &newNode)
-
-		if path.IsDir() {
-			wg.Add(1)
-			go func() {
-				WalkOnFsPath(&newNode, newAbsolutePath, wg, ch)
-				wg.Done()
-			}()
-		}
+// WalkOnFsPath adds the entries found under absolutePath to root, every folder it descends into is sent to ch.
+// Symlinks are handled according to the LinkPolicy of the tree root belongs to and the work is bounded by its
+// ScanLimits. The scan runs in the background until wg is done.
+func WalkOnFsPath(root *FileNode, absolutePath connector.Path, wg *sync.WaitGroup, ch chan connector.Path) {
+	var opts Options
+	if t := root.indexed(); t != nil {
+		opts = t.opts
+	}
+	w := newFsWalk(root, absolutePath.String())
+	w.rel = relPath(root)
+	if w.maxDepth > 0 && depth(w.rel) >= w.maxDepth {
+		return
 	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		newScan(opts, ch).run(w, root, absolutePath)
+	}()
 }
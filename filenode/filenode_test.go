@@ -2,6 +2,7 @@ package filenode
 
 import (
 	connector "github.com/ayhanozemre/fs-shadow/path"
+	"github.com/ayhanozemre/fs-shadow/utils"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"os"
@@ -216,3 +217,165 @@ func Test_RemoveCore(t *testing.T) {
 	assert.Equal(t, treeSubLength-2, len(tree.Subs), "delete process error")
 
 }
+
+func Test_SearchIndex(t *testing.T) {
+	tree := makeDummyTree()
+	assert.NotNil(t, tree.Search("alphabet/c"), "lazy index lookup error")
+	assert.Nil(t, tree.Search("alphabet/z"), "unknown node found")
+	assert.Nil(t, tree.Search("other/c"), "wrong root matched")
+
+	_, err := tree.Rename(connector.NewVirtualPath("alphabet/c", false), connector.NewVirtualPath("alphabet/z", false))
+	assert.Equal(t, nil, err, "rename process error")
+	assert.Nil(t, tree.Search("alphabet/c"), "old name still indexed")
+	assert.NotNil(t, tree.Search("alphabet/z"), "new name not indexed")
+
+	_, err = tree.Move(connector.NewVirtualPath("alphabet/z", false), connector.NewVirtualPath("alphabet/a", true))
+	assert.Equal(t, nil, err, "move process error")
+	assert.Nil(t, tree.Search("alphabet/z"), "moved node still indexed in old parent")
+	assert.NotNil(t, tree.Search("alphabet/a/z"), "moved node not indexed in new parent")
+
+	_, err = tree.Remove(connector.NewVirtualPath("alphabet/a/z", false))
+	assert.Equal(t, nil, err, "remove process error")
+	assert.Nil(t, tree.Search("alphabet/a/z"), "removed node still indexed")
+
+	// direct modifications are picked up after Reindex
+	tree.Subs[0].Name = "renamed"
+	tree.Reindex()
+	assert.NotNil(t, tree.Search("alphabet/renamed"), "reindex error")
+}
+
+func Test_UUIDIndex(t *testing.T) {
+	tree := makeDummyTree()
+	a, d := tree.Subs[0], tree.Subs[3]
+	assert.Equal(t, d, tree.SearchByUUID(d.UUID), "uuid lookup error")
+	assert.Equal(t, "alphabet/d", d.Path(), "invalid node path")
+
+	_, err := tree.MoveByUUID(d.UUID, a.UUID)
+	assert.Equal(t, nil, err, "move by uuid error")
+	assert.Equal(t, a.UUID, d.ParentUUID, "parent uuid not updated")
+	assert.Equal(t, "alphabet/a/d", d.Path(), "path not updated after move")
+	assert.Nil(t, a.SearchByUUID(tree.Subs[1].UUID), "node found outside of the searched subtree")
+
+	_, err = tree.RenameByUUID(a.UUID, "x")
+	assert.Equal(t, nil, err, "rename by uuid error")
+	assert.Equal(t, "alphabet/x/d", d.Path(), "path not updated after rename")
+	assert.Equal(t, d, tree.Search("alphabet/x/d"), "renamed parent not indexed")
+
+	sub := &FileNode{Name: "e", UUID: uuid.NewString(), Subs: []*FileNode{{Name: "f", UUID: uuid.NewString()}}}
+	err = tree.AddSub(sub)
+	assert.Equal(t, nil, err, "add sub error")
+	assert.Equal(t, "alphabet/e/f", tree.SearchByUUID(sub.Subs[0].UUID).Path(), "added subtree not indexed")
+	assert.NotEqual(t, nil, tree.AddSub(&FileNode{Name: "e"}), "duplicate name accepted")
+
+	_, err = tree.RemoveByUUID(sub.UUID, tree.UUID)
+	assert.Equal(t, nil, err, "remove by uuid error")
+	assert.Nil(t, tree.SearchByUUID(sub.Subs[0].UUID), "removed subtree still indexed")
+}
+
+func Test_Merkle(t *testing.T) {
+	tree := makeDummyTree()
+	for _, sub := range tree.Subs {
+		sub.Meta.Sum = sub.Name
+	}
+	tree.Meta.IsDir = true
+	tree.Subs[0].Meta.IsDir = true
+	tree.SetOptions(Options{Merkle: true})
+	rootSum := tree.Meta.Sum
+	assert.NotEqual(t, "", rootSum, "merkle sum not computed")
+
+	other := makeDummyTree()
+	for _, sub := range other.Subs {
+		sub.Meta.Sum = sub.Name
+	}
+	other.Meta.IsDir = true
+	other.Subs[0].Meta.IsDir = true
+	other.SetOptions(Options{Merkle: true})
+	assert.Equal(t, rootSum, other.Meta.Sum, "same trees have different root sums")
+	other.SetOptions(Options{Merkle: true, Hasher: utils.CRC32C})
+	assert.Equal(t, 8, len(other.Meta.Sum), "root sum not made with the hasher of the tree")
+	assert.Equal(t, utils.CRC32C, other.Meta.SumAlgo, "invalid root sum algo")
+	other.SetOptions(Options{Merkle: true})
+	assert.Equal(t, rootSum, other.Meta.Sum, "root sum not made again with the new hasher")
+
+	_, err := tree.Move(connector.NewVirtualPath("alphabet/d", false), connector.NewVirtualPath("alphabet/a", true))
+	assert.Equal(t, nil, err, "move process error")
+	assert.NotEqual(t, rootSum, tree.Meta.Sum, "root sum not updated after move")
+	movedSum := tree.Meta.Sum
+
+	_, err = tree.Rename(connector.NewVirtualPath("alphabet/a/d", false), connector.NewVirtualPath("alphabet/a/e", false))
+	assert.Equal(t, nil, err, "rename process error")
+	assert.NotEqual(t, movedSum, tree.Meta.Sum, "root sum not updated after rename")
+
+	_, err = tree.Rename(connector.NewVirtualPath("alphabet/a/e", false), connector.NewVirtualPath("alphabet/a/d", false))
+	assert.Equal(t, nil, err, "rename process error")
+	assert.Equal(t, movedSum, tree.Meta.Sum, "root sum differs for the same content")
+
+	_, err = tree.Remove(connector.NewVirtualPath("alphabet/a/d", false))
+	assert.Equal(t, nil, err, "remove process error")
+	_, err = other.Remove(connector.NewVirtualPath("alphabet/d", false))
+	assert.Equal(t, nil, err, "remove process error")
+	assert.Equal(t, other.Meta.Sum, tree.Meta.Sum, "root sums differ after remove")
+}
+
+func Test_Stats(t *testing.T) {
+	tree := makeDummyTree()
+	tree.Meta.IsDir = true
+	tree.Subs[0].Meta.IsDir = true
+	for i, sub := range tree.Subs[1:] {
+		sub.Meta.Size = int64(i+1) * 10
+		sub.Meta.ModifiedAt = int64(i + 1)
+	}
+	tree.Subs[0].Meta.ModifiedAt = 4
+	tree.Reindex()
+	assert.Equal(t, Stats{TotalBytes: 60, FileCount: 3, DirCount: 1, NewestModifiedAt: 4}, tree.Stats, "stats not computed")
+
+	_, err := tree.Move(connector.NewVirtualPath("alphabet/d", false), connector.NewVirtualPath("alphabet/a", true))
+	assert.Equal(t, nil, err, "move process error")
+	assert.Equal(t, Stats{TotalBytes: 30, FileCount: 1, NewestModifiedAt: 3}, tree.Subs[0].Stats, "folder stats not updated after move")
+	assert.Equal(t, int64(60), tree.Stats.TotalBytes, "root stats changed after move")
+
+	tree.SearchByUUID(tree.Subs[0].Subs[0].UUID).SetMeta(MetaData{Size: 5, ModifiedAt: 9})
+	assert.Equal(t, Stats{TotalBytes: 35, FileCount: 3, DirCount: 1, NewestModifiedAt: 9}, tree.Stats, "stats not updated after write")
+
+	_, err = tree.Remove(connector.NewVirtualPath("alphabet/a", true))
+	assert.Equal(t, nil, err, "remove process error")
+	assert.Equal(t, Stats{TotalBytes: 30, FileCount: 2, NewestModifiedAt: 2}, tree.Stats, "stats not updated after remove")
+}
+
+func Test_StatsIncremental(t *testing.T) {
+	tree := makeDummyTree()
+	tree.Meta.IsDir = true
+	tree.Subs[0].Meta.IsDir = true
+	for i, sub := range tree.Subs[1:] {
+		sub.Meta.Size = int64(i+1) * 10
+		sub.Meta.ModifiedAt = int64(i + 1)
+	}
+	tree.Reindex()
+	folder := tree.Subs[0]
+	inner := &FileNode{Name: "inner", UUID: uuid.NewString(), Meta: MetaData{IsDir: true}}
+	assert.Equal(t, nil, folder.AddSub(inner), "add error")
+	leaf := &FileNode{Name: "leaf", UUID: uuid.NewString(), Meta: MetaData{Size: 7, ModifiedAt: 20}}
+	assert.Equal(t, nil, tree.SearchByUUID(inner.UUID).AddSub(leaf), "add error")
+	assert.Equal(t, Stats{TotalBytes: 67, FileCount: 4, DirCount: 2, NewestModifiedAt: 20}, tree.Stats, "stats not updated after add")
+	snap := tree.Snapshot()
+
+	// the newest file gets older, the other subs decide the newest time again
+	tree.SearchByUUID(leaf.UUID).SetMeta(MetaData{Size: 1, ModifiedAt: 2})
+	assert.Equal(t, Stats{TotalBytes: 61, FileCount: 4, DirCount: 2, NewestModifiedAt: 3}, tree.Stats, "stats not updated after write")
+	_, err := tree.MoveByUUID(tree.Subs[3].UUID, inner.UUID)
+	assert.Equal(t, nil, err, "move process error")
+	_, err = tree.RemoveByUUID(tree.Subs[1].UUID, tree.UUID)
+	assert.Equal(t, nil, err, "remove process error")
+
+	stats := map[string]Stats{}
+	_ = Walk(tree, func(relPath string, n *FileNode) error {
+		stats[relPath] = n.Stats
+		return nil
+	})
+	tree.Reindex()
+	_ = Walk(tree, func(relPath string, n *FileNode) error {
+		assert.Equal(t, n.Stats, stats[relPath], "incremental stats differ at %q", relPath)
+		return nil
+	})
+	assert.Equal(t, Stats{TotalBytes: 67, FileCount: 4, DirCount: 2, NewestModifiedAt: 20}, snap.Stats, "snapshot stats changed")
+}
@@ -0,0 +1,147 @@
+package filenode
+
+/*
+	Every FileNode keeps a name -> node map of its Subs and a pointer to its parent, and the root of a tree keeps a
+	uuid -> node map of the whole tree. Mutations done through the FileNode methods keep them in sync with the Subs
+	slices; trees built by hand (tree literals, json or msgpack decoding) get indexed on the first operation called on
+	their root, or explicitly with Reindex.
+*/
+
+// tree is the state shared by all nodes of a tree. Only the root node points to it.
+type tree struct {
+	uuids map[string]*FileNode
+	opts  Options
+	// gen is the generation of the live tree, see Snapshot. frozen marks the state of a snapshot.
+	gen    uint64
+	frozen bool
+}
+
+func (t *tree) register(node *FileNode) {
+	if node.UUID != "" {
+		t.uuids[node.UUID] = node
+	}
+	for _, sub := range node.Subs {
+		sub.parent = node
+		t.register(sub)
+	}
+}
+
+func (t *tree) unregister(node *FileNode) {
+	if t.uuids[node.UUID] == node {
+		delete(t.uuids, node.UUID)
+	}
+	for _, sub := range node.Subs {
+		t.unregister(sub)
+	}
+}
+
+func (fn *FileNode) root() *FileNode {
+	node := fn
+	for node.parent != nil {
+		node = node.parent
+	}
+	return node
+}
+
+// state returns the index of the tree fn belongs to, building it when the tree has never been indexed.
+func (fn *FileNode) state() *tree {
+	r := fn.root()
+	if r.tree == nil {
+		r.Reindex()
+	}
+	return r.tree
+}
+
+// indexed returns the index of the tree fn belongs to or nil if there is none yet.
+func (fn *FileNode) indexed() *tree {
+	return fn.root().tree
+}
+
+func (fn *FileNode) buildSubIndex() {
+	fn.subIndex = make(map[string]*FileNode, len(fn.Subs))
+	for _, sub := range fn.Subs {
+		fn.subIndex[sub.Name] = sub
+	}
+}
+
+func (fn *FileNode) sub(name string) *FileNode {
+	// a nil map is fine for a node without subs, so lookups in a snapshot never write
+	if len(fn.subIndex) != len(fn.Subs) {
+		fn.buildSubIndex()
+	}
+	return fn.subIndex[name]
+}
+
+func (fn *FileNode) addSub(node *FileNode) {
+	if fn.subIndex == nil || len(fn.subIndex) != len(fn.Subs) {
+		fn.buildSubIndex()
+	}
+	node.parent = fn
+	fn.Subs = append(fn.Subs, node)
+	fn.subIndex[node.Name] = node
+	// the share of node in the stats of fn is added when node is propagated
+	node.counted = Stats{}
+}
+
+func (fn *FileNode) removeSub(node *FileNode) {
+	for i, sub := range fn.Subs {
+		if sub == node {
+			fn.Subs = append(fn.Subs[:i], fn.Subs[i+1:]...)
+			break
+		}
+	}
+	if fn.subIndex != nil && fn.subIndex[node.Name] == node {
+		delete(fn.subIndex, node.Name)
+	}
+	node.parent = nil
+	fn.Stats.account(node.counted, Stats{}, fn.Subs)
+}
+
+func (fn *FileNode) renameSub(node *FileNode, name string) {
+	if fn.subIndex != nil {
+		delete(fn.subIndex, node.Name)
+	}
+	node.Name = name
+	if fn.subIndex != nil {
+		fn.subIndex[name] = node
+	}
+}
+
+func (fn *FileNode) isWithin(ancestor *FileNode) bool {
+	for node := fn; node != nil; node = node.parent {
+		if node == ancestor {
+			return true
+		}
+	}
+	return false
+}
+
+// Reindex rebuilds the lookup maps and parent pointers of the whole tree and recomputes the folder sums and stats.
+// It is only needed after Subs were modified directly.
+func (fn *FileNode) Reindex() {
+	r := fn.root()
+	t := &tree{uuids: make(map[string]*FileNode)}
+	if r.tree != nil {
+		if r.tree.frozen {
+			return
+		}
+		t.opts = r.tree.opts
+		t.gen = r.tree.gen
+	}
+	r.tree = t
+	r = r.mutable(t)
+	r.reindexSubs(t)
+	r.tree.register(r)
+	r.recompute(t)
+}
+
+// reindexSubs rebuilds the sub maps below fn, copying the nodes that are shared with a snapshot.
+func (fn *FileNode) reindexSubs(t *tree) {
+	fn.buildSubIndex()
+	for i, sub := range fn.Subs {
+		if sub.gen != t.gen {
+			sub = fn.cloneSub(i, t)
+		}
+		sub.reindexSubs(t)
+	}
+}
@@ -0,0 +1,240 @@
+package filenode
+
+import (
+	"fmt"
+	connector "github.com/ayhanozemre/fs-shadow/path"
+	"github.com/ayhanozemre/fs-shadow/utils"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+type LinkPolicy int
+
+const (
+	// LinkRecord keeps symlinks as leaves that hold their target, nothing behind a link is read.
+	// The sum of a link is the sum of its target path, so retargeting a link changes it.
+	LinkRecord LinkPolicy = iota
+	// LinkFollow scans symlinks as if they were the file or folder they point to. A link that leads back to one of
+	// the folders above it is recorded like LinkRecord instead of being followed.
+	LinkFollow
+)
+
+// fsWalk holds the settings of a scan and the identities of the folders above the current one, which are only
+// needed to detect loops when links are followed.
+type fsWalk struct {
+	links    LinkPolicy
+	hasher   string
+	cache    *utils.HashCache
+	chunks   utils.ChunkSizes
+	quick    utils.QuickSampling
+	deferred bool
+	excludes []Predicate
+	maxDepth int
+	logger   log.FieldLogger
+	// progress counts the files the walk hashes, it is only set for the walks of a scan.
+	progress *ScanProgress
+	// rel is the path of the folder the walk is in relative to the root, with slashes.
+	rel       string
+	ancestors map[string]bool
+}
+
+// newFsWalk prepares a scan of the entries of dir, which belongs to the tree of node.
+func newFsWalk(node *FileNode, dir string) *fsWalk {
+	var opts Options
+	if t := node.indexed(); t != nil {
+		opts = t.opts
+	}
+	return walkWith(opts, dir)
+}
+
+// walkWith prepares a scan of the entries of dir with the settings of opts.
+func walkWith(opts Options, dir string) *fsWalk {
+	w := fsWalk{
+		links:     opts.Links,
+		hasher:    opts.hasher(),
+		cache:     opts.HashCache,
+		chunks:    opts.Chunks,
+		quick:     opts.QuickSum,
+		deferred:  opts.DeferSums,
+		excludes:  opts.excludes(),
+		maxDepth:  opts.MaxDepth,
+		logger:    opts.logger(),
+		ancestors: make(map[string]bool),
+	}
+	if w.links != LinkFollow {
+		return &w
+	}
+	for p := dir; ; p = filepath.Dir(p) {
+		if key, err := connector.FileKey(p); err == nil {
+			w.ancestors[key] = true
+		}
+		if filepath.Dir(p) == p {
+			break
+		}
+	}
+	return &w
+}
+
+// enter returns the walk of the sub folder name, identified by key.
+func (w *fsWalk) enter(name string, key string) *fsWalk {
+	c := *w
+	c.rel = path.Join(w.rel, name)
+	if key == "" {
+		return &c
+	}
+	ancestors := make(map[string]bool, len(w.ancestors)+1)
+	for k := range w.ancestors {
+		ancestors[k] = true
+	}
+	ancestors[key] = true
+	c.ancestors = ancestors
+	return &c
+}
+
+// skips tells whether the entry name of the folder the walk is in is left out by the excludes or the depth.
+func (w *fsWalk) skips(name string) bool {
+	return skips(w.excludes, w.maxDepth, path.Join(w.rel, name))
+}
+
+// descends tells whether the entries of the sub folder name are within the depth.
+func (w *fsWalk) descends(name string) bool {
+	return w.maxDepth == 0 || depth(path.Join(w.rel, name)) < w.maxDepth
+}
+
+// stat builds the metadata of the entry at p, info must come from os.Lstat. descend tells whether the entry is a
+// folder the scan has to go into and key identifies that folder. chunks is the chunk manifest of a file large enough
+// to be chunked. An error in computing the sum still returns the rest of the metadata.
+func (w *fsWalk) stat(p string, info os.FileInfo) (meta MetaData, chunks []utils.Chunk, descend bool, key string, err error) {
+	meta = MetaData{
+		IsDir: info.IsDir(),
+		Size:  info.Size(),
+		Type:  TypeRegular,
+	}
+	meta.SumAlgo = w.hasher
+	meta.setAttrs(p, info)
+	if info.Mode()&os.ModeSymlink == 0 {
+		if info.IsDir() {
+			meta.Type = TypeDir
+			meta.Sum, err = utils.FolderSumWith(p, w.hasher)
+			if w.links == LinkFollow {
+				key, _ = connector.FileKey(p)
+			}
+			return meta, nil, true, key, err
+		}
+		chunks, err = w.fileSum(p, &meta)
+		return meta, chunks, false, "", err
+	}
+
+	meta.Type = TypeSymlink
+	meta.LinkTarget, err = os.Readlink(p)
+	if err != nil {
+		return meta, nil, false, "", err
+	}
+	meta.Sum, err = utils.LinkSumWith(meta.LinkTarget, w.hasher)
+	if err != nil || w.links != LinkFollow {
+		return meta, nil, false, "", err
+	}
+	target, statErr := os.Stat(p)
+	if statErr != nil {
+		// dangling link
+		return meta, nil, false, "", nil
+	}
+	if target.IsDir() {
+		key, _ = connector.FileKey(p)
+		if key == "" || w.ancestors[key] {
+			return meta, nil, false, "", nil
+		}
+	}
+	meta.IsDir = target.IsDir()
+	meta.Size = target.Size()
+	meta.setAttrs(p, target)
+	if meta.IsDir {
+		meta.Sum, err = utils.FolderSumWith(p, w.hasher)
+	} else {
+		chunks, err = w.fileSum(p, &meta)
+	}
+	return meta, chunks, meta.IsDir, key, err
+}
+
+// fileSum sets the sum of the file at p, whose attributes are in meta, unless the hash cache of the walk knows it. A file
+// larger than the maximum chunk size is chunked when chunking is enabled, it is read even when its sum is cached
+// because the cache doesn't keep manifests. Otherwise a file above the quick sampling threshold gets a weak sum,
+// weak sums aren't cached. A deferring walk marks the sums it doesn't find in the cache as pending.
+func (w *fsWalk) fileSum(p string, meta *MetaData) ([]utils.Chunk, error) {
+	chunked := w.chunks.Enabled() && meta.Size > int64(w.chunks.Max)
+	cached := w.cache != nil && meta.Inode != 0
+	key := utils.HashKey{Device: meta.Device, Inode: meta.Inode, Size: meta.Size, ModifiedAt: meta.ModifiedAt, Algo: w.hasher}
+	if cached && !chunked {
+		if sum, ok := w.cache.Get(key); ok {
+			meta.Sum = sum
+			return nil, nil
+		}
+	}
+	if w.deferred {
+		meta.SumPending = true
+		return nil, nil
+	}
+	var chunks []utils.Chunk
+	var err error
+	switch {
+	case chunked:
+		meta.Sum, chunks, err = utils.ChunkFile(p, w.chunks, w.hasher)
+	case w.quick.Enabled() && meta.Size > w.quick.Threshold():
+		meta.Sum, meta.WeakSum, err = utils.QuickSumWith(p, w.quick, w.hasher)
+		if err == nil {
+			w.progress.addFile(meta.Size)
+		}
+		return nil, err
+	default:
+		meta.Sum, err = utils.FileSumWith(p, w.hasher)
+	}
+	if err != nil {
+		return nil, err
+	}
+	w.progress.addFile(meta.Size)
+	// a write in the same tick of the clock wouldn't change the key, so files that were just modified aren't cached
+	if !cached || time.Since(time.Unix(0, meta.ModifiedAt)) < 2*time.Second {
+		return chunks, nil
+	}
+	if err := w.cache.Put(key, meta.Sum); err != nil {
+		w.logger.Error("hash cache error:", p, err)
+	}
+	return chunks, nil
+}
+
+// attrs returns the info stat has to use for the attributes of the entry at p, which is the target of a followed link.
+func (w *fsWalk) attrs(p string, info os.FileInfo) os.FileInfo {
+	if w.links != LinkFollow || info.Mode()&os.ModeSymlink == 0 {
+		return info
+	}
+	target, err := os.Stat(p)
+	if err != nil {
+		return info
+	}
+	return target
+}
+
+// setAttrs fills the permission, ownership and timestamps of the entry at p, nothing that needs its content.
+func (m *MetaData) setAttrs(p string, info os.FileInfo) {
+	m.CreatedAt = info.ModTime().Unix()
+	m.Permission = fmt.Sprintf("%d", info.Mode())
+	m.Mode = ModeOf(info.Mode())
+	m.setStat(connector.StatOf(p, info))
+}
+
+func (m *MetaData) setStat(s connector.StatInfo) {
+	m.Uid = s.Uid
+	m.Gid = s.Gid
+	m.User = s.User
+	m.Group = s.Group
+	m.Inode = s.Inode
+	m.Device = s.Device
+	m.Nlink = s.Nlink
+	m.ModifiedAt = s.ModifiedAt
+	m.ChangedAt = s.ChangedAt
+	m.AccessedAt = s.AccessedAt
+	m.BornAt = s.BornAt
+}
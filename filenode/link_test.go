@@ -0,0 +1,100 @@
+package filenode
+
+import (
+	connector "github.com/ayhanozemre/fs-shadow/path"
+	"github.com/ayhanozemre/fs-shadow/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// makeLinkFolder creates a folder holding a file, a folder and links to both of them, a link back to the folder
+// itself and a dangling link.
+func makeLinkFolder(t *testing.T) string {
+	dir := filepath.Join(t.TempDir(), "links")
+	_ = os.MkdirAll(filepath.Join(dir, "folder"), os.ModePerm)
+	_ = os.WriteFile(filepath.Join(dir, "folder", "file.txt"), []byte("content"), 0644)
+	for link, target := range map[string]string{
+		"file-link":     filepath.Join("folder", "file.txt"),
+		"folder-link":   "folder",
+		"folder/loop":   "..",
+		"dangling-link": "missing",
+	} {
+		assert.Equal(t, nil, os.Symlink(target, filepath.Join(dir, link)), "symlink error")
+	}
+	return dir
+}
+
+func scanLinkFolder(dir string, policy LinkPolicy) *FileNode {
+	root := &FileNode{Name: filepath.Base(dir), Meta: MetaData{IsDir: true}}
+	root.SetOptions(Options{Links: policy})
+	var wg sync.WaitGroup
+	WalkOnFsPath(root, connector.NewFSPath(dir), &wg, nil)
+	wg.Wait()
+	root.Reindex()
+	return root
+}
+
+func Test_LinkRecord(t *testing.T) {
+	root := scanLinkFolder(makeLinkFolder(t), LinkRecord)
+
+	link := root.Search("links/folder-link")
+	assert.NotNil(t, link, "link not recorded")
+	assert.Equal(t, TypeSymlink, link.Meta.Type, "invalid link type")
+	assert.Equal(t, "folder", link.Meta.LinkTarget, "invalid link target")
+	assert.Equal(t, utils.LinkSum("folder"), link.Meta.Sum, "invalid link sum")
+	assert.False(t, link.Meta.IsDir, "recorded link is a folder")
+	assert.Equal(t, 0, len(link.Subs), "recorded link was followed")
+
+	assert.Equal(t, TypeSymlink, root.Search("links/dangling-link").Meta.Type, "dangling link not recorded")
+	assert.Equal(t, TypeDir, root.Search("links/folder").Meta.Type, "invalid folder type")
+	assert.Equal(t, TypeRegular, root.Search("links/folder/file.txt").Meta.Type, "invalid file type")
+}
+
+func Test_LinkFollow(t *testing.T) {
+	root := scanLinkFolder(makeLinkFolder(t), LinkFollow)
+
+	file := root.Search("links/folder/file.txt")
+	fileLink := root.Search("links/file-link")
+	assert.Equal(t, TypeSymlink, fileLink.Meta.Type, "invalid link type")
+	assert.Equal(t, file.Meta.Sum, fileLink.Meta.Sum, "followed link has a different sum")
+
+	folderLink := root.Search("links/folder-link")
+	assert.True(t, folderLink.Meta.IsDir, "followed folder link is not a folder")
+	assert.NotNil(t, root.Search("links/folder-link/file.txt"), "folder link not followed")
+
+	// links/folder/loop and links/folder-link/loop point back to links
+	for _, p := range []string{"links/folder/loop", "links/folder-link/loop"} {
+		loop := root.Search(p)
+		assert.NotNil(t, loop, "loop not recorded: %s", p)
+		assert.False(t, loop.Meta.IsDir, "loop followed: %s", p)
+		assert.Equal(t, 0, len(loop.Subs), "loop followed: %s", p)
+	}
+	assert.False(t, root.Search("links/dangling-link").Meta.IsDir, "dangling link is a folder")
+}
+
+func Test_LinkRetarget(t *testing.T) {
+	dir := makeLinkFolder(t)
+	_ = os.Mkdir(filepath.Join(dir, "other"), os.ModePerm)
+	_ = os.WriteFile(filepath.Join(dir, "other", "other.txt"), []byte("other"), 0644)
+	for _, policy := range []LinkPolicy{LinkRecord, LinkFollow} {
+		root := scanLinkFolder(dir, policy)
+		link := filepath.Join(dir, "folder-link")
+		_ = os.Remove(link)
+		_ = os.Symlink("other", link)
+
+		node, err := root.Update(connector.NewFSPath("links/folder-link"), connector.NewFSPath(link))
+		assert.Equal(t, nil, err, "update error")
+		assert.Equal(t, "other", node.Meta.LinkTarget, "link target not updated")
+		if policy == LinkFollow {
+			assert.NotNil(t, root.Search("links/folder-link/other.txt"), "new target not scanned")
+			assert.Nil(t, root.Search("links/folder-link/file.txt"), "old target still in the tree")
+		} else {
+			assert.Equal(t, utils.LinkSum("other"), node.Meta.Sum, "link sum not updated")
+		}
+		_ = os.Remove(link)
+		_ = os.Symlink("folder", link)
+	}
+}
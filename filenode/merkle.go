@@ -0,0 +1,56 @@
+package filenode
+
+import "github.com/ayhanozemre/fs-shadow/utils"
+
+// merkleSum hashes the subs with the named hasher, an unknown one leaves the folder without a sum.
+func (fn *FileNode) merkleSum(algo string) string {
+	entries := make([]utils.SumEntry, len(fn.Subs))
+	for i, sub := range fn.Subs {
+		entries[i] = utils.SumEntry{Name: sub.Name, Sum: sub.Meta.Sum}
+	}
+	sum, _ := utils.MerkleSumWith(entries, algo)
+	return sum
+}
+
+// recompute updates the values derived from the subs (folder sums and stats) for the whole subtree, deepest folders first.
+func (fn *FileNode) recompute(t *tree) {
+	fn = fn.mutable(t)
+	for i, sub := range fn.Subs {
+		if sub.gen != t.gen {
+			sub = fn.cloneSub(i, t)
+		}
+		sub.recompute(t)
+	}
+	fn.Stats = fn.subStats()
+	fn.refresh(t)
+}
+
+// propagate updates the values derived from the subs of fn and of all its parents. The stats of every parent only
+// take the change of the share of the node below it, so the siblings aren't visited and the walk ends at the first
+// share that didn't change, unless the folder sums have to be updated all the way up.
+func (fn *FileNode) propagate(t *tree) {
+	for node := fn.mutable(t); node != nil; node = node.parent {
+		node.refresh(t)
+		if node.parent == nil {
+			return
+		}
+		share := node.share()
+		if share == node.counted && !t.opts.Merkle {
+			return
+		}
+		from := node.counted
+		node.counted = share
+		node.parent.Stats.account(from, share, node.parent.Subs)
+	}
+}
+
+func (fn *FileNode) refresh(t *tree) {
+	if !fn.Meta.IsDir {
+		fn.Stats = Stats{}
+		return
+	}
+	if t.opts.Merkle {
+		fn.Meta.Sum = fn.merkleSum(t.opts.hasher())
+		fn.Meta.SumAlgo = t.opts.hasher()
+	}
+}
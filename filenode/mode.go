@@ -0,0 +1,122 @@
+package filenode
+
+import (
+	"os"
+	"strconv"
+)
+
+// FileMode holds the permission bits of a file the way chmod takes them: rwx for the owner, the group and the others
+// plus the setuid, setgid and sticky bits, e.g. 04755.
+type FileMode uint32
+
+const (
+	ModeSetuid FileMode = 04000
+	ModeSetgid FileMode = 02000
+	ModeSticky FileMode = 01000
+)
+
+// Access is one rwx triplet of a FileMode.
+type Access struct {
+	Read    bool
+	Write   bool
+	Execute bool
+}
+
+// ModeOf converts the permission bits of an os.FileMode, the type bits are dropped.
+func ModeOf(m os.FileMode) FileMode {
+	mode := FileMode(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= ModeSetuid
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= ModeSetgid
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= ModeSticky
+	}
+	return mode
+}
+
+// OsMode converts the mode back to an os.FileMode without type bits.
+func (m FileMode) OsMode() os.FileMode {
+	mode := os.FileMode(m & 0777)
+	if m.IsSetuid() {
+		mode |= os.ModeSetuid
+	}
+	if m.IsSetgid() {
+		mode |= os.ModeSetgid
+	}
+	if m.IsSticky() {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+func (m FileMode) Perm() FileMode {
+	return m & 0777
+}
+
+func (m FileMode) Owner() Access {
+	return access(m >> 6)
+}
+
+func (m FileMode) Group() Access {
+	return access(m >> 3)
+}
+
+func (m FileMode) Other() Access {
+	return access(m)
+}
+
+func (m FileMode) IsSetuid() bool {
+	return m&ModeSetuid != 0
+}
+
+func (m FileMode) IsSetgid() bool {
+	return m&ModeSetgid != 0
+}
+
+func (m FileMode) IsSticky() bool {
+	return m&ModeSticky != 0
+}
+
+// String returns the mode like ls does without the type letter, e.g. "rwsr-xr-t".
+func (m FileMode) String() string {
+	b := []byte("---------")
+	for i, a := range []Access{m.Owner(), m.Group(), m.Other()} {
+		if a.Read {
+			b[i*3] = 'r'
+		}
+		if a.Write {
+			b[i*3+1] = 'w'
+		}
+		if a.Execute {
+			b[i*3+2] = 'x'
+		}
+	}
+	special := []struct {
+		set    bool
+		at     int
+		letter byte
+	}{{m.IsSetuid(), 2, 's'}, {m.IsSetgid(), 5, 's'}, {m.IsSticky(), 8, 't'}}
+	for _, s := range special {
+		if !s.set {
+			continue
+		}
+		if b[s.at] == 'x' {
+			b[s.at] = s.letter
+		} else {
+			b[s.at] = s.letter - 'a' + 'A'
+		}
+	}
+	return string(b)
+}
+
+// Octal returns the mode as chmod takes it, e.g. "0755".
+func (m FileMode) Octal() string {
+	return "0" + strconv.FormatUint(uint64(m), 8)
+}
+
+func access(m FileMode) Access {
+	return Access{Read: m&04 != 0, Write: m&02 != 0, Execute: m&01 != 0}
+}
@@ -0,0 +1,27 @@
+package filenode
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func Test_FileMode(t *testing.T) {
+	mode := ModeOf(os.ModeDir | os.ModeSetuid | os.ModeSticky | 0754)
+	assert.Equal(t, FileMode(05754), mode)
+	assert.Equal(t, "05754", mode.Octal())
+	assert.Equal(t, "rwsr-xr-T", mode.String())
+	assert.Equal(t, Access{Read: true, Write: true, Execute: true}, mode.Owner())
+	assert.Equal(t, Access{Read: true, Execute: true}, mode.Group())
+	assert.Equal(t, Access{Read: true}, mode.Other())
+	assert.True(t, mode.IsSetuid())
+	assert.False(t, mode.IsSetgid())
+	assert.True(t, mode.IsSticky())
+	assert.Equal(t, os.ModeSetuid|os.ModeSticky|0754, mode.OsMode())
+	assert.Equal(t, "rwxr-sr-x", ModeOf(os.ModeSetgid|0755).String())
+
+	// trees recorded before Mode existed only have the decimal os.FileMode
+	old := MetaData{Permission: fmt.Sprintf("%d", os.ModeSetgid|0640)}
+	assert.Equal(t, FileMode(02640), old.FileMode())
+}
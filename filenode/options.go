@@ -0,0 +1,141 @@
+package filenode
+
+import (
+	"github.com/ayhanozemre/fs-shadow/utils"
+	log "github.com/sirupsen/logrus"
+	"path/filepath"
+	"strings"
+)
+
+// Options are the tree-wide settings, they are kept by the root node.
+type Options struct {
+	// Merkle makes the sum of every folder a hash of the names and sums of its subs made with the Hasher, see
+	// utils.MerkleSumWith.
+	// The sums are updated up to the root on every change, so two trees can be compared by their root sums. Every
+	// change hashes the entries of the folders above it again, unlike the stats which only take the difference.
+	Merkle bool
+	// Links decides whether scans follow symlinks, see LinkPolicy.
+	Links LinkPolicy
+	// Hasher names the utils hasher the sums of files are computed with, empty is utils.DefaultHasher.
+	Hasher string
+	// Scan bounds the workers and open files of the scans of folders.
+	Scan ScanLimits
+	// Progress counts the work of the scans when it is set, see ScanProgress.
+	Progress *ScanProgress
+	// HashCache is consulted before files are hashed when it is set, files are only read when their inode, size or
+	// modification time aren't in it. It is only used where the inode numbers are known.
+	HashCache *utils.HashCache
+	// Chunks enables the chunk manifests of files larger than Chunks.Max, see FileNode.Chunks. The zero value
+	// disables them.
+	Chunks utils.ChunkSizes
+	// QuickSum gives the files larger than its threshold weak sums that only read parts of them, see
+	// MetaData.WeakSum. Files that are chunked are read whole anyway and get full sums. The zero value disables it.
+	QuickSum utils.QuickSampling
+	// DeferSums leaves the sums of files out of scans and updates, their nodes are marked with MetaData.SumPending
+	// instead. The sums are computed later with ComputeSum and stored with ResolveSum. Sums found in the HashCache
+	// are used right away.
+	DeferSums bool
+	// Exclude leaves out of scans the entries whose path relative to the root, or the path of a folder above them,
+	// matches one of the patterns, see Glob for their syntax. Malformed patterns are logged and match nothing.
+	Exclude []string
+	// MaxDepth leaves out of scans the entries more than MaxDepth folders below the root, the subs of the root are at
+	// depth 1. Zero doesn't limit the depth.
+	MaxDepth int
+	// Logger receives the errors scans can't return, it is the standard logrus logger when nil.
+	Logger log.FieldLogger
+
+	// excluded holds the Exclude patterns compiled by SetOptions, compiled tells whether they were.
+	excluded []Predicate
+	compiled bool
+}
+
+func (o Options) hasher() string {
+	if o.Hasher == "" {
+		return utils.DefaultHasher
+	}
+	return o.Hasher
+}
+
+func (o Options) logger() log.FieldLogger {
+	if o.Logger == nil {
+		return log.StandardLogger()
+	}
+	return o.Logger
+}
+
+// compile compiles the Exclude patterns, the malformed ones are logged and left out.
+func (o Options) compile() Options {
+	o.excluded = nil
+	for _, pattern := range o.Exclude {
+		p, err := Glob(pattern)
+		if err != nil {
+			o.logger().WithError(err).WithField("pattern", pattern).Warn("malformed exclude pattern")
+			continue
+		}
+		o.excluded = append(o.excluded, p)
+	}
+	o.compiled = true
+	return o
+}
+
+// excludes returns the compiled Exclude patterns, the options of a tree are compiled once by SetOptions.
+func (o Options) excludes() []Predicate {
+	if !o.compiled {
+		o = o.compile()
+	}
+	return o.excluded
+}
+
+// Skips tells whether the entry at relPath, relative to the root, is left out of the tree by Exclude or MaxDepth.
+// The root itself never is. Options that don't come from a tree, see FileNode.Options, compile their patterns on
+// every call.
+func (o Options) Skips(relPath string) bool {
+	return skips(o.excludes(), o.MaxDepth, relPath)
+}
+
+func skips(excludes []Predicate, maxDepth int, relPath string) bool {
+	relPath = strings.Trim(filepath.ToSlash(relPath), "/")
+	if relPath == "" {
+		return false
+	}
+	parts := strings.Split(relPath, "/")
+	if maxDepth > 0 && len(parts) > maxDepth {
+		return true
+	}
+	for i := range parts {
+		prefix := strings.Join(parts[:i+1], "/")
+		for _, exclude := range excludes {
+			if exclude(prefix, nil) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// depth is the number of folders between the root and the entry at relPath, plus one.
+func depth(relPath string) int {
+	relPath = strings.Trim(filepath.ToSlash(relPath), "/")
+	if relPath == "" {
+		return 0
+	}
+	return strings.Count(relPath, "/") + 1
+}
+
+func (fn *FileNode) Options() Options {
+	return fn.state().opts
+}
+
+// SetOptions changes the settings of the tree fn belongs to and compiles its Exclude patterns. Enabling Merkle
+// recomputes every folder sum.
+func (fn *FileNode) SetOptions(opts Options) {
+	t := fn.state()
+	if t.frozen {
+		return
+	}
+	merkle := opts.Merkle && (!t.opts.Merkle || opts.hasher() != t.opts.hasher())
+	t.opts = opts.compile()
+	if merkle {
+		fn.root().recompute(t)
+	}
+}
@@ -0,0 +1,163 @@
+package filenode
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Predicate decides whether a node is part of the result of a query, relPath is relative to the queried node.
+type Predicate func(relPath string, n *FileNode) bool
+
+type Match struct {
+	Path string
+	Node *FileNode
+}
+
+// Query returns the nodes below fn that satisfy p, in the order of Walk.
+func (fn *FileNode) Query(p Predicate) []Match {
+	var matches []Match
+	_ = Walk(fn, func(relPath string, n *FileNode) error {
+		if n != fn && p(relPath, n) {
+			matches = append(matches, Match{Path: relPath, Node: n})
+		}
+		return nil
+	})
+	return matches
+}
+
+// Glob matches the relative path of a node against a slash separated pattern. Every segment is matched with
+// path.Match, and a "**" segment matches any number of folders, including none: "**/*.go" matches "main.go" as well
+// as "cmd/app/main.go".
+func Glob(pattern string) (Predicate, error) {
+	segments := strings.Split(pattern, "/")
+	for _, segment := range segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, err
+		}
+	}
+	return func(relPath string, n *FileNode) bool {
+		return matchSegments(segments, strings.Split(filepath.ToSlash(relPath), "/"))
+	}, nil
+}
+
+// MustGlob is like Glob but panics when the pattern is malformed.
+func MustGlob(pattern string) Predicate {
+	p, err := Glob(pattern)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func matchSegments(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for len(pattern) > 0 && pattern[0] == "**" {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i < len(parts); i++ {
+				if matchSegments(pattern, parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
+func And(predicates ...Predicate) Predicate {
+	return func(relPath string, n *FileNode) bool {
+		for _, p := range predicates {
+			if !p(relPath, n) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func Or(predicates ...Predicate) Predicate {
+	return func(relPath string, n *FileNode) bool {
+		for _, p := range predicates {
+			if p(relPath, n) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func Not(p Predicate) Predicate {
+	return func(relPath string, n *FileNode) bool {
+		return !p(relPath, n)
+	}
+}
+
+func IsDir() Predicate {
+	return func(relPath string, n *FileNode) bool {
+		return n.Meta.IsDir
+	}
+}
+
+func IsFile() Predicate {
+	return Not(IsDir())
+}
+
+func SizeGreaterThan(size int64) Predicate {
+	return func(relPath string, n *FileNode) bool {
+		return n.Meta.Size > size
+	}
+}
+
+func SizeLessThan(size int64) Predicate {
+	return func(relPath string, n *FileNode) bool {
+		return n.Meta.Size < size
+	}
+}
+
+func ModifiedAfter(t time.Time) Predicate {
+	return func(relPath string, n *FileNode) bool {
+		return n.Meta.ModifiedTime().After(t)
+	}
+}
+
+func ModifiedBefore(t time.Time) Predicate {
+	return func(relPath string, n *FileNode) bool {
+		return n.Meta.ModifiedTime().Before(t)
+	}
+}
+
+// PermissionIs matches the permission bits of the node, e.g. PermissionIs(0777).
+func PermissionIs(perm os.FileMode) Predicate {
+	return func(relPath string, n *FileNode) bool {
+		return n.Meta.FileMode().Perm() == ModeOf(perm).Perm()
+	}
+}
+
+// HasWeakSum matches the files whose sum is a quick sum, see MetaData.WeakSum.
+func HasWeakSum() Predicate {
+	return func(relPath string, n *FileNode) bool {
+		return n.Meta.WeakSum
+	}
+}
+
+// HasPendingSum matches the files whose sum was deferred, see MetaData.SumPending.
+func HasPendingSum() Predicate {
+	return func(relPath string, n *FileNode) bool {
+		return n.Meta.SumPending
+	}
+}
@@ -0,0 +1,69 @@
+package filenode
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func makeQueryTree() *FileNode {
+	return &FileNode{Name: "root", Meta: MetaData{IsDir: true}, Subs: []*FileNode{
+		{Name: "cmd", Meta: MetaData{IsDir: true}, Subs: []*FileNode{
+			{Name: "app", Meta: MetaData{IsDir: true}, Subs: []*FileNode{
+				{Name: "main.go", Meta: MetaData{Size: 300, CreatedAt: 2000, Permission: "493"}},
+			}},
+		}},
+		{Name: "main.go", Meta: MetaData{Size: 100, CreatedAt: 1000, Permission: "420"}},
+		{Name: "readme.md", Meta: MetaData{Size: 50, CreatedAt: 3000, Permission: "420"}},
+	}}
+}
+
+func queryPaths(matches []Match) []string {
+	paths := make([]string, 0, len(matches))
+	for _, m := range matches {
+		paths = append(paths, m.Path)
+	}
+	return paths
+}
+
+func Test_Glob(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "cmd/main.go", false},
+		{"**/*.go", "main.go", true},
+		{"**/*.go", "cmd/app/main.go", true},
+		{"cmd/**", "cmd/app/main.go", true},
+		{"cmd/**/main.go", "cmd/main.go", true},
+		{"cmd/*/main.go", "cmd/app/lib/main.go", false},
+		{"**", "readme.md", true},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.match, MustGlob(c.pattern)(c.path, nil), "%s %s", c.pattern, c.path)
+	}
+
+	_, err := Glob("[")
+	assert.NotEqual(t, nil, err, "malformed pattern accepted")
+}
+
+func Test_Query(t *testing.T) {
+	tree := makeQueryTree()
+
+	paths := queryPaths(tree.Query(And(MustGlob("**/*.go"), IsFile())))
+	assert.Equal(t, []string{"cmd/app/main.go", "main.go"}, paths, "glob query")
+
+	paths = queryPaths(tree.Query(IsDir()))
+	assert.Equal(t, []string{"cmd", "cmd/app"}, paths, "folder query")
+
+	paths = queryPaths(tree.Query(And(IsFile(), Or(SizeGreaterThan(200), SizeLessThan(60)))))
+	assert.Equal(t, []string{"cmd/app/main.go", "readme.md"}, paths, "size query")
+
+	paths = queryPaths(tree.Query(And(IsFile(), ModifiedAfter(time.Unix(1500, 0)), Not(MustGlob("*.md")))))
+	assert.Equal(t, []string{"cmd/app/main.go"}, paths, "modified query")
+
+	paths = queryPaths(tree.Query(PermissionIs(0644)))
+	assert.Equal(t, []string{"main.go", "readme.md"}, paths, "permission query")
+}
@@ -0,0 +1,260 @@
+package filenode
+
+import (
+	connector "github.com/ayhanozemre/fs-shadow/path"
+	"github.com/google/uuid"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// ScanLimits bound the work a scan does at the same time, zero values are replaced by the defaults.
+type ScanLimits struct {
+	// ListWorkers is the number of folders listed at the same time, 4 by default.
+	ListWorkers int
+	// HashWorkers is the number of files hashed at the same time, the number of CPUs by default.
+	HashWorkers int
+	// MaxOpenFiles caps the files and folders the scan keeps open, listing and hashing share it. 64 by default.
+	MaxOpenFiles int
+}
+
+func (l ScanLimits) withDefaults() ScanLimits {
+	if l.ListWorkers < 1 {
+		l.ListWorkers = 4
+	}
+	if l.HashWorkers < 1 {
+		l.HashWorkers = runtime.NumCPU()
+	}
+	if l.MaxOpenFiles < 1 {
+		l.MaxOpenFiles = 64
+	}
+	return l
+}
+
+// ScanProgress counts the work of the scans of a tree. The counters only grow and can be read while a scan runs.
+// The methods are safe to call on a nil ScanProgress, which counts nothing. A file only counts as hashed when the scan
+// read it, sums taken from the hash cache or deferred aren't counted.
+type ScanProgress struct {
+	dirsScanned int64
+	filesHashed int64
+	bytesHashed int64
+}
+
+func (p *ScanProgress) DirsScanned() int64 {
+	if p == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&p.dirsScanned)
+}
+
+func (p *ScanProgress) FilesHashed() int64 {
+	if p == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&p.filesHashed)
+}
+
+func (p *ScanProgress) BytesHashed() int64 {
+	if p == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&p.bytesHashed)
+}
+
+func (p *ScanProgress) addDir() {
+	if p != nil {
+		atomic.AddInt64(&p.dirsScanned, 1)
+	}
+}
+
+func (p *ScanProgress) addFile(size int64) {
+	if p != nil {
+		atomic.AddInt64(&p.filesHashed, 1)
+		atomic.AddInt64(&p.bytesHashed, size)
+	}
+}
+
+type dirJob struct {
+	walk *fsWalk
+	node *FileNode
+	path connector.Path
+}
+
+type hashJob struct {
+	walk *fsWalk
+	node *FileNode
+	path string
+	info os.FileInfo
+}
+
+/*
+scan lists folders and hashes files on two pools of workers. Folders wait in a queue, so a deep or wide tree only
+costs memory for the folders not listed yet instead of a goroutine each. Files go to the hash workers through a
+channel that is as large as the pool, a listing worker waits when all of them are busy. Every open file or folder
+takes a slot of files first.
+*/
+type scan struct {
+	limits   ScanLimits
+	progress *ScanProgress
+	ch       chan connector.Path
+	files    chan struct{}
+	hashes   chan hashJob
+
+	// dirs and pending are guarded by mu, pending counts the jobs queued or running. The scan is over when it is 0.
+	mu      sync.Mutex
+	cond    *sync.Cond
+	dirs    []dirJob
+	pending int
+}
+
+func newScan(opts Options, ch chan connector.Path) *scan {
+	limits := opts.Scan.withDefaults()
+	s := scan{
+		limits:   limits,
+		progress: opts.Progress,
+		ch:       ch,
+		files:    make(chan struct{}, limits.MaxOpenFiles),
+		hashes:   make(chan hashJob, limits.HashWorkers),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return &s
+}
+
+// run scans the folder at absolutePath into root and returns when every folder below it is listed and hashed.
+func (s *scan) run(w *fsWalk, root *FileNode, absolutePath connector.Path) {
+	w.progress = s.progress
+	s.push(dirJob{walk: w, node: root, path: absolutePath})
+	var workers sync.WaitGroup
+	for i := 0; i < s.limits.ListWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				job, ok := s.pop()
+				if !ok {
+					return
+				}
+				s.list(job)
+				s.done()
+			}
+		}()
+	}
+	for i := 0; i < s.limits.HashWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range s.hashes {
+				s.entry(job.walk, job.node, job.path, job.info)
+				s.done()
+			}
+		}()
+	}
+	workers.Wait()
+}
+
+func (s *scan) push(job dirJob) {
+	s.mu.Lock()
+	s.pending++
+	s.dirs = append(s.dirs, job)
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+// pop waits for a folder to list, it returns false once the scan is over.
+func (s *scan) pop() (dirJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.dirs) == 0 && s.pending > 0 {
+		s.cond.Wait()
+	}
+	if len(s.dirs) == 0 {
+		return dirJob{}, false
+	}
+	job := s.dirs[len(s.dirs)-1]
+	s.dirs = s.dirs[:len(s.dirs)-1]
+	return job, true
+}
+
+func (s *scan) hash(job hashJob) {
+	s.mu.Lock()
+	s.pending++
+	s.mu.Unlock()
+	s.hashes <- job
+}
+
+// done marks a job as finished, the last one stops the workers.
+func (s *scan) done() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending--
+	if s.pending == 0 {
+		close(s.hashes)
+		s.cond.Broadcast()
+	}
+}
+
+func (s *scan) acquire() {
+	s.files <- struct{}{}
+}
+
+func (s *scan) release() {
+	<-s.files
+}
+
+// list adds the entries of a folder to its node. The nodes are added at once, the hash workers only fill in their
+// metadata.
+func (s *scan) list(job dirJob) {
+	if s.ch != nil {
+		s.ch <- job.path
+	}
+	s.acquire()
+	all, _ := ioutil.ReadDir(job.path.String())
+	s.release()
+	s.progress.addDir()
+
+	files := all[:0]
+	for _, info := range all {
+		if !job.walk.skips(info.Name()) {
+			files = append(files, info)
+		}
+	}
+
+	subs := make([]*FileNode, len(files))
+	for i, info := range files {
+		subs[i] = &FileNode{
+			Name:       info.Name(),
+			UUID:       uuid.NewString(),
+			ParentUUID: job.node.UUID,
+			Subs:       []*FileNode{},
+		}
+	}
+	job.node.Subs = append(job.node.Subs, subs...)
+
+	for i, info := range files {
+		p := filepath.Join(job.path.String(), info.Name())
+		if info.IsDir() {
+			// a folder sum only reads the names of its entries
+			s.entry(job.walk, subs[i], p, info)
+			continue
+		}
+		s.hash(hashJob{walk: job.walk, node: subs[i], path: p, info: info})
+	}
+}
+
+// entry computes the metadata of the node at p and queues it when it is a folder to descend into.
+func (s *scan) entry(w *fsWalk, node *FileNode, p string, info os.FileInfo) {
+	s.acquire()
+	meta, chunks, descend, key, err := w.stat(p, info)
+	s.release()
+	if err != nil {
+		w.logger.Error("sum error:", p, err)
+	}
+	node.Meta = meta
+	node.Chunks = chunks
+	if descend && w.descends(node.Name) {
+		s.push(dirJob{walk: w.enter(node.Name, key), node: node, path: connector.NewFSPath(p)})
+	}
+}
@@ -0,0 +1,46 @@
+package filenode
+
+import (
+	"github.com/ayhanozemre/fs-shadow/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_ScanHashCache(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cache")
+	_ = os.Mkdir(dir, os.ModePerm)
+	file := filepath.Join(dir, "test.txt")
+	_ = os.WriteFile(file, []byte("test"), 0644)
+	// files modified in the last seconds aren't cached
+	old := time.Now().Add(-time.Hour)
+	_ = os.Chtimes(file, old, old)
+
+	cache, err := utils.OpenHashCache(filepath.Join(t.TempDir(), "sums"))
+	assert.Equal(t, nil, err, "open error")
+	defer cache.Close()
+
+	progress := &ScanProgress{}
+	node := scanFolder(dir, Options{HashCache: cache, Progress: progress}).Search("cache/test.txt")
+	expected, _ := utils.FileSum(file)
+	assert.Equal(t, expected, node.Meta.Sum, "invalid sum")
+	assert.Equal(t, 1, cache.Len(), "sum not cached")
+	assert.Equal(t, int64(1), progress.FilesHashed(), "invalid hashed file count")
+
+	// a cached sum is used as long as the key matches, without reading the file
+	key := utils.HashKey{Device: node.Meta.Device, Inode: node.Meta.Inode, Size: 4, ModifiedAt: old.UnixNano(), Algo: utils.SHA256}
+	assert.Equal(t, nil, cache.Put(key, "cached"), "put error")
+	node = scanFolder(dir, Options{HashCache: cache, Progress: progress}).Search("cache/test.txt")
+	assert.Equal(t, "cached", node.Meta.Sum, "cache not consulted")
+	assert.Equal(t, int64(1), progress.FilesHashed(), "cached sum counted as hashed")
+
+	_ = os.WriteFile(file, []byte("changed"), 0644)
+	_ = os.Chtimes(file, old, old)
+	node = scanFolder(dir, Options{HashCache: cache, Progress: progress}).Search("cache/test.txt")
+	expected, _ = utils.FileSum(file)
+	assert.Equal(t, expected, node.Meta.Sum, "outdated sum used")
+	assert.Equal(t, int64(2), progress.FilesHashed(), "invalid hashed file count")
+	assert.Equal(t, int64(4+7), progress.BytesHashed(), "invalid hashed byte count")
+}
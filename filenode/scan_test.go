@@ -0,0 +1,160 @@
+package filenode
+
+import (
+	"fmt"
+	connector "github.com/ayhanozemre/fs-shadow/path"
+	"github.com/ayhanozemre/fs-shadow/utils"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func makeScanFolder(t *testing.T) (string, int64) {
+	dir := filepath.Join(t.TempDir(), "scan")
+	var size int64
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 4; j++ {
+			sub := filepath.Join(dir, fmt.Sprintf("dir-%d", i), fmt.Sprintf("sub-%d", j))
+			_ = os.MkdirAll(sub, os.ModePerm)
+			for k := 0; k < 3; k++ {
+				content := []byte(fmt.Sprintf("file %d %d %d", i, j, k))
+				_ = os.WriteFile(filepath.Join(sub, fmt.Sprintf("file-%d.txt", k)), content, 0644)
+				size += int64(len(content))
+			}
+		}
+	}
+	return dir, size
+}
+
+func scanFolder(dir string, opts Options) *FileNode {
+	root := &FileNode{Name: filepath.Base(dir), Meta: MetaData{IsDir: true}}
+	root.SetOptions(opts)
+	var wg sync.WaitGroup
+	WalkOnFsPath(root, connector.NewFSPath(dir), &wg, nil)
+	wg.Wait()
+	root.Reindex()
+	return root
+}
+
+func Test_ScanLimits(t *testing.T) {
+	dir, size := makeScanFolder(t)
+	expected := make(map[string]string)
+	for _, m := range scanFolder(dir, Options{}).Query(func(string, *FileNode) bool { return true }) {
+		expected[m.Path] = m.Node.Meta.Sum
+	}
+	assert.Equal(t, 5+5*4+5*4*3, len(expected), "invalid node count")
+
+	progress := &ScanProgress{}
+	limits := ScanLimits{ListWorkers: 1, HashWorkers: 1, MaxOpenFiles: 1}
+	root := scanFolder(dir, Options{Scan: limits, Progress: progress})
+	result := make(map[string]string)
+	for _, m := range root.Query(func(string, *FileNode) bool { return true }) {
+		result[m.Path] = m.Node.Meta.Sum
+	}
+	assert.Equal(t, expected, result, "limited scan differs")
+	assert.Equal(t, "dir-0", root.Subs[0].Name, "subs out of order")
+
+	assert.Equal(t, int64(1+5+5*4), progress.DirsScanned(), "invalid scanned folder count")
+	assert.Equal(t, int64(5*4*3), progress.FilesHashed(), "invalid hashed file count")
+	assert.Equal(t, size, progress.BytesHashed(), "invalid hashed byte count")
+
+	var none *ScanProgress
+	assert.Equal(t, int64(0), none.DirsScanned(), "nil progress counted")
+}
+
+func Test_ScanExcludeAndDepth(t *testing.T) {
+	dir, _ := makeScanFolder(t)
+
+	root := scanFolder(dir, Options{Exclude: []string{"dir-0", "**/file-1.txt"}})
+	assert.Nil(t, root.Search("scan/dir-0"), "excluded folder scanned")
+	assert.Nil(t, root.Search("scan/dir-1/sub-0/file-1.txt"), "excluded file scanned")
+	assert.NotNil(t, root.Search("scan/dir-1/sub-0/file-0.txt"), "file not scanned")
+
+	root = scanFolder(dir, Options{MaxDepth: 2})
+	assert.Equal(t, 5, len(root.Subs), "invalid sub count")
+	sub := root.Search("scan/dir-1/sub-0")
+	assert.NotNil(t, sub, "folder at max depth not scanned")
+	assert.Equal(t, 0, len(sub.Subs), "folder at max depth descended")
+	assert.NotEqual(t, "", sub.Meta.Sum, "folder at max depth has no sum")
+
+	opts := Options{Exclude: []string{"dir-0", "["}, MaxDepth: 2}
+	assert.False(t, opts.Skips(""), "root skipped")
+	assert.True(t, opts.Skips("dir-0/sub-0"), "entry of excluded folder not skipped")
+	assert.True(t, opts.Skips("dir-1/sub-0/file-0.txt"), "entry below max depth not skipped")
+	assert.False(t, opts.Skips("dir-1/sub-0"), "entry at max depth skipped")
+
+	logger, hook := test.NewNullLogger()
+	opts.Logger = logger
+	root.SetOptions(opts)
+	assert.Equal(t, 1, len(hook.AllEntries()), "malformed pattern not logged")
+	opts = root.Options()
+	assert.True(t, opts.Skips("dir-0/sub-0"), "entry of excluded folder not skipped")
+	assert.False(t, opts.Skips("dir-1/sub-0"), "entry at max depth skipped")
+	assert.Equal(t, 1, len(hook.AllEntries()), "patterns compiled again")
+}
+
+func Test_ScanQuickSum(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "quick")
+	_ = os.Mkdir(dir, os.ModePerm)
+	large := filepath.Join(dir, "large.bin")
+	_ = os.WriteFile(large, make([]byte, 1000), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "small.txt"), []byte("test"), 0644)
+
+	opts := Options{QuickSum: utils.QuickSampling{Edge: 16, Samples: 2, Block: 8}}
+	root := scanFolder(dir, opts)
+	node := root.Search("quick/large.bin")
+	assert.True(t, node.Meta.WeakSum, "large file got a full sum")
+	assert.False(t, root.Search("quick/small.txt").Meta.WeakSum, "small file got a weak sum")
+	assert.Equal(t, 1, len(root.Query(HasWeakSum())), "invalid weak sum count")
+
+	// a full scan of the same content is not a change, the sums can't be compared
+	assert.Equal(t, 0, len(Diff(scanFolder(dir, Options{}), root, DiffOptions{})), "weak sum reported as a change")
+
+	node, err := root.UpgradeSum(connector.NewFSPath("quick/large.bin"), connector.NewFSPath(large))
+	assert.Equal(t, nil, err, "upgrade error")
+	expected, _ := utils.FileSum(large)
+	assert.False(t, node.Meta.WeakSum, "sum not upgraded")
+	assert.Equal(t, expected, node.Meta.Sum, "invalid upgraded sum")
+	assert.Equal(t, 0, len(root.Query(HasWeakSum())), "weak sum left")
+
+	_, err = root.UpgradeSum(connector.NewFSPath("quick/missing.bin"), connector.NewFSPath(filepath.Join(dir, "missing.bin")))
+	assert.NotEqual(t, nil, err, "missing node upgraded")
+}
+
+func Test_ScanDeferSums(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "deferred")
+	_ = os.Mkdir(dir, os.ModePerm)
+	file := filepath.Join(dir, "test.txt")
+	_ = os.WriteFile(file, []byte("test"), 0644)
+
+	progress := &ScanProgress{}
+	opts := Options{DeferSums: true, Progress: progress}
+	root := scanFolder(dir, opts)
+	node := root.Search("deferred/test.txt")
+	assert.True(t, node.Meta.SumPending, "sum not deferred")
+	assert.Equal(t, int64(0), progress.FilesHashed(), "deferred sum counted as hashed")
+	assert.Equal(t, "", node.Meta.Sum, "deferred sum computed")
+	assert.False(t, root.Meta.SumPending, "folder sum deferred")
+	assert.Equal(t, 1, len(root.Query(HasPendingSum())), "invalid pending sum count")
+
+	meta, _, err := ComputeSum(opts, connector.NewFSPath(file))
+	assert.Equal(t, nil, err, "compute error")
+	expected, _ := utils.FileSum(file)
+	assert.Equal(t, expected, meta.Sum, "invalid computed sum")
+
+	// the sum of an older version of the file isn't stored
+	stale := meta
+	stale.Size = 3
+	_, ok := root.ResolveSum(node.UUID, stale, nil)
+	assert.False(t, ok, "stale sum stored")
+
+	node, ok = root.ResolveSum(node.UUID, meta, nil)
+	assert.True(t, ok, "sum not stored")
+	assert.False(t, node.Meta.SumPending, "sum still pending")
+	assert.Equal(t, expected, root.Search("deferred/test.txt").Meta.Sum, "sum not in the tree")
+	_, ok = root.ResolveSum(node.UUID, meta, nil)
+	assert.False(t, ok, "resolved sum stored twice")
+}
@@ -0,0 +1,150 @@
+package filenode
+
+import "errors"
+
+/*
+	Snapshots share their nodes with the live tree. Taking one only copies the root and bumps the generation of the
+	tree; from then on every node whose generation is older than the tree's is treated as shared, and the mutating
+	methods copy it (and its parents up to the root) before changing it, so the snapshot keeps seeing the old nodes.
+	A snapshot is read-only: Search, SearchByUUID, Walk, Query and marshalling can be used on it from any goroutine,
+	while the methods that change nodes return an error or leave it untouched. Parent pointers are not part of a
+	snapshot, so Path is only meaningful for the nodes of the live tree. The parent pointers of the shared nodes lead
+	to the live tree, so the nodes a snapshot hands out are views: copies without a parent that belong to the
+	snapshot, which can be searched and are read-only as well. The Subs of a node are the shared nodes themselves.
+	Nodes of the live tree may be replaced by copies after a Snapshot, so pointers taken before it should be looked
+	up again (or taken from the return values of the mutating methods) before they are modified.
+*/
+
+var errSnapshot = errors.New("snapshot is read-only")
+
+// Snapshot returns a view of fn and everything below it that never changes, no matter what happens to the tree.
+func (fn *FileNode) Snapshot() *FileNode {
+	t := fn.state()
+	if t.frozen {
+		return fn
+	}
+	snap := *fn
+	snap.parent = nil
+	snap.tree = &tree{opts: t.opts, gen: t.gen, frozen: true}
+	t.gen++
+	return &snap
+}
+
+// frozen returns the snapshot fn is the root or a view of, nil for the nodes of a live tree.
+func (fn *FileNode) frozen() *tree {
+	if fn != nil && fn.tree != nil && fn.tree.frozen {
+		return fn.tree
+	}
+	return nil
+}
+
+// view returns n as a node of the snapshot t, see the comment above. Only the fields the live tree never changes on
+// a shared node are read.
+func (t *tree) view(n *FileNode) *FileNode {
+	if t == nil || n == nil || n.tree == t {
+		return n
+	}
+	return &FileNode{
+		Subs:       n.Subs,
+		Name:       n.Name,
+		UUID:       n.UUID,
+		ParentUUID: n.ParentUUID,
+		Meta:       n.Meta,
+		Stats:      n.Stats,
+		Chunks:     n.Chunks,
+		tree:       t,
+		gen:        n.gen,
+	}
+}
+
+// writable returns the state of the tree fn belongs to, unless the tree is a snapshot.
+func (fn *FileNode) writable() (*tree, error) {
+	t := fn.state()
+	if t.frozen {
+		return nil, errSnapshot
+	}
+	return t, nil
+}
+
+func copySubs(subs []*FileNode) []*FileNode {
+	if subs == nil {
+		return nil
+	}
+	c := make([]*FileNode, len(subs))
+	copy(c, subs)
+	return c
+}
+
+// mutable returns the version of fn that only belongs to the live tree and can be changed in place.
+func (fn *FileNode) mutable(t *tree) *FileNode {
+	if fn.gen == t.gen {
+		return fn
+	}
+	if fn.parent == nil {
+		if fn.tree == t {
+			// the live root keeps its identity, only the slice and the map it shares with the snapshots are copied
+			fn.Subs = copySubs(fn.Subs)
+			fn.buildSubIndex()
+			fn.gen = t.gen
+			return fn
+		}
+		// a removed node, changes to it don't reach any tree
+		c := *fn
+		c.Subs = copySubs(fn.Subs)
+		c.buildSubIndex()
+		c.gen = t.gen
+		return &c
+	}
+
+	parent := fn.parent.mutable(t)
+	for i, sub := range parent.Subs {
+		if sub == fn {
+			return parent.cloneSub(i, t)
+		}
+	}
+	// fn has already been replaced by a copy
+	if live := parent.sub(fn.Name); live != nil && live.UUID == fn.UUID {
+		return live
+	}
+	return fn
+}
+
+// cloneSub replaces the i-th sub of fn, which must be mutable, with a copy owned by the live tree.
+func (fn *FileNode) cloneSub(i int, t *tree) *FileNode {
+	shared := fn.Subs[i]
+	c := *shared
+	c.Subs = copySubs(shared.Subs)
+	c.buildSubIndex()
+	c.parent = fn
+	c.gen = t.gen
+	for _, sub := range c.Subs {
+		sub.parent = &c
+	}
+	fn.Subs[i] = &c
+	fn.subIndex[c.Name] = &c
+	if c.UUID != "" && t.uuids[c.UUID] == shared {
+		t.uuids[c.UUID] = &c
+	}
+	return &c
+}
+
+// adopt marks the nodes that have just been added to the tree as owned by it.
+func (t *tree) adopt(node *FileNode) {
+	node.gen = t.gen
+	for _, sub := range node.Subs {
+		t.adopt(sub)
+	}
+}
+
+// searchSnapshot looks for uuid without the index, which snapshots don't have.
+func (fn *FileNode) searchSnapshot(uuid string) *FileNode {
+	var found *FileNode
+	_ = Walk(fn, func(relPath string, n *FileNode) error {
+		if n.UUID == uuid {
+			found = n
+			return SkipAll
+		}
+		return nil
+	})
+	return found
+}
@@ -0,0 +1,134 @@
+package filenode
+
+import (
+	"encoding/json"
+	"fmt"
+	connector "github.com/ayhanozemre/fs-shadow/path"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func makeSnapshotTree() *FileNode {
+	root := &FileNode{Name: "root", UUID: "r", Meta: MetaData{IsDir: true}}
+	_ = root.AddSub(&FileNode{Name: "docs", UUID: "docs", Meta: MetaData{IsDir: true}})
+	_ = root.AddSub(&FileNode{Name: "src", UUID: "src", Meta: MetaData{IsDir: true}})
+	_ = root.SearchByUUID("docs").AddSub(&FileNode{Name: "a.txt", UUID: "a", Meta: MetaData{Sum: "sum-a", Size: 1}})
+	_ = root.SearchByUUID("src").AddSub(&FileNode{Name: "lib", UUID: "lib", Meta: MetaData{IsDir: true}})
+	_ = root.SearchByUUID("lib").AddSub(&FileNode{Name: "lib.go", UUID: "lib-go", Meta: MetaData{Sum: "sum-lib", Size: 2}})
+	return root
+}
+
+func marshalTree(t *testing.T, n *FileNode) string {
+	b, err := json.Marshal(n)
+	assert.Equal(t, nil, err, "marshal error")
+	return string(b)
+}
+
+func Test_Snapshot(t *testing.T) {
+	tree := makeSnapshotTree()
+	tree.SetOptions(Options{Merkle: true})
+	snap := tree.Snapshot()
+	before := marshalTree(t, snap)
+
+	_, err := tree.Move(connector.NewVirtualPath("root/src/lib", true), connector.NewVirtualPath("root/docs", true))
+	assert.Equal(t, nil, err, "move process error")
+	_, err = tree.Rename(connector.NewVirtualPath("root/docs/a.txt", false), connector.NewVirtualPath("root/docs/b.txt", false))
+	assert.Equal(t, nil, err, "rename process error")
+	tree.SearchByUUID("lib-go").SetMeta(MetaData{Sum: "sum-lib-2", Size: 20})
+	_, err = tree.Remove(connector.NewVirtualPath("root/src", true))
+	assert.Equal(t, nil, err, "remove process error")
+	err = tree.SearchByUUID("lib").AddSub(&FileNode{Name: "new.go", UUID: "new"})
+	assert.Equal(t, nil, err, "add process error")
+
+	assert.Equal(t, before, marshalTree(t, snap), "snapshot changed")
+	assert.NotNil(t, snap.Search("root/src/lib/lib.go"), "snapshot lost a node")
+	assert.Equal(t, int64(2), snap.SearchByUUID("lib-go").Meta.Size, "snapshot sees the new metadata")
+	assert.Nil(t, snap.SearchByUUID("new"), "snapshot sees the new node")
+
+	assert.Equal(t, "root/docs/lib/lib.go", tree.SearchByUUID("lib-go").Path(), "live node is misplaced")
+	assert.Equal(t, tree.SearchByUUID("lib-go"), tree.Search("root/docs/lib/lib.go"), "uuid index out of date")
+	assert.Equal(t, int64(20), tree.SearchByUUID("lib-go").Meta.Size, "write not applied")
+	assert.Equal(t, int64(21), tree.Stats.TotalBytes, "stats not updated")
+	assert.NotEqual(t, snap.Meta.Sum, tree.Meta.Sum, "root sum not updated")
+
+	// the live tree must end up like a tree that never had a snapshot
+	fresh := makeSnapshotTree()
+	fresh.SetOptions(Options{Merkle: true})
+	_, _ = fresh.Move(connector.NewVirtualPath("root/src/lib", true), connector.NewVirtualPath("root/docs", true))
+	_, _ = fresh.Rename(connector.NewVirtualPath("root/docs/a.txt", false), connector.NewVirtualPath("root/docs/b.txt", false))
+	fresh.SearchByUUID("lib-go").SetMeta(MetaData{Sum: "sum-lib-2", Size: 20})
+	_, _ = fresh.Remove(connector.NewVirtualPath("root/src", true))
+	_ = fresh.SearchByUUID("lib").AddSub(&FileNode{Name: "new.go", UUID: "new"})
+	assert.Equal(t, marshalTree(t, fresh), marshalTree(t, tree), "live tree differs")
+}
+
+func Test_SnapshotReadOnly(t *testing.T) {
+	snap := makeSnapshotTree().Snapshot()
+	before := marshalTree(t, snap)
+
+	_, err := snap.Move(connector.NewVirtualPath("root/src/lib", true), connector.NewVirtualPath("root/docs", true))
+	assert.NotEqual(t, nil, err, "snapshot moved a node")
+	_, err = snap.RemoveByUUID("a", "docs")
+	assert.NotEqual(t, nil, err, "snapshot removed a node")
+	err = snap.AddSub(&FileNode{Name: "new", UUID: "new"})
+	assert.NotEqual(t, nil, err, "snapshot added a node")
+	snap.SetMeta(MetaData{Sum: "changed"})
+	assert.Equal(t, before, marshalTree(t, snap), "snapshot changed")
+}
+
+func Test_SnapshotConcurrentReads(t *testing.T) {
+	tree := makeSnapshotTree()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		snap := tree.Snapshot()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = snap.Query(IsFile())
+			_ = snap.Search("root/docs/a.txt")
+			_, _ = json.Marshal(snap)
+		}()
+		node := tree.SearchByUUID("a")
+		node.SetMeta(MetaData{Size: node.Meta.Size + 1})
+	}
+	wg.Wait()
+	assert.Equal(t, int64(21), tree.SearchByUUID("a").Meta.Size, "writes lost")
+}
+
+func Test_SnapshotInnerNodes(t *testing.T) {
+	tree := makeSnapshotTree()
+	snap := tree.Snapshot()
+	lib := snap.Search("root/src/lib")
+
+	_, err := tree.RenameByUUID("lib", "lib-2")
+	assert.Equal(t, nil, err, "rename process error")
+	assert.NotNil(t, lib.SearchByUUID("lib-go"), "inner snapshot node lost its subs")
+	assert.NotNil(t, snap.SearchByUUID("src").SearchByUUID("lib-go"), "inner snapshot node lost its subs")
+	assert.Equal(t, "lib", lib.Name, "inner snapshot node renamed")
+	assert.NotEqual(t, nil, lib.AddSub(&FileNode{Name: "new.go", UUID: "new"}), "inner snapshot node changed")
+	_, err = lib.RenameByUUID("lib-go", "other.go")
+	assert.NotEqual(t, nil, err, "inner snapshot node renamed a node")
+	assert.Nil(t, tree.SearchByUUID("new"), "live tree changed through the snapshot")
+	assert.NotNil(t, tree.Search("root/src/lib-2/lib.go"), "live tree changed through the snapshot")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		snap := tree.Snapshot()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			inner := snap.Search("root/src").SearchByUUID("lib")
+			_ = inner.SearchByUUID("lib-go")
+			_ = Walk(inner, func(relPath string, n *FileNode) error {
+				_ = n.SearchByUUID("lib-go")
+				return nil
+			})
+		}()
+		_, err = tree.RenameByUUID("lib", fmt.Sprintf("lib-%d", i))
+		assert.Equal(t, nil, err, "rename process error")
+		_, err = tree.RenameByUUID("lib-go", fmt.Sprintf("lib-%d.go", i))
+		assert.Equal(t, nil, err, "rename process error")
+	}
+	wg.Wait()
+}
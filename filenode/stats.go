@@ -0,0 +1,55 @@
+package filenode
+
+// Stats are the du-style totals of everything below a folder, they are kept up to date with the sums (see
+// propagate) so reading them never walks the tree. Files have empty stats.
+type Stats struct {
+	TotalBytes int64 `json:"total_bytes"`
+	FileCount  int64 `json:"file_count"`
+	DirCount   int64 `json:"dir_count"`
+	// NewestModifiedAt is the latest modification time, see MetaData.ModifiedTime, of the files and folders below the
+	// folder in nanoseconds.
+	NewestModifiedAt int64 `json:"newest_modified_at"`
+}
+
+// share is what the node adds to the stats of its folder.
+func (fn *FileNode) share() Stats {
+	modifiedAt := fn.Meta.ModifiedTime().UnixNano()
+	if !fn.Meta.IsDir {
+		return Stats{TotalBytes: fn.Meta.Size, FileCount: 1, NewestModifiedAt: modifiedAt}
+	}
+	stats := fn.Stats
+	stats.DirCount++
+	if modifiedAt > stats.NewestModifiedAt {
+		stats.NewestModifiedAt = modifiedAt
+	}
+	return stats
+}
+
+// subStats sums the shares of the subs and records them, every folder brings its own totals so only one level is
+// visited.
+func (fn *FileNode) subStats() Stats {
+	var stats Stats
+	for _, sub := range fn.Subs {
+		sub.counted = sub.share()
+		stats.account(Stats{}, sub.counted, nil)
+	}
+	return stats
+}
+
+// account replaces the share from of a sub in stats with to. Only a newest modification time that got older needs the
+// shares of the other subs.
+func (stats *Stats) account(from Stats, to Stats, subs []*FileNode) {
+	stats.TotalBytes += to.TotalBytes - from.TotalBytes
+	stats.FileCount += to.FileCount - from.FileCount
+	stats.DirCount += to.DirCount - from.DirCount
+	if to.NewestModifiedAt >= stats.NewestModifiedAt {
+		stats.NewestModifiedAt = to.NewestModifiedAt
+	} else if from.NewestModifiedAt == stats.NewestModifiedAt {
+		stats.NewestModifiedAt = 0
+		for _, sub := range subs {
+			if sub.counted.NewestModifiedAt > stats.NewestModifiedAt {
+				stats.NewestModifiedAt = sub.counted.NewestModifiedAt
+			}
+		}
+	}
+}
@@ -1,6 +1,11 @@
 package filenode
 
-import "time"
+import (
+	"github.com/ayhanozemre/fs-shadow/utils"
+	"os"
+	"strconv"
+	"time"
+)
 
 type DateType int
 
@@ -9,18 +14,81 @@ const (
 	NANO
 )
 
+// NodeType tells what kind of file a node stands for, it is empty in trees recorded before it was introduced.
+type NodeType string
+
+const (
+	TypeRegular NodeType = "regular"
+	TypeDir     NodeType = "dir"
+	TypeSymlink NodeType = "symlink"
+)
+
 type MetaData struct {
-	IsDir      bool   `json:"is_dir"`
-	Sum        string `json:"sum"`
-	Size       int64  `json:"size"`
-	CreatedAt  int64  `json:"created_at"`
-	Permission string `json:"permission"`
+	IsDir bool   `json:"is_dir"`
+	Sum   string `json:"sum"`
+	// SumAlgo names the utils hasher Sum was computed with, empty in trees recorded before it was introduced.
+	SumAlgo string `json:"sum_algo"`
+	// WeakSum tells that Sum is a quick sum which only read parts of the file, see utils.QuickSumWith.
+	// FileNode.UpgradeSum replaces it with a full one.
+	WeakSum bool `json:"weak_sum"`
+	// SumPending tells that Sum is empty because hashing the file was deferred, see Options.DeferSums.
+	SumPending bool     `json:"sum_pending"`
+	Size       int64    `json:"size"`
+	CreatedAt  int64    `json:"created_at"`
+	Permission string   `json:"permission"`
+	Type       NodeType `json:"type"`
+	// LinkTarget is the path a symlink points to, as it was written in the link.
+	LinkTarget string `json:"link_target"`
+	// Ownership and inode data, only filled on Linux. User and Group are empty when the ids can't be resolved.
+	Uid    uint32 `json:"uid"`
+	Gid    uint32 `json:"gid"`
+	User   string `json:"user"`
+	Group  string `json:"group"`
+	Inode  uint64 `json:"inode"`
+	Device uint64 `json:"device"`
+	Nlink  uint64 `json:"nlink"`
+	// Timestamps in unix nanoseconds, zero when unknown. CreatedAt keeps the modification time in seconds for the
+	// readers of older trees, which only have that. BornAt is only filled where the filesystem records it.
+	ModifiedAt int64 `json:"modified_at"`
+	ChangedAt  int64 `json:"changed_at"`
+	AccessedAt int64 `json:"accessed_at"`
+	BornAt     int64 `json:"born_at"`
+	// Mode holds the permission bits, Permission keeps the decimal os.FileMode for the readers of older trees.
+	Mode FileMode `json:"mode"`
+}
+
+// SumAlgorithm returns SumAlgo, trees recorded before it was introduced were hashed with utils.DefaultHasher.
+func (m MetaData) SumAlgorithm() string {
+	if m.SumAlgo == "" {
+		return utils.DefaultHasher
+	}
+	return m.SumAlgo
+}
+
+// FileMode returns the permission bits, falling back to Permission for trees recorded before Mode existed.
+func (m MetaData) FileMode() FileMode {
+	if m.Mode != 0 || m.Permission == "" {
+		return m.Mode
+	}
+	mode, err := strconv.ParseUint(m.Permission, 10, 32)
+	if err != nil {
+		return 0
+	}
+	return ModeOf(os.FileMode(mode))
+}
+
+// ModifiedTime returns the modification time, falling back to CreatedAt for trees recorded before ModifiedAt existed.
+func (m MetaData) ModifiedTime() time.Time {
+	if m.ModifiedAt != 0 {
+		return time.Unix(0, m.ModifiedAt).UTC()
+	}
+	return time.Unix(m.CreatedAt, 0).UTC()
 }
 
 func (m MetaData) CreatedDate(t DateType) time.Time {
 	switch t {
 	case NANO:
-		return time.Unix(0, time.Unix(m.CreatedAt, 0).UnixNano()).UTC()
+		return m.ModifiedTime()
 	default:
 		return time.Unix(m.CreatedAt, 0).UTC()
 	}
@@ -30,7 +98,24 @@ type ExtraPayload struct {
 	UUID       string
 	IsDir      bool
 	Sum        string
+	SumAlgo    string
+	WeakSum    bool
+	SumPending bool
 	Size       int64
 	CreatedAt  int64
 	Permission string
+	Type       NodeType
+	LinkTarget string
+	Uid        uint32
+	Gid        uint32
+	User       string
+	Group      string
+	Inode      uint64
+	Device     uint64
+	Nlink      uint64
+	ModifiedAt int64
+	ChangedAt  int64
+	AccessedAt int64
+	BornAt     int64
+	Mode       FileMode
 }
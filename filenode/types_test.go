@@ -2,7 +2,9 @@ package filenode
 
 import (
 	"crypto/sha256"
+	"encoding/json"
 	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
 	"testing"
 	"time"
 )
@@ -36,3 +38,20 @@ func TestMetaData_CreatedDateWithMilli(t *testing.T) {
 	assert.Equal(t, int64(1262304000), metadata.CreatedDate(MILLI).Unix())
 	assert.Equal(t, createAt, metadata.CreatedDate(MILLI))
 }
+
+func TestMetaData_ModifiedTime(t *testing.T) {
+	modifiedAt := time.Date(2010, 1, 1, 0, 0, 0, 123456789, time.UTC)
+	metadata := MetaData{CreatedAt: modifiedAt.Unix(), ModifiedAt: modifiedAt.UnixNano()}
+	assert.Equal(t, modifiedAt, metadata.ModifiedTime())
+	assert.Equal(t, modifiedAt, metadata.CreatedDate(NANO))
+
+	// trees recorded before ModifiedAt existed
+	var old MetaData
+	assert.Nil(t, json.Unmarshal([]byte(`{"is_dir":false,"size":1,"created_at":1262304000}`), &old))
+	assert.Equal(t, time.Unix(1262304000, 0).UTC(), old.ModifiedTime())
+	b, err := msgpack.Marshal(struct{ CreatedAt int64 }{CreatedAt: 1262304000})
+	assert.Nil(t, err)
+	old = MetaData{}
+	assert.Nil(t, msgpack.Unmarshal(b, &old))
+	assert.Equal(t, time.Unix(1262304000, 0).UTC(), old.ModifiedTime())
+}
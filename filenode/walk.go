@@ -0,0 +1,116 @@
+package filenode
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sort"
+)
+
+// SkipDir and SkipAll work like their io/fs counterparts when they are returned from a WalkFunc.
+var SkipDir = fs.SkipDir
+var SkipAll = errors.New("skip everything and stop the walk")
+
+// WalkFunc receives every node with its path relative to the root of the walk, the root itself is ".".
+type WalkFunc func(relPath string, n *FileNode) error
+
+// Walk visits root and all the nodes below it in pre-order, the subs of a folder are visited in name order.
+func Walk(root *FileNode, fn WalkFunc) error {
+	it := NewIterator(root)
+	for it.Next() {
+		err := fn(it.Path(), it.Node())
+		if err == SkipDir {
+			it.SkipDir()
+		} else if err == SkipAll {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type iteratorFrame struct {
+	path  string
+	node  *FileNode
+	subs  []*FileNode
+	index int
+}
+
+/*
+	Iterator is the pull-style version of Walk, the walk only advances when Next is called, so it can be paused
+	and resumed at any time. The tree must not change while it is iterated.
+*/
+type Iterator struct {
+	root *FileNode
+	// snapshot is set when root belongs to a snapshot, the nodes are handed out as its views.
+	snapshot *tree
+
+	stack   []*iteratorFrame
+	path    string
+	node    *FileNode
+	parent  *FileNode
+	started bool
+	skip    bool
+}
+
+func NewIterator(root *FileNode) *Iterator {
+	return &Iterator{root: root, snapshot: root.frozen()}
+}
+
+// Next moves to the next node and reports whether there is one.
+func (it *Iterator) Next() bool {
+	if !it.started {
+		it.started = true
+		it.path, it.node = ".", it.root
+		return it.root != nil
+	}
+	if it.node == nil {
+		return false
+	}
+	if !it.skip && len(it.node.Subs) > 0 {
+		subs := make([]*FileNode, len(it.node.Subs))
+		copy(subs, it.node.Subs)
+		sort.Slice(subs, func(i, j int) bool { return subs[i].Name < subs[j].Name })
+		it.stack = append(it.stack, &iteratorFrame{path: it.path, node: it.node, subs: subs})
+	}
+	it.skip = false
+
+	for len(it.stack) > 0 {
+		frame := it.stack[len(it.stack)-1]
+		if frame.index == len(frame.subs) {
+			it.stack = it.stack[:len(it.stack)-1]
+			continue
+		}
+		it.node = frame.subs[frame.index]
+		it.parent = frame.node
+		it.path = filepath.Join(frame.path, it.node.Name)
+		frame.index++
+		return true
+	}
+	it.node, it.parent = nil, nil
+	return false
+}
+
+func (it *Iterator) Path() string {
+	return it.path
+}
+
+func (it *Iterator) Node() *FileNode {
+	return it.snapshot.view(it.node)
+}
+
+// Parent returns the folder the current node was reached from, it is nil for the root.
+func (it *Iterator) Parent() *FileNode {
+	return it.snapshot.view(it.parent)
+}
+
+// SkipDir keeps Next from descending into the current node. When the current node is a file, the remaining
+// subs of its folder are skipped as well.
+func (it *Iterator) SkipDir() {
+	it.skip = true
+	if it.node != nil && !it.node.Meta.IsDir && len(it.stack) > 0 {
+		frame := it.stack[len(it.stack)-1]
+		frame.index = len(frame.subs)
+	}
+}
@@ -0,0 +1,84 @@
+package filenode
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func makeWalkTree() *FileNode {
+	return &FileNode{Name: "root", Meta: MetaData{IsDir: true}, Subs: []*FileNode{
+		{Name: "b", Meta: MetaData{IsDir: true}, Subs: []*FileNode{
+			{Name: "b2.txt"},
+			{Name: "b1.txt"},
+		}},
+		{Name: "a", Meta: MetaData{IsDir: true}, Subs: []*FileNode{
+			{Name: "a1.txt"},
+		}},
+		{Name: "c.txt"},
+	}}
+}
+
+func Test_Walk(t *testing.T) {
+	var paths []string
+	err := Walk(makeWalkTree(), func(relPath string, n *FileNode) error {
+		paths = append(paths, relPath)
+		return nil
+	})
+	assert.Equal(t, nil, err, "walk error")
+	assert.Equal(t, []string{".", "a", "a/a1.txt", "b", "b/b1.txt", "b/b2.txt", "c.txt"}, paths, "invalid walk order")
+}
+
+func Test_WalkSkip(t *testing.T) {
+	var paths []string
+	_ = Walk(makeWalkTree(), func(relPath string, n *FileNode) error {
+		paths = append(paths, relPath)
+		if relPath == "a" || relPath == "b/b1.txt" {
+			return SkipDir
+		}
+		return nil
+	})
+	assert.Equal(t, []string{".", "a", "b", "b/b1.txt", "c.txt"}, paths, "skip dir error")
+
+	paths = nil
+	_ = Walk(makeWalkTree(), func(relPath string, n *FileNode) error {
+		paths = append(paths, relPath)
+		if relPath == "b" {
+			return SkipAll
+		}
+		return nil
+	})
+	assert.Equal(t, []string{".", "a", "a/a1.txt", "b"}, paths, "skip all error")
+
+	walkErr := errors.New("stop")
+	err := Walk(makeWalkTree(), func(relPath string, n *FileNode) error {
+		return walkErr
+	})
+	assert.Equal(t, walkErr, err, "walk error not returned")
+}
+
+func Test_Iterator(t *testing.T) {
+	root := makeWalkTree()
+	it := NewIterator(root)
+	assert.True(t, it.Next(), "root not visited")
+	assert.Equal(t, root, it.Node(), "first node is not the root")
+	assert.Nil(t, it.Parent(), "root has a parent")
+
+	assert.True(t, it.Next(), "iteration stopped early")
+	assert.Equal(t, "a", it.Path(), "invalid path")
+	it.SkipDir()
+
+	// the iterator keeps its position between calls
+	assert.True(t, it.Next(), "iteration stopped early")
+	assert.Equal(t, "b", it.Path(), "invalid path after skip")
+	assert.True(t, it.Next(), "iteration stopped early")
+	assert.Equal(t, "b/b1.txt", it.Path(), "invalid path")
+	assert.Equal(t, "b", it.Parent().Name, "invalid parent")
+
+	count := 0
+	for it.Next() {
+		count++
+	}
+	assert.Equal(t, 2, count, "invalid number of remaining nodes")
+	assert.False(t, it.Next(), "iterator restarted")
+}
@@ -28,18 +28,32 @@ func (path FSPath) IsDir() bool {
 	return fInfo.IsDir()
 }
 
+// Info describes the file the path points to, a symlink is only described by itself when its target is missing.
 func (path *FSPath) Info() *FileInfo {
-	p, _ := os.Stat(path.String())
-	return &FileInfo{
-		IsDir:      p.IsDir(),
-		Size:       p.Size(),
-		CreatedAt:  p.ModTime().Unix(),
-		Permission: fmt.Sprintf("%d", p.Mode()),
+	l, err := os.Lstat(path.String())
+	if err != nil {
+		return &FileInfo{}
+	}
+	info := FileInfo{}
+	if l.Mode()&os.ModeSymlink != 0 {
+		info.IsSymlink = true
+		info.LinkTarget, _ = os.Readlink(path.String())
+	}
+	p, err := os.Stat(path.String())
+	if err != nil {
+		p = l
 	}
+	info.IsDir = p.IsDir()
+	info.Size = p.Size()
+	info.CreatedAt = p.ModTime().Unix()
+	info.Permission = fmt.Sprintf("%d", p.Mode())
+	info.StatInfo = StatOf(path.String(), p)
+	return &info
 }
 
+// Exists reports whether there is an entry at the path, dangling symlinks exist too.
 func (path *FSPath) Exists() bool {
-	if _, err := os.Stat(path.String()); os.IsNotExist(err) {
+	if _, err := os.Lstat(path.String()); os.IsNotExist(err) {
 		return false
 	}
 	return true
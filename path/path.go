@@ -21,4 +21,22 @@ type FileInfo struct {
 	Size       int64
 	CreatedAt  int64
 	Permission string
+	IsSymlink  bool
+	LinkTarget string
+	StatInfo
+}
+
+// StatInfo holds the ownership, inode data and timestamps of a file, see StatOf. Timestamps are unix nanoseconds.
+type StatInfo struct {
+	Uid        uint32
+	Gid        uint32
+	User       string
+	Group      string
+	Inode      uint64
+	Device     uint64
+	Nlink      uint64
+	ModifiedAt int64
+	ChangedAt  int64
+	AccessedAt int64
+	BornAt     int64
 }
@@ -0,0 +1,102 @@
+package connector
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// FileKey identifies the file the path points to by its device and inode number, symlinks are followed.
+func FileKey(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("no stat data for %s", path)
+	}
+	return fmt.Sprintf("%d:%d", st.Dev, st.Ino), nil
+}
+
+// StatOf reads the ownership, inode data and timestamps of info, which was read from path. The user and group names
+// are resolved through os/user and the birth time is read with statx, it stays zero where the filesystem doesn't
+// record it.
+func StatOf(path string, info os.FileInfo) StatInfo {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return StatInfo{ModifiedAt: info.ModTime().UnixNano()}
+	}
+	return StatInfo{
+		Uid:        st.Uid,
+		Gid:        st.Gid,
+		User:       names.user(st.Uid),
+		Group:      names.group(st.Gid),
+		Inode:      uint64(st.Ino),
+		Device:     uint64(st.Dev),
+		Nlink:      uint64(st.Nlink),
+		ModifiedAt: st.Mtim.Nano(),
+		ChangedAt:  st.Ctim.Nano(),
+		AccessedAt: st.Atim.Nano(),
+		BornAt:     birthTime(path, info),
+	}
+}
+
+// birthTime asks statx for the creation time of path, info tells whether the path itself is a symlink that must not
+// be followed.
+func birthTime(path string, info os.FileInfo) int64 {
+	if path == "" {
+		return 0
+	}
+	flags := 0
+	if info.Mode()&os.ModeSymlink != 0 {
+		flags = unix.AT_SYMLINK_NOFOLLOW
+	}
+	var stx unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, path, flags, unix.STATX_BTIME, &stx); err != nil {
+		return 0
+	}
+	if stx.Mask&unix.STATX_BTIME == 0 {
+		return 0
+	}
+	return stx.Btime.Sec*int64(1e9) + int64(stx.Btime.Nsec)
+}
+
+// nameCache keeps the results of os/user lookups, failed lookups are kept as empty names.
+type nameCache struct {
+	users  map[uint32]string
+	groups map[uint32]string
+	sync.Mutex
+}
+
+var names = nameCache{users: make(map[uint32]string), groups: make(map[uint32]string)}
+
+func (c *nameCache) user(uid uint32) string {
+	c.Lock()
+	defer c.Unlock()
+	name, ok := c.users[uid]
+	if !ok {
+		if u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10)); err == nil {
+			name = u.Username
+		}
+		c.users[uid] = name
+	}
+	return name
+}
+
+func (c *nameCache) group(gid uint32) string {
+	c.Lock()
+	defer c.Unlock()
+	name, ok := c.groups[gid]
+	if !ok {
+		if g, err := user.LookupGroupId(strconv.FormatUint(uint64(gid), 10)); err == nil {
+			name = g.Name
+		}
+		c.groups[gid] = name
+	}
+	return name
+}
@@ -0,0 +1,43 @@
+package connector
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_FSPathStatInfo(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.txt")
+	_ = os.WriteFile(file, []byte("test"), 0644)
+	link := file + ".link"
+	_ = os.Link(file, link)
+
+	info := NewFSPath(file).Info()
+	var st syscall.Stat_t
+	assert.Equal(t, nil, syscall.Stat(file, &st), "stat error")
+	assert.Equal(t, uint32(os.Getuid()), info.Uid, "invalid uid")
+	assert.Equal(t, uint32(os.Getgid()), info.Gid, "invalid gid")
+	assert.Equal(t, st.Ino, info.Inode, "invalid inode")
+	assert.Equal(t, uint64(2), info.Nlink, "invalid link count")
+	assert.Equal(t, info.User, NewFSPath(link).Info().User, "user names differ")
+	assert.Equal(t, st.Mtim.Nano(), info.ModifiedAt, "invalid modification time")
+	assert.Equal(t, st.Ctim.Nano(), info.ChangedAt, "invalid change time")
+	assert.Equal(t, st.Atim.Nano(), info.AccessedAt, "invalid access time")
+	if info.BornAt != 0 {
+		assert.LessOrEqual(t, info.BornAt, info.ModifiedAt, "born after the last modification")
+	}
+}
+
+func Test_FSPathNanoTimes(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.txt")
+	_ = os.WriteFile(file, []byte("test"), 0644)
+	modifiedAt := time.Date(2010, 1, 1, 0, 0, 0, 123456789, time.UTC)
+	assert.Equal(t, nil, os.Chtimes(file, modifiedAt, modifiedAt), "chtimes error")
+
+	info := NewFSPath(file).Info()
+	assert.Equal(t, modifiedAt.UnixNano(), info.ModifiedAt, "modification time lost its precision")
+	assert.Equal(t, modifiedAt.UnixNano(), info.AccessedAt, "access time lost its precision")
+}
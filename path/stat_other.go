@@ -0,0 +1,20 @@
+//go:build !linux
+
+package connector
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// FileKey identifies the file the path points to, symlinks are followed. Without the device and inode numbers the
+// resolved path is the best identity there is.
+func FileKey(path string) (string, error) {
+	return filepath.EvalSymlinks(path)
+}
+
+// StatOf is only fully implemented on Linux, elsewhere the ownership and inode data stay empty and the modification
+// time is the only timestamp.
+func StatOf(path string, info os.FileInfo) StatInfo {
+	return StatInfo{ModifiedAt: info.ModTime().UnixNano()}
+}
@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/bits"
+	"os"
+)
+
+// ChunkSizes are the bounds of the chunks of a file in bytes, the zero value disables chunking. Avg is rounded down
+// to a power of two.
+type ChunkSizes struct {
+	Min int `json:"min"`
+	Avg int `json:"avg"`
+	Max int `json:"max"`
+}
+
+var DefaultChunkSizes = ChunkSizes{Min: 16 << 10, Avg: 64 << 10, Max: 256 << 10}
+
+// Chunk is a part of a file, Sum is computed over the bytes of the part only.
+type Chunk struct {
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Sum    string `json:"sum"`
+}
+
+// ChunkDiff lists the chunks of the new content that the old content doesn't have and the ones it lost, chunks are
+// compared by their sums. Added chunks have the offsets of the new content and removed ones those of the old.
+type ChunkDiff struct {
+	Added   []Chunk `json:"added"`
+	Removed []Chunk `json:"removed"`
+}
+
+// DiffChunks compares two manifests of the same file, a chunk that appears twice has to be found twice.
+func DiffChunks(oldChunks, newChunks []Chunk) ChunkDiff {
+	var diff ChunkDiff
+	count := make(map[string]int, len(oldChunks))
+	for _, c := range oldChunks {
+		count[c.Sum]++
+	}
+	for _, c := range newChunks {
+		if count[c.Sum] > 0 {
+			count[c.Sum]--
+			continue
+		}
+		diff.Added = append(diff.Added, c)
+	}
+	for i := len(oldChunks) - 1; i >= 0; i-- {
+		c := oldChunks[i]
+		if count[c.Sum] > 0 {
+			count[c.Sum]--
+			diff.Removed = append([]Chunk{c}, diff.Removed...)
+		}
+	}
+	return diff
+}
+
+// gear holds the random values the rolling hash adds for every byte. They come from a fixed seed so the chunks of
+// a file are the same in every process.
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x66732d736861646f) // splitmix64
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Enabled tells whether files are chunked with these sizes.
+func (s ChunkSizes) Enabled() bool {
+	return s != ChunkSizes{}
+}
+
+// Validate reports sizes that can't be chunked with.
+func (s ChunkSizes) Validate() error {
+	if s.Min < 1 || s.Avg < s.Min || s.Max < s.Avg {
+		return errors.New("chunk sizes must satisfy 0 < min <= avg <= max")
+	}
+	if s.Avg < 16 {
+		return errors.New("average chunk size must be at least 16 bytes")
+	}
+	return nil
+}
+
+// masks returns the masks of the rolling hash before and after the average size. The first one has more bits, so
+// cuts are less likely before the average and more likely after it, which keeps the sizes close to the average.
+func (s ChunkSizes) masks() (small uint64, large uint64) {
+	n := bits.Len(uint(s.Avg)) - 1
+	top := func(ones int) uint64 {
+		// the high bits of the hash depend on the most recent bytes
+		return ^uint64(0) << (64 - ones)
+	}
+	return top(n + 2), top(n - 2)
+}
+
+// cut returns the size of the chunk at the start of data, data holds at most Max bytes.
+func (s ChunkSizes) cut(data []byte, small, large uint64) int {
+	n := len(data)
+	if n <= s.Min {
+		return n
+	}
+	normal := s.Avg
+	if n < normal {
+		normal = n
+	}
+	var fp uint64
+	i := s.Min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&small == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&large == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+/*
+ChunkReader splits the content of r into chunks whose boundaries depend on the content (FastCDC), so inserting or
+removing bytes only changes the chunks around the edit. It also returns the sum of the whole content, which is the
+same as FileSumWith would compute.
+*/
+func ChunkReader(r io.Reader, sizes ChunkSizes, algo string) (string, []Chunk, error) {
+	hasher, err := GetHasher(algo)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := sizes.Validate(); err != nil {
+		return "", nil, err
+	}
+	small, large := sizes.masks()
+	whole := hasher()
+	br := bufio.NewReaderSize(io.TeeReader(r, whole), sizes.Max)
+	var chunks []Chunk
+	var offset int64
+	for {
+		data, err := br.Peek(sizes.Max)
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			return "", nil, err
+		}
+		if len(data) == 0 {
+			break
+		}
+		n := sizes.cut(data, small, large)
+		h := hasher()
+		h.Write(data[:n])
+		chunks = append(chunks, Chunk{Offset: offset, Size: int64(n), Sum: hex.EncodeToString(h.Sum(nil))})
+		offset += int64(n)
+		_, _ = br.Discard(n)
+	}
+	return hex.EncodeToString(whole.Sum(nil)), chunks, nil
+}
+
+// ChunkFile is ChunkReader over the file at path.
+func ChunkFile(path string, sizes ChunkSizes, algo string) (string, []Chunk, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	return ChunkReader(f, sizes, algo)
+}
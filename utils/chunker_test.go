@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_ChunkReader(t *testing.T) {
+	sizes := ChunkSizes{Min: 1 << 10, Avg: 4 << 10, Max: 16 << 10}
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	file := filepath.Join(t.TempDir(), "test.bin")
+	_ = os.WriteFile(file, data, 0644)
+
+	sum, chunks, err := ChunkFile(file, sizes, SHA256)
+	assert.Equal(t, nil, err, "chunk error")
+	expected, _ := FileSum(file)
+	assert.Equal(t, expected, sum, "invalid whole sum")
+
+	var offset int64
+	for i, c := range chunks {
+		assert.Equal(t, offset, c.Offset, "chunks not contiguous")
+		assert.LessOrEqual(t, c.Size, int64(sizes.Max), "chunk larger than max")
+		if i < len(chunks)-1 {
+			assert.GreaterOrEqual(t, c.Size, int64(sizes.Min), "chunk smaller than min")
+		}
+		offset += c.Size
+	}
+	assert.Equal(t, int64(len(data)), offset, "chunks don't cover the content")
+	avg := len(data) / len(chunks)
+	assert.True(t, avg > sizes.Avg/2 && avg < sizes.Avg*2, "average chunk size off: %d", avg)
+
+	_, again, _ := ChunkReader(bytes.NewReader(data), sizes, SHA256)
+	assert.Equal(t, chunks, again, "chunks not deterministic")
+
+	// an insertion only changes the chunks around it
+	edited := append(append(append([]byte{}, data[:len(data)/2]...), []byte("inserted")...), data[len(data)/2:]...)
+	_, editedChunks, _ := ChunkReader(bytes.NewReader(edited), sizes, SHA256)
+	diff := DiffChunks(chunks, editedChunks)
+	assert.True(t, len(diff.Added) > 0 && len(diff.Added) <= 2, "invalid added chunks: %d", len(diff.Added))
+	assert.True(t, len(diff.Removed) > 0 && len(diff.Removed) <= 2, "invalid removed chunks: %d", len(diff.Removed))
+	assert.Equal(t, ChunkDiff{}, DiffChunks(chunks, chunks), "equal manifests differ")
+
+	_, empty, err := ChunkReader(bytes.NewReader(nil), sizes, SHA256)
+	assert.Equal(t, nil, err, "empty content error")
+	assert.Equal(t, 0, len(empty), "chunks of empty content")
+}
+
+func Test_ChunkSizes(t *testing.T) {
+	assert.False(t, ChunkSizes{}.Enabled(), "zero sizes enabled")
+	assert.Equal(t, nil, DefaultChunkSizes.Validate(), "default sizes invalid")
+	assert.NotEqual(t, nil, ChunkSizes{Min: 64, Avg: 32, Max: 128}.Validate(), "min above avg accepted")
+	assert.NotEqual(t, nil, ChunkSizes{Min: 1, Avg: 8, Max: 8}.Validate(), "tiny avg accepted")
+	_, _, err := ChunkReader(bytes.NewReader(nil), ChunkSizes{}, SHA256)
+	assert.NotEqual(t, nil, err, "zero sizes used")
+}
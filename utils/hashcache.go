@@ -0,0 +1,296 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const hashCacheHeader = "fs-shadow hash cache 1"
+
+// HashKey identifies the content of a file without reading it, a file whose size or modification time changed is
+// looked up with a different key. Algo is the name of the hasher the sum was computed with.
+type HashKey struct {
+	Device     uint64
+	Inode      uint64
+	Size       int64
+	ModifiedAt int64
+	Algo       string
+}
+
+type hashFile struct {
+	device uint64
+	inode  uint64
+}
+
+type hashEntry struct {
+	size       int64
+	modifiedAt int64
+	sum        string
+}
+
+/*
+HashCache keeps the sums of files on disk so they don't have to be read again after a restart. The file is a log of
+text lines that is only appended to:
+
+	fs-shadow hash cache 1
+	P <device> <inode> <size> <mtime ns> <algo> <sum>
+	D <device> <inode>
+
+The fields are separated by tabs. P records a sum and D forgets every sum of a file, the last line about a file wins.
+Lines that can't be parsed, like one cut short by a crash, are skipped. Compact rewrites the log with only the sums
+still known.
+*/
+type HashCache struct {
+	path string
+	file *os.File
+	w    *bufio.Writer
+	// entries holds the sums of every file by the names of their hashers.
+	entries map[hashFile]map[string]hashEntry
+	// sums is the number of sums in entries and records the number of lines in the log after the header.
+	sums    int
+	records int
+	// closed is set by Close, Compact would open the log again otherwise.
+	closed bool
+	sync.Mutex
+}
+
+// OpenHashCache loads the cache at path, creating it when there is none. The log is compacted when most of its
+// lines are outdated.
+func OpenHashCache(path string) (*HashCache, error) {
+	c := HashCache{path: path, entries: make(map[hashFile]map[string]hashEntry)}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	if c.records > 1024 && c.records > 2*c.sums {
+		if err := c.compact(); err != nil {
+			return nil, err
+		}
+		return &c, nil
+	}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *HashCache) load() error {
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return scanner.Err()
+	}
+	if scanner.Text() != hashCacheHeader {
+		return errors.New("not a hash cache: " + c.path)
+	}
+	for scanner.Scan() {
+		c.records++
+		fields := strings.Split(scanner.Text(), "\t")
+		switch {
+		case len(fields) == 7 && fields[0] == "P":
+			id, ok := parseHashFile(fields[1], fields[2])
+			size, err1 := strconv.ParseInt(fields[3], 10, 64)
+			modifiedAt, err2 := strconv.ParseInt(fields[4], 10, 64)
+			if ok && err1 == nil && err2 == nil {
+				c.set(id, fields[5], hashEntry{size: size, modifiedAt: modifiedAt, sum: fields[6]})
+			}
+		case len(fields) == 3 && fields[0] == "D":
+			if id, ok := parseHashFile(fields[1], fields[2]); ok {
+				c.forget(id)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func parseHashFile(device, inode string) (hashFile, bool) {
+	d, err1 := strconv.ParseUint(device, 10, 64)
+	i, err2 := strconv.ParseUint(inode, 10, 64)
+	return hashFile{device: d, inode: i}, err1 == nil && err2 == nil
+}
+
+func (c *HashCache) set(id hashFile, algo string, e hashEntry) {
+	sums, ok := c.entries[id]
+	if !ok {
+		sums = make(map[string]hashEntry)
+		c.entries[id] = sums
+	}
+	if _, ok := sums[algo]; !ok {
+		c.sums++
+	}
+	sums[algo] = e
+}
+
+func (c *HashCache) forget(id hashFile) bool {
+	sums, ok := c.entries[id]
+	if ok {
+		c.sums -= len(sums)
+		delete(c.entries, id)
+	}
+	return ok
+}
+
+// open prepares the log for appending, a new log starts with the header.
+func (c *HashCache) open() error {
+	f, err := os.OpenFile(c.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	c.file = f
+	c.w = bufio.NewWriter(f)
+	if info.Size() == 0 {
+		_, err = c.w.WriteString(hashCacheHeader + "\n")
+		return err
+	}
+	// end a line cut short by a crash, so the next one isn't appended to it
+	last := make([]byte, 1)
+	if _, err = f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+		_, err = c.w.WriteString("\n")
+	}
+	return err
+}
+
+// Get returns the sum recorded for the key, it misses when the file changed since.
+func (c *HashCache) Get(key HashKey) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[hashFile{device: key.Device, inode: key.Inode}][key.Algo]
+	if !ok || e.size != key.Size || e.modifiedAt != key.ModifiedAt {
+		return "", false
+	}
+	return e.sum, true
+}
+
+// Put records the sum of the file, it replaces the sum recorded with the same hasher before.
+func (c *HashCache) Put(key HashKey, sum string) error {
+	if key.Algo == "" || strings.ContainsAny(key.Algo+sum, "\t\n") {
+		return errors.New("invalid hash cache entry")
+	}
+	c.Lock()
+	defer c.Unlock()
+	id := hashFile{device: key.Device, inode: key.Inode}
+	e := hashEntry{size: key.Size, modifiedAt: key.ModifiedAt, sum: sum}
+	if old, ok := c.entries[id][key.Algo]; ok && old == e {
+		return nil
+	}
+	c.set(id, key.Algo, e)
+	return c.append(fmt.Sprintf("P\t%d\t%d\t%d\t%d\t%s\t%s\n", key.Device, key.Inode, key.Size, key.ModifiedAt, key.Algo, sum))
+}
+
+// Invalidate forgets the sums of the file with every hasher.
+func (c *HashCache) Invalidate(device, inode uint64) error {
+	c.Lock()
+	defer c.Unlock()
+	if !c.forget(hashFile{device: device, inode: inode}) {
+		return nil
+	}
+	return c.append(fmt.Sprintf("D\t%d\t%d\n", device, inode))
+}
+
+func (c *HashCache) append(line string) error {
+	if c.w == nil {
+		return errors.New("hash cache is closed")
+	}
+	c.records++
+	_, err := c.w.WriteString(line)
+	return err
+}
+
+// Len returns the number of sums in the cache.
+func (c *HashCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.sums
+}
+
+// Compact rewrites the log with only the sums still in the cache. The new log replaces the old one at once, so a
+// crash leaves one of them intact. It fails once the cache is closed.
+func (c *HashCache) Compact() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return errors.New("hash cache is closed")
+	}
+	if err := c.close(); err != nil {
+		return err
+	}
+	return c.compact()
+}
+
+func (c *HashCache) compact() error {
+	tmp := c.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	_, _ = w.WriteString(hashCacheHeader + "\n")
+	for id, sums := range c.entries {
+		for algo, e := range sums {
+			_, _ = fmt.Fprintf(w, "P\t%d\t%d\t%d\t%d\t%s\t%s\n", id.device, id.inode, e.size, e.modifiedAt, algo, e.sum)
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, c.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	c.records = c.sums
+	return c.open()
+}
+
+// Flush writes the buffered lines to the log.
+func (c *HashCache) Flush() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.w == nil {
+		return nil
+	}
+	return c.w.Flush()
+}
+
+// Close flushes and closes the log, the cache can't record sums or be compacted afterwards.
+func (c *HashCache) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	c.closed = true
+	return c.close()
+}
+
+func (c *HashCache) close() error {
+	if c.file == nil {
+		return nil
+	}
+	err := c.w.Flush()
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	c.file, c.w = nil, nil
+	return err
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_HashCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sums")
+	c, err := OpenHashCache(path)
+	assert.Equal(t, nil, err, "open error")
+
+	key := HashKey{Device: 1, Inode: 2, Size: 3, ModifiedAt: 4, Algo: SHA256}
+	other := HashKey{Device: 1, Inode: 5, Size: 3, ModifiedAt: 4, Algo: SHA256}
+	assert.Equal(t, nil, c.Put(key, "sum-1"), "put error")
+	assert.Equal(t, nil, c.Put(HashKey{Device: 1, Inode: 2, Size: 3, ModifiedAt: 4, Algo: MD5}, "sum-md5"), "put error")
+	assert.Equal(t, nil, c.Put(other, "sum-2"), "put error")
+	assert.Equal(t, nil, c.Invalidate(other.Device, other.Inode), "invalidate error")
+	assert.Equal(t, nil, c.Close(), "close error")
+
+	c, err = OpenHashCache(path)
+	assert.Equal(t, nil, err, "reopen error")
+	defer c.Close()
+	sum, ok := c.Get(key)
+	assert.True(t, ok, "sum not persisted")
+	assert.Equal(t, "sum-1", sum, "invalid sum")
+	_, ok = c.Get(HashKey{Device: 1, Inode: 2, Size: 3, ModifiedAt: 5, Algo: SHA256})
+	assert.False(t, ok, "sum of a modified file returned")
+	_, ok = c.Get(other)
+	assert.False(t, ok, "invalidated sum returned")
+	assert.Equal(t, 2, c.Len(), "invalid sum count")
+	assert.NotEqual(t, nil, c.Put(HashKey{Algo: "bad\talgo"}, "sum"), "entry breaking the log accepted")
+}
+
+func Test_HashCacheRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sums")
+	_ = os.WriteFile(path, []byte(hashCacheHeader+"\nP\t1\t2\t3\t4\tsha256\tsum-1\nP\t1\t3\t3"), 0644)
+
+	c, err := OpenHashCache(path)
+	assert.Equal(t, nil, err, "open error")
+	assert.Equal(t, 1, c.Len(), "torn line loaded")
+	assert.Equal(t, nil, c.Put(HashKey{Device: 1, Inode: 4, Size: 3, ModifiedAt: 4, Algo: SHA256}, "sum-2"), "put error")
+	assert.Equal(t, nil, c.Close(), "close error")
+
+	c, err = OpenHashCache(path)
+	assert.Equal(t, nil, err, "reopen error")
+	assert.Equal(t, 2, c.Len(), "line after the torn one lost")
+	_ = c.Close()
+
+	_ = os.WriteFile(path, []byte("something else\n"), 0644)
+	_, err = OpenHashCache(path)
+	assert.NotEqual(t, nil, err, "foreign file opened")
+}
+
+func Test_HashCacheCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sums")
+	c, err := OpenHashCache(path)
+	assert.Equal(t, nil, err, "open error")
+	for i := int64(0); i < 100; i++ {
+		assert.Equal(t, nil, c.Put(HashKey{Device: 1, Inode: 2, Size: 3, ModifiedAt: i, Algo: SHA256}, "sum"), "put error")
+	}
+	assert.Equal(t, nil, c.Flush(), "flush error")
+	before, _ := os.Stat(path)
+
+	assert.Equal(t, nil, c.Compact(), "compact error")
+	after, _ := os.Stat(path)
+	assert.Less(t, after.Size(), before.Size(), "log not compacted")
+	assert.Equal(t, nil, c.Put(HashKey{Device: 1, Inode: 3, Size: 3, ModifiedAt: 0, Algo: SHA256}, "sum"), "put after compact error")
+	assert.Equal(t, nil, c.Close(), "close error")
+	assert.NotEqual(t, nil, c.Compact(), "closed cache compacted")
+	assert.NotEqual(t, nil, c.Put(HashKey{Device: 1, Inode: 4, Size: 3, ModifiedAt: 0, Algo: SHA256}, "sum"), "put after compacting a closed cache")
+
+	c, err = OpenHashCache(path)
+	assert.Equal(t, nil, err, "reopen error")
+	defer c.Close()
+	_, ok := c.Get(HashKey{Device: 1, Inode: 2, Size: 3, ModifiedAt: 99, Algo: SHA256})
+	assert.True(t, ok, "latest sum lost in compaction")
+	assert.Equal(t, 2, c.Len(), "invalid sum count")
+}
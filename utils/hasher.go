@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// Hasher creates the hash a sum is computed with.
+type Hasher func() hash.Hash
+
+// Names of the built-in hashers.
+const (
+	SHA256 = "sha256"
+	SHA1   = "sha1"
+	MD5    = "md5"
+	CRC32C = "crc32c"
+	FNV128 = "fnv128"
+)
+
+// DefaultHasher is used when no hasher is named, trees recorded before hashers could be chosen use it too.
+const DefaultHasher = SHA256
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+var hashers = struct {
+	m map[string]Hasher
+	sync.RWMutex
+}{m: map[string]Hasher{
+	SHA256: sha256.New,
+	SHA1:   sha1.New,
+	MD5:    md5.New,
+	CRC32C: func() hash.Hash { return crc32.New(crc32cTable) },
+	FNV128: fnv.New128,
+}}
+
+// RegisterHasher adds a hasher that can be chosen by its name, the names in use can't be registered again.
+func RegisterHasher(name string, h Hasher) error {
+	if name == "" || h == nil {
+		return errors.New("hasher needs a name and a function")
+	}
+	hashers.Lock()
+	defer hashers.Unlock()
+	if _, ok := hashers.m[name]; ok {
+		return errors.New("hasher already registered: " + name)
+	}
+	hashers.m[name] = h
+	return nil
+}
+
+// GetHasher returns the hasher registered under name, an empty name is the DefaultHasher.
+func GetHasher(name string) (Hasher, error) {
+	if name == "" {
+		name = DefaultHasher
+	}
+	hashers.RLock()
+	defer hashers.RUnlock()
+	h, ok := hashers.m[name]
+	if !ok {
+		return nil, errors.New("unknown hasher: " + name)
+	}
+	return h, nil
+}
+
+// Hashers returns the names of the registered hashers in alphabetical order.
+func Hashers() []string {
+	hashers.RLock()
+	defer hashers.RUnlock()
+	names := make([]string, 0, len(hashers.m))
+	for name := range hashers.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
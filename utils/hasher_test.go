@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"crypto/sha512"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_Hashers(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.txt")
+	_ = os.WriteFile(file, []byte("123456789"), 0644)
+
+	cases := map[string]string{
+		SHA256: "15e2b0d3c33891ebb0f1ef609ec419420c20e320ce94c65fbc8c3312448eb225",
+		SHA1:   "f7c3bc1d808e04732adf679965ccc34ca7ae3441",
+		MD5:    "25f9e794323b453885f5181f1b624d0b",
+		CRC32C: "e3069283",
+		FNV128: "8bea2c73be03b30fd4142fb1ec2c2066",
+	}
+	for algo, expected := range cases {
+		sum, err := FileSumWith(file, algo)
+		assert.Equal(t, nil, err, "sum error: %s", algo)
+		assert.Equal(t, expected, sum, "invalid sum: %s", algo)
+	}
+	sum, _ := FileSum(file)
+	assert.Equal(t, cases[DefaultHasher], sum, "invalid default sum")
+
+	_, err := FileSumWith(file, "unknown")
+	assert.NotEqual(t, nil, err, "unknown hasher used")
+}
+
+func Test_RegisterHasher(t *testing.T) {
+	assert.Equal(t, nil, RegisterHasher("sha512-test", sha512.New), "register error")
+	assert.NotEqual(t, nil, RegisterHasher("sha512-test", sha512.New), "hasher registered twice")
+	assert.NotEqual(t, nil, RegisterHasher(MD5, sha512.New), "built-in hasher replaced")
+	assert.Contains(t, Hashers(), "sha512-test", "hasher not listed")
+
+	sum, err := LinkSumWith("target", "sha512-test")
+	assert.Equal(t, nil, err, "sum error")
+	assert.Equal(t, 128, len(sum), "sum not computed with the registered hasher")
+}
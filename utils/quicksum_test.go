@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_QuickSum(t *testing.T) {
+	s := QuickSampling{Edge: 16, Samples: 2, Block: 8}
+	assert.Equal(t, int64(48), s.Threshold(), "invalid threshold")
+	dir := t.TempDir()
+
+	small := filepath.Join(dir, "small.txt")
+	_ = os.WriteFile(small, []byte("123456789"), 0644)
+	sum, weak, err := QuickSumWith(small, s, SHA256)
+	assert.Equal(t, nil, err, "quick sum error")
+	assert.False(t, weak, "small file sampled")
+	expected, _ := FileSum(small)
+	assert.Equal(t, expected, sum, "small file not hashed whole")
+
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	large := filepath.Join(dir, "large.bin")
+	_ = os.WriteFile(large, data, 0644)
+	sum, weak, err = QuickSumWith(large, s, SHA256)
+	assert.Equal(t, nil, err, "quick sum error")
+	assert.True(t, weak, "large file hashed whole")
+	full, _ := FileSum(large)
+	assert.NotEqual(t, full, sum, "quick sum equals full sum")
+
+	// the samples are at 16+(1000-40)*i/3, a change between them isn't seen
+	changed := func(offset int) string {
+		c := append([]byte{}, data...)
+		c[offset]++
+		_ = os.WriteFile(large, c, 0644)
+		quick, _, _ := QuickSumWith(large, s, SHA256)
+		return quick
+	}
+	assert.Equal(t, sum, changed(100), "unsampled change detected")
+	assert.NotEqual(t, sum, changed(5), "change at the start missed")
+	assert.NotEqual(t, sum, changed(995), "change at the end missed")
+	assert.NotEqual(t, sum, changed(340), "change in a sample missed")
+	_ = os.WriteFile(large, data[:999], 0644)
+	shorter, _, _ := QuickSumWith(large, s, SHA256)
+	assert.NotEqual(t, sum, shorter, "size change missed")
+
+	assert.False(t, QuickSampling{}.Enabled(), "zero sampling enabled")
+	assert.Equal(t, nil, DefaultQuickSampling.Validate(), "default sampling invalid")
+	assert.NotEqual(t, nil, QuickSampling{Edge: 16, Samples: 2}.Validate(), "samples without a block accepted")
+}
@@ -2,25 +2,38 @@ package utils
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"github.com/ayhanozemre/fs-shadow/path"
 	"io"
 	"io/ioutil"
 	"os"
+	"sort"
 )
 
 const FolderDeepLimit = 100
 
 func Sum(path connector.Path) (string, error) {
+	return SumWith(path, DefaultHasher)
+}
+
+// SumWith is Sum computed with the hasher registered under algo.
+func SumWith(path connector.Path, algo string) (string, error) {
 	if path.IsDir() {
-		return FolderSum(path.String())
+		return FolderSumWith(path.String(), algo)
 	}
-	return FileSum(path.String())
+	return FileSumWith(path.String(), algo)
 }
 
 func FolderSum(path string) (string, error) {
+	return FolderSumWith(path, DefaultHasher)
+}
+
+func FolderSumWith(path string, algo string) (string, error) {
+	hasher, err := GetHasher(algo)
+	if err != nil {
+		return "", err
+	}
 	deepCount := 0
 	var buff bytes.Buffer
 
@@ -37,23 +50,78 @@ func FolderSum(path string) (string, error) {
 		p, _ := os.Stat(path)
 		buff.WriteString(fmt.Sprint(p.ModTime().Unix()))
 	}
-	h := sha256.New()
+	h := hasher()
 	h.Write(buff.Bytes())
 	value := hex.EncodeToString(h.Sum(nil))
 	return value, nil
 }
 
 func FileSum(path string) (string, error) {
+	return FileSumWith(path, DefaultHasher)
+}
+
+func FileSumWith(path string, algo string) (string, error) {
+	hasher, err := GetHasher(algo)
+	if err != nil {
+		return "", err
+	}
 	f, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
 
-	h := sha256.New()
+	h := hasher()
 	if _, err := io.Copy(h, f); err != nil {
 		return "", err
 	}
 	value := hex.EncodeToString(h.Sum(nil))
 	return value, nil
 }
+
+// LinkSum is the sum of a symlink that isn't followed, it only depends on where the link points to.
+func LinkSum(target string) string {
+	sum, _ := LinkSumWith(target, DefaultHasher)
+	return sum
+}
+
+func LinkSumWith(target string, algo string) (string, error) {
+	hasher, err := GetHasher(algo)
+	if err != nil {
+		return "", err
+	}
+	h := hasher()
+	h.Write([]byte(target))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type SumEntry struct {
+	Name string
+	Sum  string
+}
+
+// MerkleSum hashes the names and sums of the entries of a folder with the DefaultHasher. The order of the entries
+// doesn't matter.
+func MerkleSum(entries []SumEntry) string {
+	sum, _ := MerkleSumWith(entries, DefaultHasher)
+	return sum
+}
+
+func MerkleSumWith(entries []SumEntry, algo string) (string, error) {
+	hasher, err := GetHasher(algo)
+	if err != nil {
+		return "", err
+	}
+	sorted := make([]SumEntry, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	h := hasher()
+	for _, e := range sorted {
+		h.Write([]byte(e.Name))
+		h.Write([]byte{0})
+		h.Write([]byte(e.Sum))
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
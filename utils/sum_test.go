@@ -47,3 +47,18 @@ func Test_Sum(t *testing.T) {
 	_ = os.RemoveAll(testFolder)
 
 }
+
+func Test_MerkleSum(t *testing.T) {
+	a := MerkleSum([]SumEntry{{Name: "a", Sum: "1"}, {Name: "b", Sum: "2"}})
+	b := MerkleSum([]SumEntry{{Name: "b", Sum: "2"}, {Name: "a", Sum: "1"}})
+	assert.Equal(t, a, b, "entry order changed the sum")
+	assert.NotEqual(t, a, MerkleSum([]SumEntry{{Name: "a", Sum: "1"}, {Name: "b", Sum: "3"}}), "sum change not detected")
+	assert.NotEqual(t, a, MerkleSum([]SumEntry{{Name: "a", Sum: "1"}, {Name: "c", Sum: "2"}}), "name change not detected")
+	assert.NotEqual(t, MerkleSum([]SumEntry{{Name: "ab", Sum: "c"}}), MerkleSum([]SumEntry{{Name: "a", Sum: "bc"}}), "ambiguous encoding")
+
+	crc, err := MerkleSumWith([]SumEntry{{Name: "a", Sum: "1"}, {Name: "b", Sum: "2"}}, CRC32C)
+	assert.Equal(t, nil, err, "merkle sum error")
+	assert.Equal(t, 8, len(crc), "sum not made with the named hasher")
+	_, err = MerkleSumWith(nil, "unknown")
+	assert.NotEqual(t, nil, err, "unknown hasher accepted")
+}
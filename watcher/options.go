@@ -0,0 +1,244 @@
+package watcher
+
+import (
+	"errors"
+	"github.com/ayhanozemre/fs-shadow/filenode"
+	"github.com/ayhanozemre/fs-shadow/utils"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// Option changes the configuration of a watcher when it is created.
+type Option func(*config)
+
+type config struct {
+	linkPolicy filenode.LinkPolicy
+	hasher     string
+	scanLimits filenode.ScanLimits
+	progress   *filenode.ScanProgress
+	hashCache  *utils.HashCache
+	chunks     utils.ChunkSizes
+	quickSum   utils.QuickSampling
+	sumWorkers int
+	tick       time.Duration
+	events     int
+	errors     int
+	exclude    []string
+	maxDepth   int
+	logger     log.FieldLogger
+	drain      time.Duration
+	overflow   OverflowPolicy
+	scanTxns   bool
+}
+
+func newConfig(opts []Option) *config {
+	cfg := config{
+		progress: &filenode.ScanProgress{},
+		tick:     2 * time.Second,
+		logger:   log.StandardLogger(),
+		drain:    10 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return &cfg
+}
+
+// treeOptions are the settings the tree of the watcher is created with.
+func (c *config) treeOptions() filenode.Options {
+	return filenode.Options{
+		Links:     c.linkPolicy,
+		Hasher:    c.hasher,
+		Scan:      c.scanLimits,
+		Progress:  c.progress,
+		HashCache: c.hashCache,
+		Chunks:    c.chunks,
+		QuickSum:  c.quickSum,
+		DeferSums: c.sumWorkers > 0,
+		Exclude:   c.exclude,
+		MaxDepth:  c.maxDepth,
+		Logger:    c.logger,
+	}
+}
+
+// channelSizes returns the sizes of the Events and Errors channels, the ones that aren't set are def. The channels are
+// never unbuffered, the constructors send the transaction of the root before anyone can read it.
+func (c *config) channelSizes(def int) (int, int) {
+	events, errs := c.events, c.errors
+	if events == 0 {
+		events = def
+	}
+	if errs == 0 {
+		errs = def
+	}
+	return events, errs
+}
+
+// sumQueue is the queue of the deferred sums, nil when sums aren't deferred.
+func (c *config) sumQueue() *sumQueue {
+	if c.sumWorkers == 0 {
+		return nil
+	}
+	return newSumQueue()
+}
+
+// validate reports the settings that can't be used.
+func (c *config) validate() error {
+	if _, err := utils.GetHasher(c.hasher); err != nil {
+		return err
+	}
+	if c.tick <= 0 {
+		return errors.New("tick interval must be positive")
+	}
+	if c.drain <= 0 {
+		return errors.New("drain timeout must be positive")
+	}
+	if c.events < 0 || c.errors < 0 {
+		return errors.New("channel sizes can't be negative")
+	}
+	if c.maxDepth < 0 {
+		return errors.New("max depth can't be negative")
+	}
+	for _, pattern := range c.exclude {
+		if _, err := filenode.Glob(pattern); err != nil {
+			return err
+		}
+	}
+	if c.chunks.Enabled() {
+		if err := c.chunks.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.quickSum.Enabled() {
+		return c.quickSum.Validate()
+	}
+	return nil
+}
+
+// WithLinkPolicy sets how symlinks are scanned. filenode.LinkRecord, the default, keeps links as leaves that hold their
+// target, filenode.LinkFollow scans them as the file or folder they point to.
+func WithLinkPolicy(policy filenode.LinkPolicy) Option {
+	return func(c *config) {
+		c.linkPolicy = policy
+	}
+}
+
+// WithHasher sets the utils hasher the sums of files are computed with, see utils.Hashers for the names. The default
+// is utils.DefaultHasher.
+func WithHasher(name string) Option {
+	return func(c *config) {
+		c.hasher = name
+	}
+}
+
+// WithScanLimits bounds the workers and open files of the scans, see filenode.ScanLimits for the defaults.
+func WithScanLimits(limits filenode.ScanLimits) Option {
+	return func(c *config) {
+		c.scanLimits = limits
+	}
+}
+
+// WithHashCache keeps the sums of the files in c, so a restart only reads the files that changed. The watcher flushes
+// the cache as it goes but never closes it.
+func WithHashCache(c *utils.HashCache) Option {
+	return func(cfg *config) {
+		cfg.hashCache = c
+	}
+}
+
+// WithChunking keeps a chunk manifest of every file larger than sizes.Max, so a Write reports the chunks it changed.
+// utils.DefaultChunkSizes suits most files.
+func WithChunking(sizes utils.ChunkSizes) Option {
+	return func(c *config) {
+		c.chunks = sizes
+	}
+}
+
+// WithQuickSum gives the files larger than the threshold of s weak sums that only read parts of them, so writes to
+// large files are cheap to handle. UpgradeSum and UpgradeSums replace them with full sums.
+func WithQuickSum(s utils.QuickSampling) Option {
+	return func(c *config) {
+		c.quickSum = s
+	}
+}
+
+// WithDeferredSums hashes files in the background on the given number of workers instead of while the events are
+// handled, so a large file doesn't hold back the events behind it. Create and Write transactions come with
+// filenode.MetaData.SumPending set and an event.SumUpdated transaction follows with the sum of each file.
+func WithDeferredSums(workers int) Option {
+	return func(c *config) {
+		if workers < 1 {
+			workers = 1
+		}
+		c.sumWorkers = workers
+	}
+}
+
+// WithTickInterval sets how often the file system events gathered are processed into transactions, 2 seconds by
+// default. Events that come close together, like the two halves of a move, are only matched within the same tick.
+func WithTickInterval(d time.Duration) Option {
+	return func(c *config) {
+		c.tick = d
+	}
+}
+
+// WithChannelSizes sets the buffers of the Events and Errors channels, zero keeps the default of 10, 100 on darwin.
+// The watcher blocks while a full channel isn't read.
+func WithChannelSizes(events int, errors int) Option {
+	return func(c *config) {
+		c.events = events
+		c.errors = errors
+	}
+}
+
+// WithExclude leaves the files and folders matching any of the patterns out of the tree, see filenode.Options.Exclude.
+// The patterns are matched against the paths relative to the watched folder, "**/node_modules" leaves out every
+// node_modules folder. It adds to the patterns of the previous WithExclude options.
+func WithExclude(patterns ...string) Option {
+	return func(c *config) {
+		c.exclude = append(c.exclude, patterns...)
+	}
+}
+
+// WithMaxDepth leaves the entries more than depth folders below the watched folder out of the tree, the entries of the
+// watched folder are at depth 1. Zero, the default, doesn't limit the depth.
+func WithMaxDepth(depth int) Option {
+	return func(c *config) {
+		c.maxDepth = depth
+	}
+}
+
+// WithLogger sets the logger the watcher and its scans write to, the standard logrus logger by default.
+func WithLogger(logger log.FieldLogger) Option {
+	return func(c *config) {
+		if logger == nil {
+			logger = log.StandardLogger()
+		}
+		c.logger = logger
+	}
+}
+
+// WithDrainTimeout bounds how long Stop waits for the transactions of the last events to be read, 10 seconds by
+// default.
+func WithDrainTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.drain = d
+	}
+}
+
+// WithOverflowPolicy sets what happens to the transactions and errors that aren't read in time, OverflowBlock by
+// default. The other policies never hold back the events, see OverflowPolicy.
+func WithOverflowPolicy(policy OverflowPolicy) Option {
+	return func(c *config) {
+		c.overflow = policy
+	}
+}
+
+// WithScanTransactions sends a Create transaction for every node the initial scan finds, parents first, followed by an
+// event.ScanComplete transaction. The nodes found below a folder created later are sent after its Create as well, so
+// the tree can be rebuilt from the transactions alone, see CreateFileNodeWithTransactions.
+func WithScanTransactions() Option {
+	return func(c *config) {
+		c.scanTxns = true
+	}
+}
@@ -0,0 +1,253 @@
+package watcher
+
+import (
+	"github.com/ayhanozemre/fs-shadow/event"
+	"github.com/ayhanozemre/fs-shadow/filenode"
+	"sync"
+	"sync/atomic"
+)
+
+// OverflowPolicy decides what a watcher does with the transactions and errors its consumer doesn't read fast enough.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for the consumer, the events behind a full channel wait as well.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest drops the oldest transaction that wasn't read yet to make room for a new one.
+	OverflowDropOldest
+	// OverflowDropNewest drops the transactions that don't fit.
+	OverflowDropNewest
+	// OverflowCoalesce merges the updates of a node with the transaction of the node that wasn't read yet, so only
+	// its latest state waits. The oldest transaction is dropped when nothing can be merged.
+	OverflowCoalesce
+)
+
+/*
+outbox sends the transactions and errors of a watcher to its consumer. With OverflowBlock they are sent right away,
+otherwise transactions wait in a queue as large as the Events channel and a goroutine moves them to the channel, so
+the watcher never waits for the consumer. A transaction that is dropped is followed by an event.Overflow transaction
+that tells the consumer to resync, errors are dropped silently. Both are counted.
+*/
+type outbox struct {
+	policy  OverflowPolicy
+	limit   int
+	deliver func(*EventTransaction)
+	errs    chan error
+	// mu and tree give the current tree of the watcher, the overflow marker identifies its root.
+	treeMu sync.Locker
+	tree   func() *filenode.FileNode
+
+	overflows int64
+	// seq is the Seq of the last transaction delivered, delivering guards it with OverflowBlock and the pump owns it
+	// otherwise.
+	seq        uint64
+	delivering sync.Mutex
+	// sending is held for reading by the senders, close takes it to wait for the ones in flight, which may be waiting
+	// for the consumer with OverflowBlock.
+	sending sync.RWMutex
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	queue      []*EventTransaction
+	overflowed bool
+	closed     bool
+	done       chan struct{}
+}
+
+// newOutbox returns the outbox that passes the transactions of the tree returned by tree, which is guarded by mu, to
+// deliver and sends the errors to errs, limit is the size of the Events channel.
+func newOutbox(policy OverflowPolicy, limit int, mu sync.Locker, tree func() *filenode.FileNode,
+	deliver func(*EventTransaction), errs chan error) *outbox {
+	o := outbox{
+		policy:  policy,
+		limit:   limit,
+		deliver: deliver,
+		errs:    errs,
+		treeMu:  mu,
+		tree:    tree,
+		done:    make(chan struct{}),
+	}
+	o.cond = sync.NewCond(&o.mu)
+	if policy == OverflowBlock {
+		close(o.done)
+	} else {
+		go o.pump()
+	}
+	return &o
+}
+
+// Overflows returns the number of transactions and errors dropped so far.
+func (o *outbox) Overflows() int64 {
+	return atomic.LoadInt64(&o.overflows)
+}
+
+// isClosed reports whether the outbox stopped taking transactions and errors, the channels may be closed already.
+func (o *outbox) isClosed() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.closed
+}
+
+func (o *outbox) send(txn *EventTransaction) {
+	o.sending.RLock()
+	defer o.sending.RUnlock()
+	if o.isClosed() {
+		return
+	}
+	if o.policy == OverflowBlock {
+		o.delivering.Lock()
+		defer o.delivering.Unlock()
+		o.number(txn)
+		o.deliver(txn)
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+	// the pump numbers the queued transactions, the one passed in may be read by the caller meanwhile
+	queued := *txn
+	txn = &queued
+	if o.policy == OverflowCoalesce {
+		for i := len(o.queue) - 1; i >= 0; i-- {
+			if o.queue[i].UUID != txn.UUID {
+				continue
+			}
+			if merged := coalesce(o.queue[i], txn); merged != nil {
+				o.queue[i] = merged
+				return
+			}
+			break
+		}
+	}
+	if len(o.queue) >= o.limit {
+		atomic.AddInt64(&o.overflows, 1)
+		o.overflowed = true
+		if o.policy == OverflowDropNewest {
+			return
+		}
+		o.queue = o.queue[1:]
+	}
+	o.queue = append(o.queue, txn)
+	o.cond.Signal()
+}
+
+func (o *outbox) sendError(err error) {
+	o.sending.RLock()
+	defer o.sending.RUnlock()
+	if o.isClosed() {
+		return
+	}
+	if o.policy == OverflowBlock {
+		o.errs <- err
+		return
+	}
+	select {
+	case o.errs <- err:
+		return
+	default:
+	}
+	atomic.AddInt64(&o.overflows, 1)
+	if o.policy == OverflowDropNewest {
+		return
+	}
+	select {
+	case <-o.errs:
+	default:
+	}
+	select {
+	case o.errs <- err:
+	default:
+		atomic.AddInt64(&o.overflows, 1)
+	}
+}
+
+// pump passes the queued transactions to deliver one at a time, an overflow marker goes first when transactions were
+// dropped since the last one.
+func (o *outbox) pump() {
+	defer close(o.done)
+	for {
+		o.mu.Lock()
+		for len(o.queue) == 0 && !o.closed {
+			o.cond.Wait()
+		}
+		if len(o.queue) == 0 {
+			o.mu.Unlock()
+			return
+		}
+		var txn *EventTransaction
+		if o.overflowed {
+			o.overflowed = false
+			o.mu.Unlock()
+			txn = o.marker()
+		} else {
+			txn = o.queue[0]
+			o.queue = o.queue[1:]
+			o.mu.Unlock()
+		}
+		o.number(txn)
+		o.deliver(txn)
+	}
+}
+
+// marker returns the overflow transaction of the current root, which changes with Restore.
+func (o *outbox) marker() *EventTransaction {
+	o.treeMu.Lock()
+	defer o.treeMu.Unlock()
+	marker := markerTransaction(event.Overflow, o.tree())
+	return &marker
+}
+
+// number sets the Seq of the next transaction delivered.
+func (o *outbox) number(txn *EventTransaction) {
+	o.seq++
+	txn.Seq = o.seq
+}
+
+// close stops taking transactions and errors and waits for the queued and the in flight ones to be delivered, the
+// channels can be closed afterwards.
+func (o *outbox) close() {
+	o.mu.Lock()
+	o.closed = true
+	o.mu.Unlock()
+	o.cond.Broadcast()
+	<-o.done
+	o.sending.Lock()
+	defer o.sending.Unlock()
+}
+
+// coalesce merges txn into the queued transaction of the same node, it returns nil when they can't be merged. Only
+// the transactions that update the metadata of a node merge, moving the others would reorder the tree. A node created
+// since the consumer last heard of it stays a Create, updates of different kinds become a Write. The chunk diff of a
+// merged transaction would miss the changes in between, so it is dropped. PrevSum stays the sum the consumer last
+// heard of, the one before the queued transaction.
+func coalesce(queued *EventTransaction, txn *EventTransaction) *EventTransaction {
+	if !isUpdate(txn.Type) || (queued.Type != event.Create && !isUpdate(queued.Type)) {
+		return nil
+	}
+	merged := *txn
+	merged.ChunkDiff = nil
+	switch queued.Type {
+	case event.Write:
+		merged.PrevSum = queued.PrevSum
+	case event.Chmod:
+		merged.PrevSum = queued.Meta.Sum
+	default:
+		// nothing was sent with a sum before a Create or a deferred sum
+		merged.PrevSum = ""
+	}
+	switch {
+	case queued.Type == event.Create:
+		merged.Type = event.Create
+	case queued.Type != txn.Type:
+		merged.Type = event.Write
+	case txn.Type == event.Chmod:
+		merged.OldMode = queued.OldMode
+	}
+	return &merged
+}
+
+func isUpdate(t event.Type) bool {
+	return t == event.Write || t == event.Chmod || t == event.SumUpdated
+}
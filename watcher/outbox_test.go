@@ -0,0 +1,129 @@
+package watcher
+
+import (
+	"errors"
+	"github.com/ayhanozemre/fs-shadow/event"
+	"github.com/ayhanozemre/fs-shadow/filenode"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+// queueTxns fills an outbox whose queue holds two transactions before its pump runs, then returns what it delivers.
+func queueTxns(policy OverflowPolicy, txns ...*EventTransaction) ([]*EventTransaction, int64) {
+	out := make(chan *EventTransaction, len(txns)+1)
+	o := &outbox{
+		policy:  policy,
+		limit:   2,
+		deliver: func(txn *EventTransaction) { out <- txn },
+		treeMu:  &sync.Mutex{},
+		tree:    func() *filenode.FileNode { return &filenode.FileNode{UUID: "root"} },
+		done:    make(chan struct{}),
+	}
+	o.cond = sync.NewCond(&o.mu)
+	for _, txn := range txns {
+		o.send(txn)
+	}
+	go o.pump()
+	o.close()
+	close(out)
+	var delivered []*EventTransaction
+	for txn := range out {
+		delivered = append(delivered, txn)
+	}
+	return delivered, o.Overflows()
+}
+
+func txnTypes(txns []*EventTransaction) []string {
+	var types []string
+	for _, txn := range txns {
+		types = append(types, string(txn.Type)+":"+txn.UUID)
+	}
+	return types
+}
+
+func Test_OutboxPolicies(t *testing.T) {
+	a := &EventTransaction{Type: event.Create, UUID: "a"}
+	b := &EventTransaction{Type: event.Create, UUID: "b"}
+	c := &EventTransaction{Type: event.Create, UUID: "c"}
+
+	delivered, overflows := queueTxns(OverflowDropNewest, a, b, c)
+	assert.Equal(t, []string{"overflow:root", "create:a", "create:b"}, txnTypes(delivered), "drop newest")
+	assert.Equal(t, int64(1), overflows, "invalid overflow count")
+	for i, txn := range delivered {
+		assert.Equal(t, uint64(i+1), txn.Seq, "invalid sequence number")
+	}
+	assert.Equal(t, uint64(0), a.Seq, "queued transaction changed")
+
+	delivered, overflows = queueTxns(OverflowDropOldest, a, b, c)
+	assert.Equal(t, []string{"overflow:root", "create:b", "create:c"}, txnTypes(delivered), "drop oldest")
+	assert.Equal(t, int64(1), overflows, "invalid overflow count")
+
+	write := &EventTransaction{Type: event.Write, UUID: "a", Meta: filenode.MetaData{Sum: "new"}}
+	chmod := &EventTransaction{Type: event.Chmod, UUID: "b"}
+	rename := &EventTransaction{Type: event.Rename, UUID: "b"}
+	delivered, overflows = queueTxns(OverflowCoalesce, a, write, chmod, write)
+	assert.Equal(t, []string{"create:a", "chmod:b"}, txnTypes(delivered), "coalesce")
+	assert.Equal(t, "new", delivered[0].Meta.Sum, "create not updated")
+	assert.Equal(t, int64(0), overflows, "invalid overflow count")
+
+	delivered, overflows = queueTxns(OverflowCoalesce, chmod, &EventTransaction{Type: event.Write, UUID: "b"}, rename, c)
+	assert.Equal(t, []string{"overflow:root", "rename:b", "create:c"}, txnTypes(delivered), "coalesce overflow")
+	assert.Equal(t, int64(1), overflows, "invalid overflow count")
+
+	first := &EventTransaction{Type: event.Write, UUID: "w", PrevSum: "v1", Meta: filenode.MetaData{Sum: "v2"}}
+	second := &EventTransaction{Type: event.Write, UUID: "w", PrevSum: "v2", Meta: filenode.MetaData{Sum: "v3"}}
+	delivered, _ = queueTxns(OverflowCoalesce, first, second)
+	assert.Equal(t, []string{"write:w"}, txnTypes(delivered), "writes not coalesced")
+	assert.Equal(t, "v1", delivered[0].PrevSum, "previous sum of the newer write kept")
+	assert.Equal(t, "v3", delivered[0].Meta.Sum, "sum of the older write kept")
+	attrs := &EventTransaction{Type: event.Chmod, UUID: "m", Meta: filenode.MetaData{Sum: "v1"}}
+	delivered, _ = queueTxns(OverflowCoalesce, attrs, &EventTransaction{Type: event.Write, UUID: "m", PrevSum: "v1",
+		Meta: filenode.MetaData{Sum: "v2"}})
+	assert.Equal(t, "v1", delivered[0].PrevSum, "invalid previous sum after a chmod")
+
+	delivered, _ = queueTxns(OverflowBlock, a, b, c)
+	assert.Equal(t, 3, len(delivered), "block dropped transactions")
+	assert.Equal(t, uint64(3), delivered[2].Seq, "invalid sequence number")
+}
+
+func Test_OutboxErrors(t *testing.T) {
+	first, second := errors.New("first"), errors.New("second")
+	for policy, expected := range map[OverflowPolicy]error{OverflowDropNewest: first, OverflowDropOldest: second} {
+		errs := make(chan error, 1)
+		tree := func() *filenode.FileNode { return &filenode.FileNode{} }
+		o := newOutbox(policy, 1, &sync.Mutex{}, tree, func(*EventTransaction) {}, errs)
+		o.sendError(first)
+		o.sendError(second)
+		assert.Equal(t, expected, <-errs, "invalid error kept")
+		assert.Equal(t, int64(1), o.Overflows(), "invalid overflow count")
+		o.close()
+	}
+}
+
+func Test_OutboxMarkerRoot(t *testing.T) {
+	var mu sync.Mutex
+	root := &filenode.FileNode{Name: "old", UUID: "old"}
+	out := make(chan *EventTransaction, 4)
+	o := &outbox{
+		policy:  OverflowDropNewest,
+		limit:   1,
+		deliver: func(txn *EventTransaction) { out <- txn },
+		treeMu:  &mu,
+		tree:    func() *filenode.FileNode { return root },
+		done:    make(chan struct{}),
+	}
+	o.cond = sync.NewCond(&o.mu)
+	o.send(&EventTransaction{Type: event.Create})
+	o.send(&EventTransaction{Type: event.Write})
+	// the tree is replaced, like Restore does, before the marker is delivered
+	mu.Lock()
+	root = &filenode.FileNode{Name: "restored", UUID: "restored"}
+	mu.Unlock()
+	go o.pump()
+	o.close()
+	close(out)
+	marker := <-out
+	assert.Equal(t, event.Overflow, marker.Type, "overflow marker not first")
+	assert.Equal(t, "restored", marker.UUID, "marker of the old root")
+}
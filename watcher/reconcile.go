@@ -0,0 +1,335 @@
+package watcher
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/ayhanozemre/fs-shadow/event"
+	"github.com/ayhanozemre/fs-shadow/filenode"
+	"github.com/ayhanozemre/fs-shadow/utils"
+	"github.com/vmihailenco/msgpack/v5"
+	"io"
+	"path/filepath"
+	"sort"
+)
+
+/*
+	Anti-entropy between a leader tree and a follower tree that missed some transactions.
+	The follower asks the leader for the folders it needs, starting from the root. Every reply carries the subtree
+	sums (see utils.MerkleSum) of the subs of the folder, so the follower only descends into the folders whose sums
+	differ from its own. When there is nothing left to compare the follower ends the session and returns the
+	transactions that bring its tree in line with the leader.
+	Neither tree may change during a session.
+*/
+
+type reconcileRequest struct {
+	Path string
+	Done bool
+}
+
+type reconcileNode struct {
+	Name       string
+	UUID       string
+	ParentUUID string
+	TreeSum    string
+	Meta       filenode.MetaData
+}
+
+type reconcileReply struct {
+	Found bool
+	Node  reconcileNode
+	Subs  []reconcileNode
+}
+
+// treeSums computes the subtree sum of every node. A node hashes its synced metadata under an empty name, which no sub
+// can have, together with the names and subtree sums of its subs, so a metadata change reaches the root like a new sum.
+func treeSums(root *filenode.FileNode) map[*filenode.FileNode]string {
+	sums := make(map[*filenode.FileNode]string)
+	var walk func(node *filenode.FileNode) string
+	walk = func(node *filenode.FileNode) string {
+		entries := []utils.SumEntry{{Sum: fmt.Sprintf("%#v", newSyncedMeta(node.Meta))}}
+		for _, sub := range node.Subs {
+			entries = append(entries, utils.SumEntry{Name: sub.Name, Sum: walk(sub)})
+		}
+		sum := utils.MerkleSum(entries)
+		sums[node] = sum
+		return sum
+	}
+	walk(root)
+	return sums
+}
+
+func newReconcileNode(node *filenode.FileNode, sums map[*filenode.FileNode]string) reconcileNode {
+	return reconcileNode{
+		Name:       node.Name,
+		UUID:       node.UUID,
+		ParentUUID: node.ParentUUID,
+		TreeSum:    sums[node],
+		Meta:       node.Meta,
+	}
+}
+
+// reconcileConn writes every message with a single Write, some transports (net.Pipe) block on empty writes.
+type reconcileConn struct {
+	w   *bufio.Writer
+	enc *msgpack.Encoder
+	dec *msgpack.Decoder
+}
+
+func newReconcileConn(rw io.ReadWriter) *reconcileConn {
+	w := bufio.NewWriter(rw)
+	return &reconcileConn{w: w, enc: msgpack.NewEncoder(w), dec: msgpack.NewDecoder(rw)}
+}
+
+func (c *reconcileConn) send(v interface{}) error {
+	if err := c.enc.Encode(v); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *reconcileConn) receive(v interface{}) error {
+	return c.dec.Decode(v)
+}
+
+// ServeReconcile answers the requests of a follower until it ends the session.
+func ServeReconcile(rw io.ReadWriter, tree *filenode.FileNode) error {
+	sums := treeSums(tree)
+	conn := newReconcileConn(rw)
+	for {
+		var req reconcileRequest
+		if err := conn.receive(&req); err != nil {
+			return err
+		}
+		if req.Done {
+			return nil
+		}
+
+		var reply reconcileReply
+		if node := tree.Search(filepath.Join(tree.Name, req.Path)); node != nil {
+			reply.Found = true
+			reply.Node = newReconcileNode(node, sums)
+			for _, sub := range node.Subs {
+				reply.Subs = append(reply.Subs, newReconcileNode(sub, sums))
+			}
+			sort.Slice(reply.Subs, func(i, j int) bool { return reply.Subs[i].Name < reply.Subs[j].Name })
+		}
+		if err := conn.send(&reply); err != nil {
+			return err
+		}
+	}
+}
+
+type reconciler struct {
+	tree *filenode.FileNode
+	sums map[*filenode.FileNode]string
+	conn *reconcileConn
+
+	txns    []*EventTransaction
+	removes []*EventTransaction
+	// claimed holds the follower nodes that have a place in the leader tree.
+	claimed map[*filenode.FileNode]bool
+	// parked holds the temporary names of the follower nodes that had to give up their names, see park.
+	parked map[*filenode.FileNode]string
+	temp   int
+}
+
+type reconcileStep struct {
+	path  string
+	local *filenode.FileNode
+}
+
+// Reconcile compares the follower tree with the leader on the other end of rw and returns the transactions that
+// make the follower tree equal to the leader tree. The transactions can be replayed with ApplyTransaction.
+func Reconcile(rw io.ReadWriter, tree *filenode.FileNode) ([]*EventTransaction, error) {
+	r := reconciler{
+		tree:    tree,
+		sums:    treeSums(tree),
+		conn:    newReconcileConn(rw),
+		claimed: make(map[*filenode.FileNode]bool),
+		parked:  make(map[*filenode.FileNode]string),
+	}
+	r.claimed[tree] = true
+
+	queue := []reconcileStep{{path: "", local: tree}}
+	for len(queue) > 0 {
+		step := queue[0]
+		queue = queue[1:]
+		next, err := r.compare(step)
+		if err != nil {
+			return nil, err
+		}
+		queue = append(queue, next...)
+	}
+	if err := r.conn.send(&reconcileRequest{Done: true}); err != nil {
+		return nil, err
+	}
+
+	for _, txn := range r.removes {
+		if node := tree.SearchByUUID(txn.UUID); node == nil || !r.claimed[node] {
+			r.txns = append(r.txns, txn)
+		}
+	}
+	return r.txns, nil
+}
+
+func (r *reconciler) request(path string) (*reconcileReply, error) {
+	if err := r.conn.send(&reconcileRequest{Path: path}); err != nil {
+		return nil, err
+	}
+	var reply reconcileReply
+	if err := r.conn.receive(&reply); err != nil {
+		return nil, err
+	}
+	if !reply.Found {
+		return nil, &filenode.OpError{Op: "reconcile", Path: path, Err: filenode.ErrNotFound}
+	}
+	return &reply, nil
+}
+
+func (r *reconciler) add(t event.Type, node reconcileNode) {
+	r.txns = append(r.txns, &EventTransaction{
+		Type:       t,
+		Name:       node.Name,
+		UUID:       node.UUID,
+		ParentUUID: node.ParentUUID,
+		Meta:       node.Meta,
+	})
+}
+
+// syncedMeta holds the metadata fields that events change. The sums of folders are compared as subtree sums, access and
+// change times and the inode, device and link count of the file never produce events by themselves.
+type syncedMeta struct {
+	IsDir      bool
+	Sum        string
+	SumAlgo    string
+	WeakSum    bool
+	SumPending bool
+	Size       int64
+	CreatedAt  int64
+	ModifiedAt int64
+	BornAt     int64
+	Permission string
+	Mode       filenode.FileMode
+	Type       filenode.NodeType
+	LinkTarget string
+	Uid        uint32
+	Gid        uint32
+	User       string
+	Group      string
+}
+
+func newSyncedMeta(m filenode.MetaData) syncedMeta {
+	synced := syncedMeta{
+		IsDir:      m.IsDir,
+		Size:       m.Size,
+		CreatedAt:  m.CreatedAt,
+		ModifiedAt: m.ModifiedAt,
+		BornAt:     m.BornAt,
+		Permission: m.Permission,
+		Mode:       m.FileMode(),
+		Type:       m.Type,
+		LinkTarget: m.LinkTarget,
+		Uid:        m.Uid,
+		Gid:        m.Gid,
+		User:       m.User,
+		Group:      m.Group,
+	}
+	if !m.IsDir {
+		synced.Sum, synced.SumAlgo, synced.WeakSum, synced.SumPending = m.Sum, m.SumAlgo, m.WeakSum, m.SumPending
+	}
+	return synced
+}
+
+// metaChanged compares the synced metadata of two nodes.
+func metaChanged(local, leader filenode.MetaData) bool {
+	return newSyncedMeta(local) != newSyncedMeta(leader)
+}
+
+// park renames a follower node that holds the name a leader node needs to a temporary one. The node may still have a
+// place further down the leader tree, which is only known once the follower gets there, so it is removed at the end of
+// the session only when it never got one.
+func (r *reconciler) park(folder *filenode.FileNode, node *filenode.FileNode) {
+	var tempName string
+	for tempName == "" || folder.Search(filepath.Join(folder.Name, tempName)) != nil {
+		r.temp++
+		tempName = fmt.Sprintf(".%s.fs-shadow-%d", node.Name, r.temp)
+	}
+	txn := makeEventTransaction(*node, event.Rename)
+	txn.Name = tempName
+	r.txns = append(r.txns, txn)
+	r.parked[node] = tempName
+}
+
+func (r *reconciler) remove(node *filenode.FileNode) *EventTransaction {
+	return makeEventTransaction(*node, event.Remove)
+}
+
+// compare matches the subs of a leader folder with the subs of the follower folder and returns the folders to descend.
+func (r *reconciler) compare(step reconcileStep) ([]reconcileStep, error) {
+	reply, err := r.request(step.path)
+	if err != nil {
+		return nil, err
+	}
+	local := step.local
+	if step.path == "" {
+		// the tree sums leave out the name of the root
+		if local.Name != reply.Node.Name {
+			r.add(event.Rename, reply.Node)
+		}
+		if metaChanged(local.Meta, reply.Node.Meta) {
+			r.add(event.Write, reply.Node)
+		}
+		if r.sums[local] == reply.Node.TreeSum {
+			return nil, nil
+		}
+	}
+
+	var next []reconcileStep
+	seen := make(map[*filenode.FileNode]bool)
+	for _, sub := range reply.Subs {
+		subPath := filepath.Join(step.path, sub.Name)
+		current := r.tree.SearchByUUID(sub.UUID)
+		if current != nil && current.Meta.IsDir != sub.Meta.IsDir {
+			current = nil
+		}
+		if local != nil {
+			occupant := local.Search(filepath.Join(local.Name, sub.Name))
+			if occupant != nil && occupant != current && !seen[occupant] && r.parked[occupant] == "" {
+				// same name but a different node, it has to make room before the leader's node takes its place
+				r.park(local, occupant)
+			}
+		}
+
+		if current == nil {
+			r.add(event.Create, sub)
+			if sub.Meta.IsDir {
+				next = append(next, reconcileStep{path: subPath})
+			}
+			continue
+		}
+		if local == nil || current.ParentUUID != local.UUID {
+			r.add(event.Move, sub)
+		}
+		if name, ok := r.parked[current]; ok && name != sub.Name || !ok && current.Name != sub.Name {
+			r.add(event.Rename, sub)
+		}
+		r.claimed[current] = true
+		seen[current] = true
+
+		if metaChanged(current.Meta, sub.Meta) {
+			r.add(event.Write, sub)
+		}
+		if sub.Meta.IsDir && r.sums[current] != sub.TreeSum {
+			next = append(next, reconcileStep{path: subPath, local: current})
+		}
+	}
+
+	if local != nil {
+		for _, sub := range local.Subs {
+			if !seen[sub] {
+				r.removes = append(r.removes, r.remove(sub))
+			}
+		}
+	}
+	return next, nil
+}
@@ -0,0 +1,144 @@
+package watcher
+
+import (
+	"github.com/ayhanozemre/fs-shadow/filenode"
+	connector "github.com/ayhanozemre/fs-shadow/path"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func makeReplicaTree() *filenode.FileNode {
+	root := &filenode.FileNode{Name: "root", UUID: "r", Meta: filenode.MetaData{IsDir: true}}
+	nodes := []struct {
+		parent string
+		node   *filenode.FileNode
+	}{
+		{"r", &filenode.FileNode{Name: "docs", UUID: "docs", Meta: filenode.MetaData{IsDir: true}}},
+		{"docs", &filenode.FileNode{Name: "a.txt", UUID: "a", Meta: filenode.MetaData{Sum: "sum-a"}}},
+		{"docs", &filenode.FileNode{Name: "b.txt", UUID: "b", Meta: filenode.MetaData{Sum: "sum-b"}}},
+		{"r", &filenode.FileNode{Name: "src", UUID: "src", Meta: filenode.MetaData{IsDir: true}}},
+		{"src", &filenode.FileNode{Name: "main.go", UUID: "main", Meta: filenode.MetaData{Sum: "sum-main"}}},
+		{"src", &filenode.FileNode{Name: "lib", UUID: "lib", Meta: filenode.MetaData{IsDir: true}}},
+		{"lib", &filenode.FileNode{Name: "lib.go", UUID: "lib-go", Meta: filenode.MetaData{Sum: "sum-lib"}}},
+		{"r", &filenode.FileNode{Name: "readme.md", UUID: "readme", Meta: filenode.MetaData{Sum: "sum-readme"}}},
+	}
+	for _, n := range nodes {
+		_ = root.SearchByUUID(n.parent).AddSub(n.node)
+	}
+	return root
+}
+
+func reconcileTrees(t *testing.T, leader, follower *filenode.FileNode) []*EventTransaction {
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan error)
+	go func() {
+		done <- ServeReconcile(server, leader)
+		_ = server.Close()
+	}()
+	txns, err := Reconcile(client, follower)
+	assert.Equal(t, nil, err, "reconcile error")
+	assert.Equal(t, nil, <-done, "serve reconcile error")
+	return txns
+}
+
+func Test_ReconcileEqualTrees(t *testing.T) {
+	txns := reconcileTrees(t, makeReplicaTree(), makeReplicaTree())
+	assert.Equal(t, 0, len(txns), "equal trees produced transactions")
+}
+
+func Test_Reconcile(t *testing.T) {
+	leader := makeReplicaTree()
+	follower := makeReplicaTree()
+
+	// changes the follower missed
+	_, _ = leader.Remove(connector.NewVirtualPath("root/docs/b.txt", false))
+	_, _ = leader.Rename(connector.NewVirtualPath("root/docs/a.txt", false), connector.NewVirtualPath("root/docs/a-2.txt", false))
+	_, _ = leader.Move(connector.NewVirtualPath("root/src/lib", true), connector.NewVirtualPath("root/docs", true))
+	leader.SearchByUUID("main").SetMeta(filenode.MetaData{Sum: "sum-main-2", Size: 10})
+	_ = leader.SearchByUUID("r").AddSub(&filenode.FileNode{Name: "new", UUID: "new", Meta: filenode.MetaData{IsDir: true}})
+	_ = leader.SearchByUUID("new").AddSub(&filenode.FileNode{Name: "new.txt", UUID: "new-txt", Meta: filenode.MetaData{Sum: "sum-new"}})
+	_ = leader.SearchByUUID("new").AddSub(&filenode.FileNode{Name: "readme.md", UUID: "readme-2", Meta: filenode.MetaData{Sum: "sum-readme"}})
+
+	txns := reconcileTrees(t, leader, follower)
+	assert.NotEqual(t, 0, len(txns), "no transactions produced")
+	for _, txn := range txns {
+		err := ApplyTransaction(follower, txn)
+		assert.Equal(t, nil, err, "apply transaction error: %s %s", txn.Type, txn.Name)
+	}
+
+	assert.Equal(t, treeSums(leader)[leader], treeSums(follower)[follower], "trees are not in line")
+	assert.Equal(t, "root/docs/lib/lib.go", follower.SearchByUUID("lib-go").Path(), "moved folder is misplaced")
+	assert.Nil(t, follower.SearchByUUID("b"), "removed node still exists")
+	assert.Equal(t, int64(10), follower.SearchByUUID("main").Meta.Size, "write not applied")
+	assert.Equal(t, 0, len(reconcileTrees(t, leader, follower)), "second round produced transactions")
+}
+
+func Test_ReconcileRoot(t *testing.T) {
+	leader := makeReplicaTree()
+	follower := makeReplicaTree()
+
+	_, _ = leader.RenameByUUID("r", "root-2")
+	leader.SetMeta(filenode.MetaData{IsDir: true, Permission: "drwx------"})
+	// fields that change without an event
+	meta := leader.SearchByUUID("a").Meta
+	meta.AccessedAt, meta.Inode, meta.Nlink = 10, 20, 2
+	leader.SearchByUUID("a").SetMeta(meta)
+
+	txns := reconcileTrees(t, leader, follower)
+	assert.Equal(t, 2, len(txns), "invalid number of transactions")
+	for _, txn := range txns {
+		assert.Equal(t, "r", txn.UUID, "transaction for a node that didn't change: %s %s", txn.Type, txn.Name)
+		err := ApplyTransaction(follower, txn)
+		assert.Equal(t, nil, err, "apply transaction error: %s %s", txn.Type, txn.Name)
+	}
+	assert.Equal(t, "root-2", follower.Name, "root not renamed")
+	assert.Equal(t, "drwx------", follower.Meta.Permission, "root metadata not written")
+	assert.Equal(t, 0, len(reconcileTrees(t, leader, follower)), "second round produced transactions")
+}
+
+func Test_ReconcileNestedMeta(t *testing.T) {
+	leader := makeReplicaTree()
+	follower := makeReplicaTree()
+
+	// the sum stays the same, only the metadata tells
+	meta := leader.SearchByUUID("lib-go").Meta
+	meta.Permission = "-rwx------"
+	leader.SearchByUUID("lib-go").SetMeta(meta)
+
+	txns := reconcileTrees(t, leader, follower)
+	assert.Equal(t, 1, len(txns), "invalid number of transactions")
+	for _, txn := range txns {
+		assert.Equal(t, "lib-go", txn.UUID, "transaction for a node that didn't change: %s %s", txn.Type, txn.Name)
+		err := ApplyTransaction(follower, txn)
+		assert.Equal(t, nil, err, "apply transaction error: %s %s", txn.Type, txn.Name)
+	}
+	assert.Equal(t, "-rwx------", follower.SearchByUUID("lib-go").Meta.Permission, "permission not written")
+	assert.Equal(t, 0, len(reconcileTrees(t, leader, follower)), "second round produced transactions")
+}
+
+func Test_ReconcileMovedAndReplaced(t *testing.T) {
+	leader := makeReplicaTree()
+	follower := makeReplicaTree()
+
+	// a.txt moves into a new folder and a new file takes its name
+	_ = leader.SearchByUUID("docs").AddSub(&filenode.FileNode{Name: "inner", UUID: "inner", Meta: filenode.MetaData{IsDir: true}})
+	_, _ = leader.MoveByUUID("a", "inner")
+	_ = leader.SearchByUUID("docs").AddSub(&filenode.FileNode{Name: "a.txt", UUID: "a-2", Meta: filenode.MetaData{Sum: "sum-a-2"}})
+	// and a sibling takes the name of another one that goes away
+	_, _ = leader.RemoveByUUID("main", "src")
+	_, _ = leader.RenameByUUID("lib", "main.go")
+
+	txns := reconcileTrees(t, leader, follower)
+	for _, txn := range txns {
+		err := ApplyTransaction(follower, txn)
+		assert.Equal(t, nil, err, "apply transaction error: %s %s", txn.Type, txn.Name)
+	}
+	assert.Equal(t, "root/docs/inner/a.txt", follower.SearchByUUID("a").Path(), "moved file is misplaced")
+	assert.Equal(t, "root/docs/a.txt", follower.SearchByUUID("a-2").Path(), "new file is misplaced")
+	assert.Equal(t, "root/src/main.go", follower.SearchByUUID("lib").Path(), "renamed folder is misplaced")
+	assert.Nil(t, follower.SearchByUUID("main"), "removed node still exists")
+	assert.Equal(t, treeSums(leader)[leader], treeSums(follower)[follower], "trees are not in line")
+	assert.Equal(t, 0, len(reconcileTrees(t, leader, follower)), "second round produced transactions")
+}
@@ -8,7 +8,6 @@ import (
 func CreateFileNodeWithTransactions(tbl [][]byte) (*filenode.FileNode, error) {
 	var err error
 	var root *filenode.FileNode
-	uuidTable := make(map[string]*filenode.FileNode)
 	for i := 0; i < len(tbl); i++ {
 		txn := EventTransaction{}
 		err = txn.Decode(tbl[i])
@@ -16,36 +15,57 @@ func CreateFileNodeWithTransactions(tbl [][]byte) (*filenode.FileNode, error) {
 			return nil, err
 		}
 
-		node := txn.toFileNode()
-		if node.ParentUUID == "" {
-			root = node
+		if txn.ParentUUID == "" && txn.Type == event.Create {
+			root = txn.toFileNode()
+			root.Reindex()
+			continue
 		}
-
-		switch txn.Type {
-		case event.Create:
-			uuidTable[node.UUID] = node
-			if parent, ok := uuidTable[node.ParentUUID]; ok {
-				parent.Subs = append(parent.Subs, node)
-			}
-		case event.Rename:
-			currentNode := uuidTable[node.UUID]
-			currentNode.Name = node.Name
-			currentNode.Meta = node.Meta
-		case event.Move:
-			currentNode := uuidTable[node.UUID]
-			_, _ = root.RemoveByUUID(currentNode.UUID, currentNode.ParentUUID)
-			if parent, ok := uuidTable[node.ParentUUID]; ok {
-				currentNode.ParentUUID = node.ParentUUID
-				parent.Subs = append(parent.Subs, currentNode)
-			}
-		case event.Remove:
-			delete(uuidTable, node.UUID)
-			_, _ = root.RemoveByUUID(node.UUID, node.ParentUUID)
+		if root == nil {
+			continue
 		}
+		_ = ApplyTransaction(root, &txn)
 	}
 	return root, nil
 }
 
+// ApplyTransaction replays a single transaction on the tree, nodes are looked up by their uuids.
+func ApplyTransaction(root *filenode.FileNode, txn *EventTransaction) error {
+	node := txn.toFileNode()
+	switch txn.Type {
+	case event.Create:
+		parent := root.SearchByUUID(node.ParentUUID)
+		if parent == nil {
+			return &filenode.OpError{Op: string(txn.Type), UUID: node.ParentUUID, Err: filenode.ErrNotFound}
+		}
+		return parent.AddSub(node)
+	case event.Rename:
+		currentNode, err := root.RenameByUUID(node.UUID, node.Name)
+		if err != nil {
+			return err
+		}
+		currentNode.SetMeta(node.Meta)
+	case event.Move:
+		_, err := root.MoveByUUID(node.UUID, node.ParentUUID)
+		return err
+	case event.Write, event.Chmod, event.SumUpdated:
+		currentNode := root.SearchByUUID(node.UUID)
+		if currentNode == nil {
+			return &filenode.OpError{Op: string(txn.Type), UUID: node.UUID, Err: filenode.ErrNotFound}
+		}
+		currentNode.SetMeta(node.Meta).SetChunks(node.Chunks)
+	case event.Remove:
+		currentNode := root.SearchByUUID(node.UUID)
+		if currentNode == nil {
+			return &filenode.OpError{Op: string(txn.Type), UUID: node.UUID, Err: filenode.ErrNotFound}
+		}
+		_, err := root.RemoveByUUID(currentNode.UUID, currentNode.ParentUUID)
+		return err
+	case event.Overflow, event.ScanComplete:
+		// markers carry no change
+	}
+	return nil
+}
+
 func RestoreWatcherWithTransactions(tbl [][]byte, tw Watcher) error {
 	tree, err := CreateFileNodeWithTransactions(tbl)
 	if err != nil {
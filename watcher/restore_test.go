@@ -5,7 +5,9 @@ import (
 	"github.com/ayhanozemre/fs-shadow/filenode"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
 	"testing"
+	"time"
 )
 
 func generateTransactionBytes() [][]byte {
@@ -48,3 +50,77 @@ func Test_RestoreWatcherWithTransactions(t *testing.T) {
 	assert.Equal(t, "test-1", tw.FileTree.Name, "tree name is wrong")
 	assert.Equal(t, "s-test-1", tw.FileTree.Subs[0].Name, "first sub node name is wrong")
 }
+
+func Test_CreateFileNodeWithTransactionMoveAndRemove(t *testing.T) {
+	ets := []EventTransaction{
+		{Name: "root", UUID: "r1", Type: event.Create},
+		{Name: "a", UUID: "a1", ParentUUID: "r1", Type: event.Create},
+		{Name: "b", UUID: "b1", ParentUUID: "r1", Type: event.Create},
+		{Name: "c", UUID: "c1", ParentUUID: "b1", Type: event.Create},
+		{Name: "c", UUID: "c1", ParentUUID: "a1", Type: event.Move},
+		{Name: "b", UUID: "b1", ParentUUID: "r1", Type: event.Remove},
+	}
+	var tbl [][]byte
+	for i := 0; i < len(ets); i++ {
+		b, _ := ets[i].Encode()
+		tbl = append(tbl, b)
+	}
+
+	tree, err := CreateFileNodeWithTransactions(tbl)
+	assert.Equal(t, nil, err, "tree creation error")
+	assert.Equal(t, 1, len(tree.Subs), "removed node still exists")
+	assert.NotNil(t, tree.Search("root/a/c"), "moved node not found")
+	assert.Equal(t, "root/a/c", tree.SearchByUUID("c1").Path(), "moved node path is wrong")
+}
+
+func Test_CreateFileNodeWithTransactionSumUpdated(t *testing.T) {
+	ets := []EventTransaction{
+		{Name: "root", UUID: "r1", Type: event.Create},
+		{Name: "a", UUID: "a1", ParentUUID: "r1", Type: event.Create, Meta: filenode.MetaData{SumPending: true}},
+		{Name: "a", UUID: "a1", ParentUUID: "r1", Type: event.SumUpdated, Meta: filenode.MetaData{Sum: "sum"}},
+	}
+	var tbl [][]byte
+	for i := 0; i < len(ets); i++ {
+		b, _ := ets[i].Encode()
+		tbl = append(tbl, b)
+	}
+
+	tree, err := CreateFileNodeWithTransactions(tbl)
+	assert.Equal(t, nil, err, "tree creation error")
+	node := tree.SearchByUUID("a1")
+	assert.Equal(t, "sum", node.Meta.Sum, "sum not updated")
+	assert.False(t, node.Meta.SumPending, "sum still pending")
+}
+
+func Test_TransactionVersions(t *testing.T) {
+	// the fields of the records encoded before the versions were introduced
+	legacy := struct {
+		Name       string
+		Type       event.Type
+		UUID       string
+		ParentUUID string
+		Meta       filenode.MetaData
+	}{Name: "legacy", Type: event.Rename, UUID: "l1", ParentUUID: "r1", Meta: filenode.MetaData{Sum: "sum"}}
+	b, _ := msgpack.Marshal(&legacy)
+	var txn EventTransaction
+	assert.Equal(t, nil, txn.Decode(b), "legacy transaction decode error")
+	assert.Equal(t, "legacy", txn.Name, "invalid legacy name")
+	assert.Equal(t, "r1", txn.ParentUUID, "invalid legacy parent")
+	assert.Equal(t, "sum", txn.Meta.Sum, "invalid legacy sum")
+	assert.Equal(t, 0, txn.Version, "legacy transaction has a version")
+
+	current := EventTransaction{Name: "current", Type: event.Move, UUID: "c1", Path: "root/a/current",
+		OldPath: "root/current", OldParentUUID: "r1", PrevSum: "old", Seq: 7, Time: time.Unix(1700000000, 0)}
+	b, _ = current.Encode()
+	txn = EventTransaction{}
+	assert.Equal(t, nil, txn.Decode(b), "transaction decode error")
+	assert.Equal(t, TransactionVersion, txn.Version, "version not encoded")
+	txn.Version = 0
+	assert.True(t, current.Time.Equal(txn.Time), "invalid time")
+	txn.Time = current.Time
+	assert.Equal(t, current, txn, "transaction changed in encoding")
+
+	current.Version = TransactionVersion + 1
+	b, _ = current.Encode()
+	assert.Equal(t, ErrTransactionVersion, txn.Decode(b), "newer version decoded")
+}
@@ -0,0 +1,130 @@
+package watcher
+
+import (
+	"github.com/ayhanozemre/fs-shadow/event"
+	"github.com/ayhanozemre/fs-shadow/filenode"
+	connector "github.com/ayhanozemre/fs-shadow/path"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// sumQueue holds the uuids of the nodes whose sums were deferred, see filenode.Options.DeferSums. The methods are
+// safe to call on a nil queue, which holds nothing.
+type sumQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	uuids  []string
+	closed bool
+}
+
+func newSumQueue() *sumQueue {
+	q := sumQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return &q
+}
+
+func (q *sumQueue) push(uuids ...string) {
+	if q == nil || len(uuids) == 0 {
+		return
+	}
+	q.mu.Lock()
+	q.uuids = append(q.uuids, uuids...)
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// pop waits for a uuid, it returns false once the queue is closed.
+func (q *sumQueue) pop() (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.uuids) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return "", false
+	}
+	uuid := q.uuids[0]
+	q.uuids = q.uuids[1:]
+	return uuid, true
+}
+
+func (q *sumQueue) isClosed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
+
+// close drops the uuids left and stops the workers once they finish the sums they are computing.
+func (q *sumQueue) close() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	q.closed = true
+	q.uuids = nil
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// pendingSums returns the uuids of node and of the nodes below it whose sums are pending.
+func pendingSums(node *filenode.FileNode) []string {
+	var uuids []string
+	_ = filenode.Walk(node, func(relPath string, n *filenode.FileNode) error {
+		if n.Meta.SumPending {
+			uuids = append(uuids, n.UUID)
+		}
+		return nil
+	})
+	return uuids
+}
+
+/*
+resolveSums computes the sums queued in q until it is closed and passes a SumUpdated transaction for each to send.
+The files are read without the lock, so events keep being handled meanwhile. A node that was removed or written again
+in the meantime gets no transaction, the events that changed it take care of it. A sum is only applied while q is
+open, the watcher closes it before it stops sending, so every sum applied to the tree is sent.
+*/
+func resolveSums(q *sumQueue, mu sync.Locker, tree func() *filenode.FileNode, parentPath connector.Path,
+	send func(*EventTransaction), errs func(error)) {
+	for {
+		uuid, ok := q.pop()
+		if !ok {
+			return
+		}
+		mu.Lock()
+		node := tree().SearchByUUID(uuid)
+		if node == nil || !node.Meta.SumPending {
+			mu.Unlock()
+			continue
+		}
+		path := connector.NewFSPath(filepath.Join(parentPath.String(), node.Path()))
+		opts := tree().Options()
+		mu.Unlock()
+
+		meta, chunks, err := filenode.ComputeSum(opts, path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			errs(err)
+			continue
+		}
+
+		var txn *EventTransaction
+		mu.Lock()
+		// once the queue is closed the transaction may not be sent anymore, so the sum stays pending like in the copies
+		// of the consumers
+		if node = tree().SearchByUUID(uuid); node != nil && !q.isClosed() {
+			oldChunks := node.Chunks
+			if node, ok = tree().ResolveSum(uuid, meta, chunks); ok {
+				txn = makeEventTransaction(*node, event.SumUpdated)
+				txn.ChunkDiff = diffChunks(oldChunks, node.Chunks)
+			}
+		}
+		mu.Unlock()
+		if txn != nil {
+			send(txn)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package watcher
+
+import (
+	"github.com/ayhanozemre/fs-shadow/filenode"
+	connector "github.com/ayhanozemre/fs-shadow/path"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func Test_ResolveSumsAfterClose(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "fs-shadow-sums")
+	_ = os.Mkdir(dir, os.ModePerm)
+	_ = os.WriteFile(filepath.Join(dir, "a.txt"), []byte("test"), 0644)
+	meta, _, err := filenode.ComputeSum(filenode.Options{}, connector.NewFSPath(filepath.Join(dir, "a.txt")))
+	assert.Equal(t, nil, err, "sum error")
+	meta.Sum, meta.SumPending = "", true
+	root := &filenode.FileNode{Name: "fs-shadow-sums", UUID: "r", Meta: filenode.MetaData{IsDir: true}}
+	assert.Equal(t, nil, root.AddSub(&filenode.FileNode{Name: "a.txt", UUID: "a", Meta: meta}), "add error")
+
+	q := newSumQueue()
+	q.push("a")
+	// the queue closes while the file is read, as when the watcher stops
+	calls := 0
+	tree := func() *filenode.FileNode {
+		calls++
+		if calls == 2 {
+			q.close()
+		}
+		return root
+	}
+	var sent []*EventTransaction
+	send := func(txn *EventTransaction) { sent = append(sent, txn) }
+	var errs []error
+	resolveSums(q, &sync.Mutex{}, tree, connector.NewFSPath(filepath.Dir(dir)), send,
+		func(err error) { errs = append(errs, err) })
+	assert.Equal(t, 0, len(errs), "sum errors: %v", errs)
+	assert.Equal(t, 0, len(sent), "sum sent after the queue closed")
+	assert.True(t, root.SearchByUUID("a").Meta.SumPending, "sum applied without a transaction")
+}
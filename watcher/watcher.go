@@ -1,15 +1,70 @@
 package watcher
 
 import (
+	"context"
+	"errors"
 	"github.com/ayhanozemre/fs-shadow/event"
 	"github.com/ayhanozemre/fs-shadow/filenode"
 	connector "github.com/ayhanozemre/fs-shadow/path"
+	"github.com/ayhanozemre/fs-shadow/utils"
 	"github.com/vmihailenco/msgpack/v5"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
+// The errors of the lifecycle of a watcher.
+var (
+	ErrNotStarted   = errors.New("watcher not started")
+	ErrStopped      = errors.New("watcher stopped")
+	ErrDrainTimeout = errors.New("watcher drain timed out")
+)
+
+// The reasons a change to the tree of a watcher fails besides the ones of filenode, they come wrapped in a
+// filenode.OpError.
+var (
+	ErrUnhandledEvent = errors.New("unhandled event")
+	ErrWatchList      = errors.New("watch list not updated")
+)
+
+// watchError is the error of fsnotify for a folder whose watch couldn't be changed, it matches ErrWatchList and
+// unwraps to the error of fsnotify.
+type watchError struct {
+	err error
+}
+
+func (e *watchError) Error() string {
+	return ErrWatchList.Error() + ": " + e.err.Error()
+}
+
+func (e *watchError) Is(target error) bool {
+	return target == ErrWatchList
+}
+
+func (e *watchError) Unwrap() error {
+	return e.err
+}
+
+// watchFailed wraps the error fsnotify gave for the folder at eventPath.
+func watchFailed(op string, eventPath connector.Path, err error) error {
+	return &filenode.OpError{Op: op, Path: eventPath.String(), Err: &watchError{err: err}}
+}
+
+// unhandled is the error of an event whose type a watcher doesn't handle.
+func unhandled(e event.Event, eventPath connector.Path) error {
+	return &filenode.OpError{Op: string(e.Type), Path: eventPath.String(), Err: ErrUnhandledEvent}
+}
+
 type Watcher interface {
-	Stop()
-	Start()
+	// Stop stops watching, sends the transactions of the events gathered so far and closes the channels. It returns
+	// ErrDrainTimeout when the channels aren't read for longer than the drain timeout, see WithDrainTimeout.
+	Stop() error
+	// Close is Stop.
+	Close() error
+	// Start runs the watcher until ctx is done, which stops it like Stop. The constructors start the watchers with a
+	// background context, starting them again ties them to ctx as well.
+	Start(ctx context.Context) error
 	Watch()
 	PrintTree(label string) // for debug
 	GetErrors() <-chan error
@@ -17,24 +72,65 @@ type Watcher interface {
 	Restore(tree *filenode.FileNode)
 	SearchByPath(path string) *filenode.FileNode
 	SearchByUUID(uuid string) *filenode.FileNode
+	Query(p filenode.Predicate) []filenode.Match
+	Snapshot() *filenode.FileNode
+	ScanProgress() *filenode.ScanProgress
+	// Overflows returns the number of transactions and errors dropped because they weren't read in time, see
+	// WithOverflowPolicy.
+	Overflows() int64
+	UpgradeSum(fromPath connector.Path) (*EventTransaction, error)
+	UpgradeSums() (int, error)
 	Handler(event event.Event, extra ...*filenode.ExtraPayload) (*EventTransaction, error)
 	Create(fromPath connector.Path, extra *filenode.ExtraPayload) (*filenode.FileNode, error)
 	Write(fromPath connector.Path) (*filenode.FileNode, error)
+	Chmod(fromPath connector.Path) (*filenode.FileNode, error)
 	Remove(fromPath connector.Path) (*filenode.FileNode, error)
 	Move(fromPath connector.Path, toPath connector.Path) (*filenode.FileNode, error)
 	Rename(fromPath connector.Path, toPath connector.Path) (*filenode.FileNode, error)
 }
 
+// TransactionVersion is the version of the encoding of EventTransaction. Records encoded before the versions were
+// introduced decode with Version 0 and leave the fields added since empty.
+const TransactionVersion = 1
+
+// ErrTransactionVersion is returned when a transaction was encoded by a newer version than the one that decodes it.
+var ErrTransactionVersion = errors.New("unsupported transaction version")
+
 type EventTransaction struct {
 	Name       string
 	Type       event.Type
 	UUID       string
 	ParentUUID string
 	Meta       filenode.MetaData
+	// OldMode is the mode the node had before a Chmod event.
+	OldMode filenode.FileMode
+	// Chunks is the chunk manifest of the node, see filenode.FileNode.Chunks.
+	Chunks []utils.Chunk
+	// ChunkDiff lists the chunks a Write added and removed, it is nil when the file wasn't chunked before or after.
+	ChunkDiff *utils.ChunkDiff
+	// Path is the path of the node the way SearchByPath takes it, the path it had for a Remove.
+	Path string
+	// OldPath is the path the node had before a Rename or Move.
+	OldPath string
+	// OldParentUUID is the uuid of the folder the node was in before a Rename or Move.
+	OldParentUUID string
+	// PrevSum is the sum the file had before a Write.
+	PrevSum string
+	// Seq numbers the transactions sent to the Events of a watcher from 1 in the order they are sent, a gap means
+	// transactions were dropped. The virtual watcher numbers the ones its Handler returns.
+	Seq uint64
+	// Time is when the event happened, see event.Event.Time.
+	Time time.Time
+	// Version is the version of the encoding, see TransactionVersion.
+	Version int
 }
 
 func (t *EventTransaction) Encode() ([]byte, error) {
-	b, err := msgpack.Marshal(t)
+	v := *t
+	if v.Version == 0 {
+		v.Version = TransactionVersion
+	}
+	b, err := msgpack.Marshal(&v)
 	if err != nil {
 		return nil, err
 	}
@@ -46,6 +142,9 @@ func (t *EventTransaction) Decode(b []byte) error {
 	if err != nil {
 		return err
 	}
+	if t.Version > TransactionVersion {
+		return ErrTransactionVersion
+	}
 	return err
 }
 
@@ -55,6 +154,7 @@ func (t *EventTransaction) toFileNode() *filenode.FileNode {
 		UUID:       t.UUID,
 		ParentUUID: t.ParentUUID,
 		Meta:       t.Meta,
+		Chunks:     t.Chunks,
 	}
 }
 
@@ -65,13 +165,275 @@ func makeEventTransaction(node filenode.FileNode, event event.Type) *EventTransa
 		Meta:       node.Meta,
 		UUID:       node.UUID,
 		ParentUUID: node.ParentUUID,
+		Chunks:     node.Chunks,
+		Path:       node.Path(),
+		Time:       now(),
+		Version:    TransactionVersion,
+	}
+}
+
+// now is the current time without the monotonic clock reading, which doesn't survive the encoding.
+func now() time.Time {
+	return time.Now().Round(0)
+}
+
+// prior is what the transaction of an event tells about the node before the event changed it.
+type prior struct {
+	path       string
+	parentUUID string
+	sum        string
+}
+
+// priorOf records the node at eventPath, which is relative to the parent of the watched folder.
+func priorOf(tree *filenode.FileNode, eventPath connector.Path) prior {
+	p := prior{path: eventPath.String()}
+	if node := tree.Search(p.path); node != nil {
+		p.parentUUID, p.sum = node.ParentUUID, node.Meta.Sum
+	}
+	return p
+}
+
+// fill sets the fields of the transaction of e that describe the node before it.
+func (p prior) fill(txn *EventTransaction, e event.Event) {
+	if !e.Time.IsZero() {
+		txn.Time = e.Time.Round(0)
+	}
+	switch e.Type {
+	case event.Remove:
+		txn.Path = p.path
+	case event.Rename, event.Move:
+		txn.OldPath, txn.OldParentUUID = p.path, p.parentUUID
+	case event.Write:
+		txn.PrevSum = p.sum
+	}
+}
+
+// markerTransaction returns a transaction of type t that carries no change, it identifies the root of the tree.
+func markerTransaction(t event.Type, root *filenode.FileNode) EventTransaction {
+	return EventTransaction{Type: t, Name: root.Name, UUID: root.UUID, Path: root.Name, Time: now(),
+		Version: TransactionVersion}
+}
+
+// createTransactions returns the Create transactions of the nodes below node, parents first. The nodes may be taken
+// from a snapshot, their paths are joined to the path of node.
+func createTransactions(node *filenode.FileNode, nodePath string) []*EventTransaction {
+	var txns []*EventTransaction
+	if node == nil {
+		return txns
+	}
+	_ = filenode.Walk(node, func(relPath string, n *filenode.FileNode) error {
+		if n != node {
+			txn := makeEventTransaction(*n, event.Create)
+			txn.Path = filepath.Join(nodePath, relPath)
+			txns = append(txns, txn)
+		}
+		return nil
+	})
+	return txns
+}
+
+// publishScan sends the Create transactions of the nodes below root and then the ScanComplete marker, see
+// WithScanTransactions.
+func publishScan(root *filenode.FileNode, send func(*EventTransaction)) {
+	for _, txn := range createTransactions(root, root.Name) {
+		send(txn)
+	}
+	marker := markerTransaction(event.ScanComplete, root)
+	send(&marker)
+}
+
+// diffChunks compares the chunk manifests of a file before and after a Write.
+func diffChunks(oldChunks, newChunks []utils.Chunk) *utils.ChunkDiff {
+	if len(oldChunks) == 0 && len(newChunks) == 0 {
+		return nil
+	}
+	diff := utils.DiffChunks(oldChunks, newChunks)
+	return &diff
+}
+
+// forgetSums drops the sums of the files below a removed node from the hash cache, a nil cache is fine.
+func forgetSums(c *utils.HashCache, node *filenode.FileNode) {
+	if c == nil {
+		return
+	}
+	_ = filenode.Walk(node, func(relPath string, n *filenode.FileNode) error {
+		if !n.Meta.IsDir && n.Meta.Inode != 0 {
+			_ = c.Invalidate(n.Meta.Device, n.Meta.Inode)
+		}
+		return nil
+	})
+}
+
+// flushHashCache writes the sums recorded so far to the log of the cache, a nil cache is fine.
+func flushHashCache(c *utils.HashCache, errs func(error)) {
+	if c == nil {
+		return
+	}
+	if err := c.Flush(); err != nil {
+		errs(err)
+	}
+}
+
+// upgradeSum replaces the weak sum of the node at fromPath with a full one and returns the change as a SumUpdated
+// transaction, a node that already had a full sum gives none. The file is read without the lock, a file that changes
+// meanwhile keeps its weak sum, the events that changed it take care of it.
+func upgradeSum(mu sync.Locker, tree func() *filenode.FileNode, parentPath connector.Path,
+	fromPath connector.Path) (*EventTransaction, error) {
+	eventPath := fromPath.ExcludePath(parentPath)
+	mu.Lock()
+	node := tree().Search(eventPath.String())
+	if node == nil {
+		mu.Unlock()
+		return nil, &filenode.OpError{Op: "upgrade sum", Path: eventPath.String(), Err: filenode.ErrNotFound}
+	}
+	if !node.Meta.WeakSum {
+		mu.Unlock()
+		return nil, nil
+	}
+	uuid, prevSum, oldChunks := node.UUID, node.Meta.Sum, node.Chunks
+	opts := tree().Options()
+	mu.Unlock()
+
+	opts.QuickSum = utils.QuickSampling{}
+	meta, chunks, err := filenode.ComputeSum(opts, fromPath)
+	if err != nil {
+		return nil, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	node, ok := tree().ResolveSum(uuid, meta, chunks)
+	if !ok {
+		return nil, nil
+	}
+	txn := makeEventTransaction(*node, event.SumUpdated)
+	txn.PrevSum = prevSum
+	txn.ChunkDiff = diffChunks(oldChunks, node.Chunks)
+	return txn, nil
+}
+
+// upgradeSums upgrades the weak sums of the tree below root one at a time and passes the transactions to send. The
+// files are read without the lock, so events keep being handled, and the files that are gone by then are skipped.
+// It returns ErrStopped as soon as stopped reports true.
+func upgradeSums(mu sync.Locker, tree func() *filenode.FileNode, root connector.Path, parentPath connector.Path,
+	send func(*EventTransaction), stopped func() bool) (int, error) {
+	if stopped() {
+		return 0, ErrStopped
+	}
+	mu.Lock()
+	weak := tree().Query(filenode.HasWeakSum())
+	mu.Unlock()
+
+	count := 0
+	for _, m := range weak {
+		if stopped() {
+			return count, ErrStopped
+		}
+		fromPath := connector.NewFSPath(filepath.Join(root.String(), m.Path))
+		txn, err := upgradeSum(mu, tree, parentPath, fromPath)
+		if os.IsNotExist(err) || errors.Is(err, filenode.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		if txn != nil {
+			send(txn)
+			count++
+		}
+	}
+	return count, nil
+}
+
+// lifecycle runs the loop of a watcher until it is stopped, see Watcher.Start and Watcher.Stop.
+type lifecycle struct {
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	done    chan struct{}
+	timeout time.Duration
+}
+
+// start calls run in a goroutine with a context that is done when ctx is or when stop is called, run has to return
+// once it is. A lifecycle that is already running is stopped when ctx is done as well.
+func (l *lifecycle) start(ctx context.Context, run func(ctx context.Context)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.done != nil {
+		select {
+		case <-l.done:
+			return ErrStopped
+		default:
+		}
+		cancel, done := l.cancel, l.done
+		go func() {
+			select {
+			case <-ctx.Done():
+				cancel()
+			case <-done:
+			}
+		}()
+		return nil
+	}
+	ctx, l.cancel = context.WithCancel(ctx)
+	done := make(chan struct{})
+	l.done = done
+	go func() {
+		defer close(done)
+		run(ctx)
+	}()
+	return nil
+}
+
+// stop cancels the context of run and waits for it to return, for the timeout at most.
+func (l *lifecycle) stop() error {
+	l.mu.Lock()
+	cancel, done := l.cancel, l.done
+	l.mu.Unlock()
+	if done == nil {
+		return ErrNotStarted
+	}
+	cancel()
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		return ErrDrainTimeout
+	}
+}
+
+// filterEvent applies the Exclude and MaxDepth options of the tree to e, the paths are matched relative to root. A move
+// out of the tree becomes a Remove and a move into it a Create, ok is false for an event the tree leaves out.
+func filterEvent(opts filenode.Options, root connector.Path, e event.Event) (event.Event, bool) {
+	if len(opts.Exclude) == 0 && opts.MaxDepth == 0 {
+		return e, true
+	}
+	fromSkipped := opts.Skips(e.FromPath.ExcludePath(root).String())
+	if e.Type != event.Rename && e.Type != event.Move {
+		return e, !fromSkipped
+	}
+	toSkipped := opts.Skips(e.ToPath.ExcludePath(root).String())
+	switch {
+	case fromSkipped && toSkipped:
+		return e, false
+	case fromSkipped:
+		return event.Event{Type: event.Create, FromPath: e.ToPath}, true
+	case toSkipped:
+		return event.Event{Type: event.Remove, FromPath: e.FromPath}, true
 	}
+	return e, true
+}
+
+// attrsChanged tells whether the permission or the ownership differ, which is what a Chmod event reports.
+func attrsChanged(o, n filenode.MetaData) bool {
+	return o.FileMode() != n.FileMode() || o.Uid != n.Uid || o.Gid != n.Gid
 }
 
-func NewFSWatcher(fsPath string) (Watcher, *EventTransaction, error) {
-	return NewPathWatcher(fsPath)
+func NewFSWatcher(fsPath string, opts ...Option) (Watcher, *EventTransaction, error) {
+	return NewPathWatcher(fsPath, opts...)
 }
 
-func NewVirtualWatcher(fsPath string, extra *filenode.ExtraPayload) (Watcher, *EventTransaction, error) {
-	return NewVirtualPathWatcher(fsPath, extra)
+func NewVirtualWatcher(fsPath string, extra *filenode.ExtraPayload, opts ...Option) (Watcher, *EventTransaction, error) {
+	return NewVirtualPathWatcher(fsPath, extra, opts...)
 }
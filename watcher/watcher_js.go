@@ -1,8 +1,8 @@
 package watcher
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/ayhanozemre/fs-shadow/event"
 	"github.com/ayhanozemre/fs-shadow/filenode"
@@ -35,6 +35,31 @@ func (tw *TreeWatcher) SearchByUUID(uuid string) *filenode.FileNode {
 	return nil
 }
 
+func (tw *TreeWatcher) Query(p filenode.Predicate) []filenode.Match {
+	return nil
+}
+
+func (tw *TreeWatcher) Snapshot() *filenode.FileNode {
+	return nil
+}
+
+// Overflows is always 0, virtual trees send no transactions.
+func (tw *TreeWatcher) Overflows() int64 {
+	return 0
+}
+
+func (tw *TreeWatcher) ScanProgress() *filenode.ScanProgress {
+	return nil
+}
+
+func (tw *TreeWatcher) UpgradeSum(path connector.Path) (*EventTransaction, error) {
+	return nil, nil
+}
+
+func (tw *TreeWatcher) UpgradeSums() (int, error) {
+	return 0, nil
+}
+
 func (tw *TreeWatcher) PrintTree(label string) {
 	bannerStartLine := fmt.Sprintf("----------------%s----------------", label)
 	bannerEndLine := fmt.Sprintf("----------------%s----------------\n\n", label)
@@ -64,12 +89,22 @@ func (tw *TreeWatcher) Write(path connector.Path) (*filenode.FileNode, error) {
 	return nil, nil
 }
 
-func (tw *TreeWatcher) Stop() {
+func (tw *TreeWatcher) Chmod(path connector.Path) (*filenode.FileNode, error) {
+	return nil, nil
+}
+
+func (tw *TreeWatcher) Stop() error {
 	log.Debug("stop not implemented ")
+	return nil
 }
 
-func (tw *TreeWatcher) Start() {
+func (tw *TreeWatcher) Close() error {
+	return tw.Stop()
+}
+
+func (tw *TreeWatcher) Start(ctx context.Context) error {
 	log.Debug("start not implemented ")
+	return nil
 }
 
 func (tw *TreeWatcher) Watch() {
@@ -86,6 +121,7 @@ func (tw *TreeWatcher) Handler(e event.Event, extras ...*filenode.ExtraPayload)
 	if len(extras) > 0 {
 		extra = extras[0]
 	}
+	before := priorOf(tw.FileTree, e.FromPath.ExcludePath(tw.ParentPath))
 
 	switch e.Type {
 	case event.Remove:
@@ -104,14 +140,14 @@ func (tw *TreeWatcher) Handler(e event.Event, extras ...*filenode.ExtraPayload)
 		node, err = tw.Move(e.FromPath, e.ToPath)
 		break
 	default:
-		errorMsg := fmt.Sprintf("unhandled event: %s", e.String())
-		err = errors.New(errorMsg)
+		err = unhandled(e, e.FromPath.ExcludePath(tw.ParentPath))
 		break
 	}
 	if err != nil {
 		return nil, err
 	}
 	et := makeEventTransaction(*node, e.Type)
+	before.fill(et, e)
 	return et, err
 }
 
@@ -119,7 +155,7 @@ func (tw *TreeWatcher) Restore(tree *filenode.FileNode) {
 	tw.FileTree = tree
 }
 
-func NewPathWatcher(virtualPath string) (*TreeWatcher, *EventTransaction, error) {
+func NewPathWatcher(virtualPath string, opts ...Option) (*TreeWatcher, *EventTransaction, error) {
 	log.Debug("NewPathWatcher not implemented ")
 	return nil, nil, nil
 }
@@ -1,15 +1,17 @@
 package watcher
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/ayhanozemre/fs-shadow/event"
 	filenode "github.com/ayhanozemre/fs-shadow/filenode"
 	"github.com/ayhanozemre/fs-shadow/path"
+	"github.com/ayhanozemre/fs-shadow/utils"
 	"github.com/fsnotify/fsnotify"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
+	"os"
 	"sync"
 	"time"
 )
@@ -25,6 +27,25 @@ type TreeWatcher struct {
 
 	sync.Mutex
 	EventManager event.EventHandler
+
+	// progress counts the work of the scans, it is shared with the options of the tree.
+	progress  *filenode.ScanProgress
+	hashCache *utils.HashCache
+	// sums queues the nodes whose sums were deferred, it is nil when sums are computed right away.
+	sums *sumQueue
+	// tick is the interval the events gathered by the EventManager are processed at.
+	tick   time.Duration
+	logger log.FieldLogger
+	life   lifecycle
+	// stopping is done when the watcher is being stopped, Watch returns then.
+	stopping <-chan struct{}
+	// outbox sends the transactions and errors, see WithOverflowPolicy.
+	outbox *outbox
+	// workers counts the running sum workers, the channels are closed once they return.
+	workers    sync.WaitGroup
+	sumWorkers int
+	// scanTxns sends the nodes found by the scans as Create transactions, see WithScanTransactions.
+	scanTxns bool
 }
 
 func (tw *TreeWatcher) GetEvents() <-chan *EventTransaction {
@@ -36,20 +57,46 @@ func (tw *TreeWatcher) GetErrors() <-chan error {
 }
 
 func (tw *TreeWatcher) SearchByPath(path string) *filenode.FileNode {
+	tw.Lock()
+	defer tw.Unlock()
 	return tw.FileTree.Search(path)
 }
 
 func (tw *TreeWatcher) SearchByUUID(uuid string) *filenode.FileNode {
+	tw.Lock()
+	defer tw.Unlock()
 	return tw.FileTree.SearchByUUID(uuid)
 }
 
+func (tw *TreeWatcher) Query(p filenode.Predicate) []filenode.Match {
+	tw.Lock()
+	defer tw.Unlock()
+	return tw.FileTree.Query(p)
+}
+
+// Snapshot returns a read-only view of the tree that can be used without holding the lock of the watcher.
+func (tw *TreeWatcher) Snapshot() *filenode.FileNode {
+	tw.Lock()
+	defer tw.Unlock()
+	return tw.FileTree.Snapshot()
+}
+
+func (tw *TreeWatcher) Overflows() int64 {
+	return tw.outbox.Overflows()
+}
+
+// ScanProgress returns the counters of the scans, they can be read while a scan holds the lock of the watcher.
+func (tw *TreeWatcher) ScanProgress() *filenode.ScanProgress {
+	return tw.progress
+}
+
 func (tw *TreeWatcher) PrintTree(label string) {
 
 	bannerStartLine := fmt.Sprintf("----------------%s----------------", label)
 	bannerEndLine := fmt.Sprintf("----------------%s----------------\n\n", label)
 	fmt.Println(bannerStartLine)
 	//a, _ := json.MarshalIndent(tw.FileTree, "", "  ")
-	a, _ := json.Marshal(tw.FileTree)
+	a, _ := json.Marshal(tw.Snapshot())
 	fmt.Println(string(a))
 	fmt.Println(bannerEndLine)
 }
@@ -71,20 +118,53 @@ func (tw *TreeWatcher) Remove(path connector.Path) (*filenode.FileNode, error) {
 func (tw *TreeWatcher) Write(path connector.Path) (*filenode.FileNode, error) {
 	var node *filenode.FileNode
 	var err error
-	if !path.IsDir() {
+	// a write on a symlink means it was retargeted, a followed one may point to a folder
+	if !path.IsDir() || path.Info().IsSymlink {
 		eventPath := path.ExcludePath(tw.ParentPath)
-		node, err = tw.FileTree.Update(eventPath, path)
+		eventCh := tw.addWatches()
+		node, err = tw.FileTree.Update(eventPath, path, eventCh)
+		eventCh <- nil
+		close(eventCh)
 		return node, err
 	}
 	return node, err
 }
 
-func (tw *TreeWatcher) Create(path connector.Path, extra *filenode.ExtraPayload) (*filenode.FileNode, error) {
-	if !path.Exists() {
-		return nil, errors.New("file path does not exist")
+// Chmod refreshes the permission, ownership and timestamps of the node, the content isn't read again.
+func (tw *TreeWatcher) Chmod(path connector.Path) (*filenode.FileNode, error) {
+	return tw.FileTree.UpdateAttrs(path.ExcludePath(tw.ParentPath), path)
+}
+
+// UpgradeSum replaces the weak sum of the file at path with a full one, see filenode.MetaData.WeakSum. The change is
+// returned as a SumUpdated transaction, a file that already had a full sum gives none. The file is read without the
+// lock of the watcher.
+func (tw *TreeWatcher) UpgradeSum(path connector.Path) (*EventTransaction, error) {
+	tree := func() *filenode.FileNode { return tw.FileTree }
+	return upgradeSum(&tw.Mutex, tree, tw.ParentPath, path)
+}
+
+// UpgradeSums upgrades every weak sum of the tree and sends the changes to the events, it returns the number of sums
+// upgraded. It reads the files one at a time between the events, so it is meant to be run in the background. It returns
+// ErrStopped once the watcher has stopped.
+func (tw *TreeWatcher) UpgradeSums() (int, error) {
+	tree := func() *filenode.FileNode { return tw.FileTree }
+	return upgradeSums(&tw.Mutex, tree, tw.Path, tw.ParentPath, tw.outbox.send, tw.outbox.isClosed)
+}
+
+// startSums runs the workers that compute the deferred sums, see WithDeferredSums.
+func (tw *TreeWatcher) startSums(workers int) {
+	tree := func() *filenode.FileNode { return tw.FileTree }
+	for i := 0; i < workers; i++ {
+		tw.workers.Add(1)
+		go func() {
+			defer tw.workers.Done()
+			resolveSums(tw.sums, &tw.Mutex, tree, tw.ParentPath, tw.outbox.send, tw.outbox.sendError)
+		}()
 	}
+}
 
-	eventPath := path.ExcludePath(tw.ParentPath)
+// addWatches adds the folders sent to the returned channel to the fsnotify watcher, until nil is sent.
+func (tw *TreeWatcher) addWatches() chan connector.Path {
 	eventCh := make(chan connector.Path)
 
 	go func() {
@@ -95,8 +175,8 @@ func (tw *TreeWatcher) Create(path connector.Path, extra *filenode.ExtraPayload)
 					if p.IsDir() {
 						err := tw.Watcher.Add(p.String())
 						if err != nil {
-							tw.Errors <- err
-							return
+							// keep receiving, the walk sending to eventCh must not block
+							tw.outbox.sendError(watchFailed("watch", p.ExcludePath(tw.ParentPath), err))
 						}
 					}
 				} else {
@@ -105,7 +185,16 @@ func (tw *TreeWatcher) Create(path connector.Path, extra *filenode.ExtraPayload)
 			}
 		}
 	}()
+	return eventCh
+}
 
+func (tw *TreeWatcher) Create(path connector.Path, extra *filenode.ExtraPayload) (*filenode.FileNode, error) {
+	if !path.Exists() {
+		return nil, &filenode.OpError{Op: "create", Path: path.String(), Err: os.ErrNotExist}
+	}
+
+	eventPath := path.ExcludePath(tw.ParentPath)
+	eventCh := tw.addWatches()
 	node, err := tw.FileTree.Create(eventPath, path, eventCh)
 	eventCh <- nil
 	close(eventCh)
@@ -120,12 +209,15 @@ func (tw *TreeWatcher) Rename(fromPath connector.Path, toPath connector.Path) (*
 	if node.Meta.IsDir {
 		err = tw.Watcher.Remove(fromPath.String())
 		if err != nil {
-			return nil, err
+			return nil, watchFailed("rename", fromPath.ExcludePath(tw.ParentPath), err)
 		}
 
 		err = tw.Watcher.Add(toPath.String())
+		if err != nil {
+			return nil, watchFailed("rename", toPath.ExcludePath(tw.ParentPath), err)
+		}
 	}
-	return node, err
+	return node, nil
 }
 
 func (tw *TreeWatcher) Move(fromPath connector.Path, toPath connector.Path) (*filenode.FileNode, error) {
@@ -138,6 +230,8 @@ func (tw *TreeWatcher) Move(fromPath connector.Path, toPath connector.Path) (*fi
 
 // Handler the 'extras' parameter is optional because we may need to move an external value to the node layer.
 // sample; We want to parameterize the uuid from outside in VFS, but we don't want to do that in FS.
+// A Chmod event that changed neither the permission nor the ownership, or a Write event on a folder, gives no
+// transaction and no error.
 func (tw *TreeWatcher) Handler(e event.Event, extras ...*filenode.ExtraPayload) (*EventTransaction, error) {
 	tw.Lock()
 	defer tw.Unlock()
@@ -145,6 +239,14 @@ func (tw *TreeWatcher) Handler(e event.Event, extras ...*filenode.ExtraPayload)
 	var err error
 	var node *filenode.FileNode
 	var extra *filenode.ExtraPayload
+	var oldMeta filenode.MetaData
+	var oldChunks []utils.Chunk
+
+	e, ok := filterEvent(tw.FileTree.Options(), tw.Path, e)
+	if !ok {
+		return nil, nil
+	}
+	before := priorOf(tw.FileTree, e.FromPath.ExcludePath(tw.ParentPath))
 
 	if len(extras) > 0 {
 		extra = extras[0]
@@ -153,10 +255,38 @@ func (tw *TreeWatcher) Handler(e event.Event, extras ...*filenode.ExtraPayload)
 	switch e.Type {
 	case event.Remove:
 		node, err = tw.Remove(e.FromPath)
+		if err == nil {
+			forgetSums(tw.hashCache, node)
+		}
 		break
 	case event.Write:
+		if e.FromPath.Info().IsSymlink && tw.FileTree.Search(e.FromPath.ExcludePath(tw.ParentPath).String()) == nil {
+			// the link was renamed into place without replacing another one
+			e.Type = event.Create
+			node, err = tw.Create(e.FromPath, extra)
+			break
+		}
+		if e.FromPath.IsDir() && !e.FromPath.Info().IsSymlink {
+			// a write on a folder only means its entries changed, their own events take care of it
+			return nil, nil
+		}
+		if old := tw.FileTree.Search(e.FromPath.ExcludePath(tw.ParentPath).String()); old != nil {
+			oldChunks = old.Chunks
+		}
 		node, err = tw.Write(e.FromPath)
 		break
+	case event.Chmod:
+		old := tw.FileTree.Search(e.FromPath.ExcludePath(tw.ParentPath).String())
+		if old == nil || !e.FromPath.Exists() {
+			// the file is on its way in or out, the events that follow take care of it
+			return nil, nil
+		}
+		oldMeta = old.Meta
+		node, err = tw.Chmod(e.FromPath)
+		if err == nil && !attrsChanged(oldMeta, node.Meta) {
+			return nil, nil
+		}
+		break
 	case event.Create:
 		node, err = tw.Create(e.FromPath, extra)
 		break
@@ -167,20 +297,31 @@ func (tw *TreeWatcher) Handler(e event.Event, extras ...*filenode.ExtraPayload)
 		node, err = tw.Move(e.FromPath, e.ToPath)
 		break
 	default:
-		errorMsg := fmt.Sprintf("unhandled event: op:%s, path:%s", e.Type, e.FromPath)
-		err = errors.New(errorMsg)
+		err = unhandled(e, e.FromPath.ExcludePath(tw.ParentPath))
 		break
 	}
 	if err != nil {
 		return nil, err
 	}
 	et := makeEventTransaction(*node, e.Type)
+	before.fill(et, e)
+	if e.Type == event.Chmod {
+		et.OldMode = oldMeta.FileMode()
+	}
+	if e.Type == event.Write && !node.Meta.SumPending {
+		et.ChunkDiff = diffChunks(oldChunks, node.Chunks)
+	}
+	if e.Type == event.Create || e.Type == event.Write {
+		tw.sums.push(pendingSums(node)...)
+	}
 	return et, err
 }
 
 func (tw *TreeWatcher) Watch() {
 	for {
 		select {
+		case <-tw.stopping:
+			return
 		case e, ok := <-tw.Watcher.Events:
 			if !ok {
 				return
@@ -188,66 +329,124 @@ func (tw *TreeWatcher) Watch() {
 			var sum string
 			path := connector.NewFSPath(e.Name)
 			eventPath := path.ExcludePath(tw.ParentPath)
+			tw.Lock()
 			node := tw.FileTree.Search(eventPath.ParentPath().String())
 			if node != nil {
 				sum = node.Meta.Sum
 			}
+			tw.Unlock()
 			tw.EventManager.Append(e, sum)
 		case err, ok := <-tw.Watcher.Errors:
-			tw.Errors <- err
 			if !ok {
 				return
 			}
+			tw.outbox.sendError(err)
 		}
 	}
 }
 
-func (tw *TreeWatcher) Start() {
-	log.Debug("started!")
-	// EventManager's working range
-	ticker := time.NewTicker(2 * time.Second)
-
-	go tw.start(ticker)
-	go tw.Watch()
+func (tw *TreeWatcher) Start(ctx context.Context) error {
+	return tw.life.start(ctx, tw.run)
 }
 
-func (tw *TreeWatcher) start(ticker *time.Ticker) {
+// run processes the events gathered on every tick until ctx is done, then drains them.
+func (tw *TreeWatcher) run(ctx context.Context) {
+	tw.logger.Debug("started!")
+	// EventManager's working range
+	if tw.scanTxns {
+		publishScan(tw.Snapshot(), tw.outbox.send)
+	}
+	// the sums of the scan are sent after its nodes
+	tw.startSums(tw.sumWorkers)
+	ticker := time.NewTicker(tw.tick)
+	tw.stopping = ctx.Done()
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		tw.Watch()
+	}()
 	for {
 		select {
-		case _ = <-ticker.C:
-			if tw.EventManager.StackLength() > 0 {
-				newEvents := tw.EventManager.Process()
-				for _, e := range newEvents {
-					txn, err := tw.Handler(e)
-					if err != nil {
-						tw.Errors <- err
-					}
-					tw.Events <- txn
+		case <-ctx.Done():
+			ticker.Stop()
+			tw.drain(watching)
+			return
+		case <-ticker.C:
+			tw.process()
+		}
+	}
+}
+
+// process sends the transactions of the events gathered so far, it returns the number of events processed.
+func (tw *TreeWatcher) process() int {
+	if tw.EventManager.StackLength() == 0 {
+		return 0
+	}
+	newEvents := tw.EventManager.Process()
+	for _, e := range newEvents {
+		txn, err := tw.Handler(e)
+		if err != nil {
+			tw.outbox.sendError(err)
+			continue
+		}
+		if txn != nil {
+			tw.outbox.send(txn)
+			if tw.scanTxns && txn.Type == event.Create && txn.Meta.IsDir {
+				for _, sub := range createTransactions(tw.Snapshot().SearchByUUID(txn.UUID), txn.Path) {
+					tw.outbox.send(sub)
 				}
 			}
 		}
 	}
+	flushHashCache(tw.hashCache, tw.outbox.sendError)
+	return len(newEvents)
 }
 
-func (tw *TreeWatcher) Stop() {
-	err := tw.Watcher.Close()
-	if err != nil {
-		log.Error(err)
+// drain waits for Watch and the sum workers to return, sends the transactions of the events left, closes the fsnotify
+// watcher and then the channels. The events that can't be made sense of on their own are dropped.
+func (tw *TreeWatcher) drain(watching chan struct{}) {
+	<-watching
+	tw.sums.close()
+	tw.workers.Wait()
+	// Process stops after every Create, so it's called until no event is left that it can make sense of
+	for tw.process() > 0 {
+	}
+	tw.outbox.close()
+	if err := tw.Watcher.Close(); err != nil {
+		tw.logger.Error(err)
 	}
 	close(tw.Events)
 	close(tw.Errors)
 }
 
+func (tw *TreeWatcher) Stop() error {
+	return tw.life.stop()
+}
+
+func (tw *TreeWatcher) Close() error {
+	return tw.Stop()
+}
+
 func (tw *TreeWatcher) Restore(tree *filenode.FileNode) {
+	tw.Lock()
+	defer tw.Unlock()
+	tree.Reindex()
+	tree.SetOptions(tw.FileTree.Options())
 	tw.FileTree = tree
+	tw.sums.push(pendingSums(tree)...)
 }
 
-func NewPathWatcher(fsPath string) (*TreeWatcher, *EventTransaction, error) {
+func NewPathWatcher(fsPath string, opts ...Option) (*TreeWatcher, *EventTransaction, error) {
 	var err error
 	var watcher *fsnotify.Watcher
 	path := connector.NewFSPath(fsPath)
 	if !path.IsDir() {
-		err = errors.New("input path is not directory")
+		err = &filenode.OpError{Op: "watch", Path: fsPath, Err: filenode.ErrNotDirectory}
+		return nil, nil, err
+	}
+
+	cfg := newConfig(opts)
+	if err = cfg.validate(); err != nil {
 		return nil, nil, err
 	}
 
@@ -261,26 +460,45 @@ func NewPathWatcher(fsPath string) (*TreeWatcher, *EventTransaction, error) {
 		UUID: uuid.NewString(),
 		Meta: filenode.MetaData{
 			IsDir: true,
+			Type:  filenode.TypeDir,
 		},
 		Subs: []*filenode.FileNode{},
 	}
+	root.SetOptions(cfg.treeOptions())
 
+	events, errs := cfg.channelSizes(10)
 	tw := TreeWatcher{
 		FileTree:     &root,
 		ParentPath:   path.ParentPath(),
 		Path:         path,
 		Watcher:      watcher,
 		EventManager: event.NewEventHandler(),
-		Events:       make(chan *EventTransaction, 10),
-		Errors:       make(chan error, 10),
+		progress:     cfg.progress,
+		hashCache:    cfg.hashCache,
+		sums:         cfg.sumQueue(),
+		tick:         cfg.tick,
+		logger:       cfg.logger,
+		sumWorkers:   cfg.sumWorkers,
+		scanTxns:     cfg.scanTxns,
+		life:         lifecycle{timeout: cfg.drain},
+		Events:       make(chan *EventTransaction, events),
+		Errors:       make(chan error, errs),
 	}
+	tree := func() *filenode.FileNode { return tw.FileTree }
+	deliver := func(txn *EventTransaction) { tw.Events <- txn }
+	tw.outbox = newOutbox(cfg.overflow, events, &tw.Mutex, tree, deliver, tw.Errors)
 	e := event.Event{FromPath: path, Type: event.Create}
 	txn, err := tw.Handler(e)
 	if err != nil {
-		tw.Errors <- err
+		tw.outbox.sendError(err)
+		tw.outbox.close()
+		return nil, nil, err
+	}
+	flushHashCache(tw.hashCache, tw.outbox.sendError)
+	// the root goes first, the run loop sends the rest of the scan
+	tw.outbox.send(txn)
+	if err = tw.Start(context.Background()); err != nil {
 		return nil, nil, err
 	}
-	tw.Start()
-	tw.Events <- txn
 	return &tw, txn, nil
 }
@@ -1,10 +1,15 @@
 package watcher
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/ayhanozemre/fs-shadow/event"
 	"github.com/ayhanozemre/fs-shadow/filenode"
 	connector "github.com/ayhanozemre/fs-shadow/path"
+	"github.com/ayhanozemre/fs-shadow/utils"
 	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"path/filepath"
@@ -134,6 +139,12 @@ func Test_LinuxWatcherFunctionality(t *testing.T) {
 	assert.Equal(t, nil, err, "handler write error")
 	assert.NotEqual(t, oldSum, tw.FileTree.Subs[1].Meta.Sum, "handler: file sum mismatch")
 
+	// Handler Write on a folder
+	e = event.Event{FromPath: newFolder, Type: event.Write}
+	txn, err := tw.Handler(e, nil)
+	assert.Equal(t, nil, err, "handler folder write error")
+	assert.True(t, txn == nil, "handler: transaction for a folder write")
+
 	// Handler Rename
 	handlerRenameTestFile := connector.NewFSPath(filepath.Join(testRoot, "new-file-rename.txt"))
 	_ = os.Rename(handlerTestFile.String(), handlerRenameTestFile.String())
@@ -152,3 +163,451 @@ func Test_LinuxWatcherFunctionality(t *testing.T) {
 
 	_ = os.RemoveAll(testRoot)
 }
+
+func Test_LinuxWatcherSymlink(t *testing.T) {
+	testRoot := filepath.Join(t.TempDir(), "fs-shadow-links")
+	_ = os.Mkdir(testRoot, os.ModePerm)
+	tw, _, err := NewPathWatcher(testRoot, WithLinkPolicy(filenode.LinkRecord), WithTickInterval(50*time.Millisecond))
+	assert.Equal(t, nil, err, "linux path watcher creation error")
+	defer tw.Stop()
+	<-tw.GetEvents()
+
+	// waitLink returns the first transaction of the link that points to target
+	waitLink := func(target string) *EventTransaction {
+		for {
+			select {
+			case txn := <-tw.GetEvents():
+				if txn.Path == "fs-shadow-links/link" && txn.Meta.LinkTarget == target {
+					return txn
+				}
+			case <-time.After(5 * time.Second):
+				return nil
+			}
+		}
+	}
+
+	link := filepath.Join(testRoot, "link")
+	_ = os.Symlink("target-1", link)
+	txn := waitLink("target-1")
+	assert.NotNil(t, txn, "create:link event not received")
+	if txn != nil {
+		assert.Equal(t, event.Create, txn.Type, "create:invalid event type")
+		assert.Equal(t, filenode.TypeSymlink, txn.Meta.Type, "create:invalid node type")
+	}
+
+	// ln -sfn target-2 link
+	tmp := filepath.Join(testRoot, "link.tmp")
+	_ = os.Symlink("target-2", tmp)
+	_ = os.Rename(tmp, link)
+	txn = waitLink("target-2")
+	assert.NotNil(t, txn, "retarget:link event not received")
+	if txn != nil {
+		assert.Equal(t, filenode.TypeSymlink, txn.Meta.Type, "retarget:invalid node type")
+	}
+	assert.Nil(t, tw.SearchByPath("fs-shadow-links/link.tmp"), "retarget:temporary link in the tree")
+}
+
+func Test_LinuxWatcherChmod(t *testing.T) {
+	testRoot := filepath.Join(t.TempDir(), "fs-shadow-chmod")
+	_ = os.Mkdir(testRoot, os.ModePerm)
+	file := filepath.Join(testRoot, "test.txt")
+	_ = os.WriteFile(file, []byte("test"), 0644)
+	_ = os.Chmod(file, 0644)
+	tw, _, err := NewPathWatcher(testRoot)
+	assert.Equal(t, nil, err, "linux path watcher creation error")
+	defer tw.Stop()
+	<-tw.GetEvents()
+
+	// only timestamps change, there is nothing to report
+	_ = os.Chtimes(file, time.Now(), time.Now())
+	_ = os.Chmod(file, 0755)
+	select {
+	case txn := <-tw.GetEvents():
+		assert.Equal(t, event.Chmod, txn.Type, "invalid event type")
+		assert.Equal(t, filenode.FileMode(0644), txn.OldMode, "invalid old mode")
+		assert.Equal(t, filenode.FileMode(0755), txn.Meta.Mode, "invalid new mode")
+	case <-time.After(5 * time.Second):
+		t.Fatal("chmod event not received")
+	}
+	node := tw.SearchByPath("fs-shadow-chmod/test.txt")
+	assert.Equal(t, "rwxr-xr-x", node.Meta.Mode.String(), "mode not updated")
+}
+
+func Test_LinuxWatcherHasher(t *testing.T) {
+	testRoot := filepath.Join(t.TempDir(), "fs-shadow-hasher")
+	_ = os.Mkdir(testRoot, os.ModePerm)
+	file := filepath.Join(testRoot, "test.txt")
+	_ = os.WriteFile(file, []byte("123456789"), 0644)
+
+	_, _, err := NewPathWatcher(testRoot, WithHasher("unknown"))
+	assert.NotEqual(t, nil, err, "unknown hasher accepted")
+
+	tw, _, err := NewPathWatcher(testRoot, WithHasher(utils.CRC32C))
+	assert.Equal(t, nil, err, "linux path watcher creation error")
+	defer tw.Stop()
+	node := tw.SearchByPath("fs-shadow-hasher/test.txt")
+	assert.Equal(t, utils.CRC32C, node.Meta.SumAlgo, "invalid sum algorithm")
+	assert.Equal(t, "e3069283", node.Meta.Sum, "invalid sum")
+}
+
+func Test_LinuxWatcherScanProgress(t *testing.T) {
+	testRoot := filepath.Join(t.TempDir(), "fs-shadow-scan")
+	_ = os.MkdirAll(filepath.Join(testRoot, "folder"), os.ModePerm)
+	_ = os.WriteFile(filepath.Join(testRoot, "folder", "test.txt"), []byte("test"), 0644)
+
+	tw, _, err := NewPathWatcher(testRoot, WithScanLimits(filenode.ScanLimits{ListWorkers: 1, HashWorkers: 1, MaxOpenFiles: 1}))
+	assert.Equal(t, nil, err, "linux path watcher creation error")
+	defer tw.Stop()
+	assert.NotNil(t, tw.SearchByPath("fs-shadow-scan/folder/test.txt"), "file not scanned")
+	assert.Equal(t, int64(2), tw.ScanProgress().DirsScanned(), "invalid scanned folder count")
+	assert.Equal(t, int64(1), tw.ScanProgress().FilesHashed(), "invalid hashed file count")
+	assert.Equal(t, int64(4), tw.ScanProgress().BytesHashed(), "invalid hashed byte count")
+}
+
+func Test_LinuxWatcherChunking(t *testing.T) {
+	testRoot := filepath.Join(t.TempDir(), "fs-shadow-chunks")
+	_ = os.Mkdir(testRoot, os.ModePerm)
+	data := make([]byte, 256<<10)
+	for i := range data {
+		data[i] = byte(i * 7919 >> 5)
+	}
+	file := filepath.Join(testRoot, "test.bin")
+	_ = os.WriteFile(file, data, 0644)
+	_ = os.WriteFile(filepath.Join(testRoot, "small.txt"), []byte("test"), 0644)
+
+	sizes := utils.ChunkSizes{Min: 1 << 10, Avg: 4 << 10, Max: 16 << 10}
+	_, _, err := NewPathWatcher(testRoot, WithChunking(utils.ChunkSizes{Min: 64, Avg: 32, Max: 128}))
+	assert.NotEqual(t, nil, err, "invalid chunk sizes accepted")
+
+	watcher, err := fsnotify.NewWatcher()
+	assert.Equal(t, nil, err, "watcher creation error")
+	defer watcher.Close()
+	path := connector.NewFSPath(testRoot)
+	root := filenode.FileNode{Name: path.Name(), Meta: filenode.MetaData{IsDir: true}}
+	root.SetOptions(filenode.Options{Chunks: sizes})
+	tw := TreeWatcher{FileTree: &root, ParentPath: path.ParentPath(), Path: path, Watcher: watcher}
+	_, err = tw.Create(path, nil)
+	assert.Equal(t, nil, err, "root node creation error")
+	node := tw.SearchByPath("fs-shadow-chunks/test.bin")
+	assert.NotEqual(t, 0, len(node.Chunks), "large file not chunked")
+	assert.Equal(t, 0, len(tw.SearchByPath("fs-shadow-chunks/small.txt").Chunks), "small file chunked")
+	restored, _ := json.Marshal(tw.FileTree)
+	oldChunks := node.Chunks
+
+	copy(data[100<<10:], "changed")
+	_ = os.WriteFile(file, data, 0644)
+	txn, err := tw.Handler(event.Event{FromPath: connector.NewFSPath(file), Type: event.Write})
+	assert.Equal(t, nil, err, "handler write error")
+	assert.NotNil(t, txn.ChunkDiff, "chunk diff missing")
+	assert.Equal(t, 1, len(txn.ChunkDiff.Added), "invalid added chunks")
+	assert.Equal(t, 1, len(txn.ChunkDiff.Removed), "invalid removed chunks")
+	assert.Equal(t, len(oldChunks), len(txn.Chunks), "invalid chunk count")
+	assert.Equal(t, txn.Chunks, tw.SearchByPath("fs-shadow-chunks/test.bin").Chunks, "manifest not updated")
+
+	// replaying the transaction updates the manifest of a restored tree
+	b, _ := txn.Encode()
+	decoded := EventTransaction{}
+	assert.Equal(t, nil, decoded.Decode(b), "decode error")
+	tree := filenode.FileNode{}
+	_ = json.Unmarshal(restored, &tree)
+	tree.Reindex()
+	assert.Equal(t, oldChunks, tree.SearchByUUID(txn.UUID).Chunks, "manifest not serialized")
+	assert.Equal(t, nil, ApplyTransaction(&tree, &decoded), "apply error")
+	assert.Equal(t, txn.Chunks, tree.SearchByUUID(txn.UUID).Chunks, "manifest not restored")
+}
+
+func Test_LinuxWatcherQuickSum(t *testing.T) {
+	testRoot := filepath.Join(t.TempDir(), "fs-shadow-quick")
+	_ = os.Mkdir(testRoot, os.ModePerm)
+	file := filepath.Join(testRoot, "large.bin")
+	_ = os.WriteFile(file, make([]byte, 1000), 0644)
+
+	_, _, err := NewPathWatcher(testRoot, WithQuickSum(utils.QuickSampling{Samples: 2}))
+	assert.NotEqual(t, nil, err, "invalid sampling accepted")
+
+	tw, _, err := NewPathWatcher(testRoot, WithQuickSum(utils.QuickSampling{Edge: 16, Samples: 2, Block: 8}))
+	assert.Equal(t, nil, err, "linux path watcher creation error")
+	defer tw.Stop()
+	<-tw.GetEvents()
+	assert.True(t, tw.SearchByPath("fs-shadow-quick/large.bin").Meta.WeakSum, "large file got a full sum")
+
+	count, err := tw.UpgradeSums()
+	assert.Equal(t, nil, err, "upgrade error")
+	assert.Equal(t, 1, count, "invalid upgraded sum count")
+	expected, _ := utils.FileSum(file)
+	select {
+	case txn := <-tw.GetEvents():
+		assert.Equal(t, event.SumUpdated, txn.Type, "invalid event type")
+		assert.Equal(t, expected, txn.Meta.Sum, "invalid upgraded sum")
+		assert.NotEqual(t, "", txn.PrevSum, "weak sum not reported")
+		assert.False(t, txn.Meta.WeakSum, "transaction has a weak sum")
+	case <-time.After(time.Second):
+		t.Fatal("upgrade transaction not received")
+	}
+
+	txn, err := tw.UpgradeSum(connector.NewFSPath(file))
+	assert.Equal(t, nil, err, "upgrade error")
+	assert.Nil(t, txn, "full sum upgraded")
+}
+
+func Test_LinuxWatcherUpgradeSumsStop(t *testing.T) {
+	testRoot := filepath.Join(t.TempDir(), "fs-shadow-upgrade-stop")
+	_ = os.Mkdir(testRoot, os.ModePerm)
+	for i := 0; i < 5; i++ {
+		_ = os.WriteFile(filepath.Join(testRoot, fmt.Sprintf("large-%d.bin", i)), make([]byte, 1000), 0644)
+	}
+
+	tw, _, err := NewPathWatcher(testRoot, WithQuickSum(utils.QuickSampling{Edge: 16, Samples: 2, Block: 8}),
+		WithChannelSizes(1, 1), WithDrainTimeout(100*time.Millisecond))
+	assert.Equal(t, nil, err, "linux path watcher creation error")
+
+	// the root transaction fills the events, so the upgrades wait for the consumer while the watcher stops
+	upgraded := make(chan error, 1)
+	go func() {
+		_, err := tw.UpgradeSums()
+		upgraded <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, ErrDrainTimeout, tw.Stop(), "stop didn't wait for the upgrade")
+	for range tw.GetEvents() {
+	}
+	err = <-upgraded
+	assert.True(t, err == nil || err == ErrStopped, "invalid upgrade error: %v", err)
+	_, err = tw.UpgradeSums()
+	assert.Equal(t, ErrStopped, err, "upgraded after stop")
+}
+
+func Test_LinuxWatcherDeferredSums(t *testing.T) {
+	testRoot := filepath.Join(t.TempDir(), "fs-shadow-deferred")
+	_ = os.Mkdir(testRoot, os.ModePerm)
+	file := filepath.Join(testRoot, "test.txt")
+	_ = os.WriteFile(file, []byte("test"), 0644)
+
+	tw, txn, err := NewPathWatcher(testRoot, WithDeferredSums(1))
+	assert.Equal(t, nil, err, "linux path watcher creation error")
+	defer tw.Stop()
+	assert.Equal(t, event.Create, txn.Type, "invalid event type")
+	<-tw.GetEvents()
+
+	// waits for the SumUpdated transaction of the file, the transactions before it are returned too
+	sumUpdated := func(expected string) []*EventTransaction {
+		var txns []*EventTransaction
+		for {
+			select {
+			case txn := <-tw.GetEvents():
+				txns = append(txns, txn)
+				if txn.Type == event.SumUpdated && txn.Meta.Sum == expected {
+					return txns
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("sum update not received")
+				return nil
+			}
+		}
+	}
+	expected, _ := utils.FileSum(file)
+	sumUpdated(expected)
+	node := tw.SearchByPath("fs-shadow-deferred/test.txt")
+	assert.False(t, node.Meta.SumPending, "sum still pending")
+	assert.Equal(t, expected, node.Meta.Sum, "sum not stored")
+
+	_ = os.WriteFile(file, []byte("changed"), 0644)
+	expected, _ = utils.FileSum(file)
+	txns := sumUpdated(expected)
+	assert.Equal(t, event.Write, txns[0].Type, "invalid event type")
+	assert.True(t, txns[0].Meta.SumPending, "write transaction has a sum")
+	assert.Equal(t, node.UUID, txns[len(txns)-1].UUID, "invalid sum update uuid")
+}
+
+func Test_LinuxWatcherOptions(t *testing.T) {
+	testRoot := filepath.Join(t.TempDir(), "fs-shadow-options")
+	_ = os.MkdirAll(filepath.Join(testRoot, "node_modules", "pkg"), os.ModePerm)
+	_ = os.MkdirAll(filepath.Join(testRoot, "a", "b", "c"), os.ModePerm)
+	_ = os.WriteFile(filepath.Join(testRoot, "a", "b", "c", "deep.txt"), []byte("deep"), 0644)
+	_ = os.WriteFile(filepath.Join(testRoot, "moved.txt"), []byte("moved"), 0644)
+
+	_, _, err := NewPathWatcher(testRoot, WithExclude("["))
+	assert.NotEqual(t, nil, err, "malformed exclude pattern accepted")
+	_, _, err = NewPathWatcher(testRoot, WithTickInterval(0))
+	assert.NotEqual(t, nil, err, "zero tick interval accepted")
+
+	tw, _, err := NewPathWatcher(testRoot,
+		WithTickInterval(100*time.Millisecond),
+		WithChannelSizes(1, 1),
+		WithExclude("**/node_modules", "**/*.log"),
+		WithMaxDepth(2),
+		WithLogger(log.New()),
+	)
+	assert.Equal(t, nil, err, "linux path watcher creation error")
+	defer tw.Stop()
+	assert.Equal(t, 1, cap(tw.Events), "invalid events size")
+	<-tw.GetEvents()
+
+	assert.Nil(t, tw.SearchByPath("fs-shadow-options/node_modules"), "excluded folder scanned")
+	assert.NotNil(t, tw.SearchByPath("fs-shadow-options/a/b"), "folder at max depth not scanned")
+	assert.Nil(t, tw.SearchByPath("fs-shadow-options/a/b/c"), "folder below max depth scanned")
+
+	_ = os.Mkdir(filepath.Join(testRoot, "debug.log"), os.ModePerm)
+	_ = os.Mkdir(filepath.Join(testRoot, "docs"), os.ModePerm)
+	start := time.Now()
+	select {
+	case txn := <-tw.GetEvents():
+		assert.Equal(t, event.Create, txn.Type, "invalid event type")
+		assert.Equal(t, "docs", txn.Name, "excluded folder reported")
+	case <-time.After(5 * time.Second):
+		t.Fatal("create not received")
+	}
+	assert.Less(t, time.Since(start), 2*time.Second, "tick interval not applied")
+	assert.Nil(t, tw.SearchByPath("fs-shadow-options/debug.log"), "excluded folder added")
+
+	// a move out of the tree is a remove
+	_ = os.Rename(filepath.Join(testRoot, "moved.txt"), filepath.Join(testRoot, "node_modules", "moved.txt"))
+	select {
+	case txn := <-tw.GetEvents():
+		assert.Equal(t, event.Remove, txn.Type, "invalid event type")
+		assert.Equal(t, "moved.txt", txn.Name, "invalid event name")
+	case <-time.After(5 * time.Second):
+		t.Fatal("remove not received")
+	}
+}
+
+func Test_LinuxWatcherStop(t *testing.T) {
+	testRoot := filepath.Join(t.TempDir(), "fs-shadow-stop")
+	_ = os.Mkdir(testRoot, os.ModePerm)
+	waitEvents := func(tw *TreeWatcher) {
+		for i := 0; i < 100 && tw.EventManager.StackLength() == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// the events gathered before Stop are sent before the channels are closed
+	tw, _, err := NewPathWatcher(testRoot, WithTickInterval(time.Hour))
+	assert.Equal(t, nil, err, "linux path watcher creation error")
+	<-tw.GetEvents()
+	_ = os.Mkdir(filepath.Join(testRoot, "folder"), os.ModePerm)
+	waitEvents(tw)
+	assert.Equal(t, nil, tw.Stop(), "stop error")
+	txn, ok := <-tw.GetEvents()
+	assert.True(t, ok, "events closed before the drain")
+	assert.Equal(t, event.Create, txn.Type, "invalid event type")
+	assert.Equal(t, "folder", txn.Name, "invalid event name")
+	_, ok = <-tw.GetEvents()
+	assert.False(t, ok, "events not closed")
+	_, ok = <-tw.GetErrors()
+	assert.False(t, ok, "errors not closed")
+	assert.Equal(t, nil, tw.Close(), "second stop error")
+	assert.Equal(t, ErrStopped, tw.Start(context.Background()), "stopped watcher started")
+
+	// a drain that can't send times out, the channels are closed once it is read
+	tw, _, err = NewPathWatcher(testRoot, WithTickInterval(time.Hour), WithChannelSizes(1, 1),
+		WithDrainTimeout(100*time.Millisecond))
+	assert.Equal(t, nil, err, "linux path watcher creation error")
+	_ = os.Mkdir(filepath.Join(testRoot, "other"), os.ModePerm)
+	waitEvents(tw)
+	assert.Equal(t, ErrDrainTimeout, tw.Stop(), "drain did not time out")
+	var txns []*EventTransaction
+	for txn := range tw.GetEvents() {
+		txns = append(txns, txn)
+	}
+	assert.Equal(t, 2, len(txns), "invalid transaction count")
+
+	// cancelling the context of Start stops the watcher
+	ctx, cancel := context.WithCancel(context.Background())
+	tw, _, err = NewPathWatcher(testRoot)
+	assert.Equal(t, nil, err, "linux path watcher creation error")
+	assert.Equal(t, nil, tw.Start(ctx), "start error")
+	<-tw.GetEvents()
+	cancel()
+	select {
+	case _, ok = <-tw.GetEvents():
+		assert.False(t, ok, "events not closed")
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher not stopped")
+	}
+}
+
+func Test_LinuxWatcherOverflow(t *testing.T) {
+	testRoot := filepath.Join(t.TempDir(), "fs-shadow-overflow")
+	_ = os.Mkdir(testRoot, os.ModePerm)
+
+	tw, _, err := NewPathWatcher(testRoot, WithTickInterval(50*time.Millisecond), WithChannelSizes(1, 1),
+		WithOverflowPolicy(OverflowDropNewest))
+	assert.Equal(t, nil, err, "linux path watcher creation error")
+	defer tw.Stop()
+
+	// nothing reads the events, the watcher keeps up with the folders anyway
+	for i := 0; i < 10; i++ {
+		_ = os.Mkdir(filepath.Join(testRoot, fmt.Sprintf("folder-%d", i)), os.ModePerm)
+	}
+	for i := 0; i < 100 && tw.SearchByPath("fs-shadow-overflow/folder-9") == nil; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.NotNil(t, tw.SearchByPath("fs-shadow-overflow/folder-9"), "watcher blocked by the consumer")
+	assert.Less(t, int64(0), tw.Overflows(), "no overflow counted")
+
+	var types []event.Type
+	for len(types) < 3 {
+		select {
+		case txn := <-tw.GetEvents():
+			types = append(types, txn.Type)
+		case <-time.After(time.Second):
+			t.Fatal("transactions not delivered")
+		}
+	}
+	assert.Equal(t, []event.Type{event.Create, event.Create, event.Overflow}, types, "overflow not reported")
+}
+
+func treePaths(root *filenode.FileNode) []string {
+	var paths []string
+	_ = filenode.Walk(root, func(relPath string, n *filenode.FileNode) error {
+		paths = append(paths, relPath)
+		return nil
+	})
+	return paths
+}
+
+func Test_LinuxWatcherScanTransactions(t *testing.T) {
+	testRoot := filepath.Join(t.TempDir(), "fs-shadow-scan")
+	_ = os.MkdirAll(filepath.Join(testRoot, "a", "b"), os.ModePerm)
+	_ = os.WriteFile(filepath.Join(testRoot, "a", "b", "file.txt"), []byte("scan"), 0644)
+	_ = os.WriteFile(filepath.Join(testRoot, "top.txt"), []byte("top"), 0644)
+
+	tw, _, err := NewPathWatcher(testRoot, WithTickInterval(50*time.Millisecond), WithScanTransactions())
+	assert.Equal(t, nil, err, "linux path watcher creation error")
+
+	var tbl [][]byte
+	var txns []*EventTransaction
+	for len(txns) == 0 || txns[len(txns)-1].Type != event.ScanComplete {
+		select {
+		case txn := <-tw.GetEvents():
+			txns = append(txns, txn)
+		case <-time.After(time.Second):
+			t.Fatal("scan transactions not delivered")
+		}
+	}
+	assert.Equal(t, 6, len(txns), "invalid number of scan transactions")
+	seen := map[string]bool{}
+	for _, txn := range txns {
+		if txn.Type == event.Create {
+			assert.True(t, txn.ParentUUID == "" || seen[txn.ParentUUID], "child sent before its parent")
+			seen[txn.UUID] = true
+		}
+		b, _ := txn.Encode()
+		tbl = append(tbl, b)
+	}
+
+	// the folders below a new one are only found by its scan
+	_ = os.MkdirAll(filepath.Join(testRoot, "later", "sub", "deep"), os.ModePerm)
+	for i := 0; i < 100 && tw.SearchByPath("fs-shadow-scan/later/sub/deep") == nil; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equal(t, nil, tw.Stop(), "stop error")
+	for txn := range tw.GetEvents() {
+		b, _ := txn.Encode()
+		tbl = append(tbl, b)
+	}
+
+	tree, err := CreateFileNodeWithTransactions(tbl)
+	assert.Equal(t, nil, err, "restore error")
+	assert.Equal(t, treePaths(tw.Snapshot()), treePaths(tree), "tree not rebuilt from the transactions")
+}
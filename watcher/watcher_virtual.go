@@ -1,8 +1,8 @@
 package watcher
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/ayhanozemre/fs-shadow/event"
 	"github.com/ayhanozemre/fs-shadow/filenode"
@@ -17,6 +17,9 @@ type VirtualTree struct {
 	ParentPath connector.Path
 
 	sync.Mutex
+	logger log.FieldLogger
+	// seq is the Seq of the last transaction the Handler returned.
+	seq uint64
 }
 
 func (tw *VirtualTree) GetEvents() <-chan *EventTransaction {
@@ -28,18 +31,45 @@ func (tw *VirtualTree) GetErrors() <-chan error {
 }
 
 func (tw *VirtualTree) SearchByPath(path string) *filenode.FileNode {
+	tw.Lock()
+	defer tw.Unlock()
 	return tw.FileTree.Search(path)
 }
 
 func (tw *VirtualTree) SearchByUUID(uuid string) *filenode.FileNode {
+	tw.Lock()
+	defer tw.Unlock()
 	return tw.FileTree.SearchByUUID(uuid)
 }
 
+func (tw *VirtualTree) Query(p filenode.Predicate) []filenode.Match {
+	tw.Lock()
+	defer tw.Unlock()
+	return tw.FileTree.Query(p)
+}
+
+// Snapshot returns a read-only view of the tree that can be used without holding the lock of the watcher.
+func (tw *VirtualTree) Snapshot() *filenode.FileNode {
+	tw.Lock()
+	defer tw.Unlock()
+	return tw.FileTree.Snapshot()
+}
+
+// Overflows is always 0, virtual trees send no transactions.
+func (tw *VirtualTree) Overflows() int64 {
+	return 0
+}
+
+// ScanProgress is always nil, virtual trees are never scanned.
+func (tw *VirtualTree) ScanProgress() *filenode.ScanProgress {
+	return nil
+}
+
 func (tw *VirtualTree) PrintTree(label string) {
 	bannerStartLine := fmt.Sprintf("----------------%s----------------", label)
 	bannerEndLine := fmt.Sprintf("----------------%s----------------\n\n", label)
 	fmt.Println(bannerStartLine)
-	a, _ := json.MarshalIndent(tw.FileTree, "", "  ")
+	a, _ := json.MarshalIndent(tw.Snapshot(), "", "  ")
 	fmt.Println(string(a))
 	fmt.Println(bannerEndLine)
 }
@@ -50,8 +80,7 @@ func (tw *VirtualTree) Create(path connector.Path, extra *filenode.ExtraPayload)
 	if err != nil {
 		return nil, err
 	}
-	node.UpdateWithExtra(*extra)
-	return node, nil
+	return node.UpdateWithExtra(*extra), nil
 }
 
 func (tw *VirtualTree) Remove(path connector.Path) (*filenode.FileNode, error) {
@@ -77,19 +106,44 @@ func (tw *VirtualTree) Move(fromPath connector.Path, toPath connector.Path) (*fi
 }
 
 func (tw *VirtualTree) Write(path connector.Path) (*filenode.FileNode, error) {
+	eventPath := path.ExcludePath(tw.ParentPath)
+	node := tw.FileTree.Search(eventPath.String())
+	if node == nil {
+		return nil, &filenode.OpError{Op: "write", Path: eventPath.String(), Err: filenode.ErrNotFound}
+	}
+	return node, nil
+}
+
+func (tw *VirtualTree) Chmod(path connector.Path) (*filenode.FileNode, error) {
+	return tw.Write(path)
+}
+
+// UpgradeSum gives no transaction, virtual trees can't read files. Their weak sums are upgraded by the transactions
+// of the watcher that reads them.
+func (tw *VirtualTree) UpgradeSum(path connector.Path) (*EventTransaction, error) {
 	return nil, nil
 }
 
-func (tw *VirtualTree) Stop() {
-	log.Debug("close not implemented ")
+func (tw *VirtualTree) UpgradeSums() (int, error) {
+	return 0, nil
 }
 
-func (tw *VirtualTree) Start() {
-	log.Debug("start not implemented ")
+func (tw *VirtualTree) Stop() error {
+	tw.logger.Debug("close not implemented ")
+	return nil
+}
+
+func (tw *VirtualTree) Close() error {
+	return tw.Stop()
+}
+
+func (tw *VirtualTree) Start(ctx context.Context) error {
+	tw.logger.Debug("start not implemented ")
+	return nil
 }
 
 func (tw *VirtualTree) Watch() {
-	log.Debug("watch not implemented ")
+	tw.logger.Debug("watch not implemented ")
 }
 
 func (tw *VirtualTree) Handler(e event.Event, extras ...*filenode.ExtraPayload) (*EventTransaction, error) {
@@ -98,6 +152,13 @@ func (tw *VirtualTree) Handler(e event.Event, extras ...*filenode.ExtraPayload)
 	var err error
 	var node *filenode.FileNode
 	var extra *filenode.ExtraPayload
+	var oldMeta filenode.MetaData
+
+	e, ok := filterEvent(tw.FileTree.Options(), tw.Path, e)
+	if !ok {
+		return nil, nil
+	}
+	before := priorOf(tw.FileTree, e.FromPath.ExcludePath(tw.ParentPath))
 
 	if len(extras) > 0 {
 		extra = extras[0]
@@ -109,6 +170,18 @@ func (tw *VirtualTree) Handler(e event.Event, extras ...*filenode.ExtraPayload)
 		break
 	case event.Write:
 		node, err = tw.Write(e.FromPath)
+		if err == nil && extra != nil {
+			node = node.UpdateWithExtra(*extra)
+		}
+		break
+	case event.Chmod:
+		node, err = tw.Chmod(e.FromPath)
+		if err == nil {
+			oldMeta = node.Meta
+			if extra != nil {
+				node = node.UpdateWithExtra(*extra)
+			}
+		}
 		break
 	case event.Create:
 		node, err = tw.Create(e.FromPath, extra)
@@ -120,23 +193,38 @@ func (tw *VirtualTree) Handler(e event.Event, extras ...*filenode.ExtraPayload)
 		node, err = tw.Move(e.FromPath, e.ToPath)
 		break
 	default:
-		errorMsg := fmt.Sprintf("unhandled event: %s", e.String())
-		err = errors.New(errorMsg)
+		err = unhandled(e, e.FromPath.ExcludePath(tw.ParentPath))
 		break
 	}
 	if err != nil {
 		return nil, err
 	}
 	et := makeEventTransaction(*node, e.Type)
+	before.fill(et, e)
+	tw.seq++
+	et.Seq = tw.seq
+	if e.Type == event.Chmod {
+		et.OldMode = oldMeta.FileMode()
+	}
 	return et, err
 }
 
 func (tw *VirtualTree) Restore(tree *filenode.FileNode) {
+	tw.Lock()
+	defer tw.Unlock()
+	tree.Reindex()
+	tree.SetOptions(tw.FileTree.Options())
 	tw.FileTree = tree
 }
 
-func NewVirtualPathWatcher(virtualPath string, extra *filenode.ExtraPayload) (*VirtualTree, *EventTransaction, error) {
+// NewVirtualPathWatcher creates the tree of a virtual path, which is only changed by the events passed to the Handler.
+// It takes the options of NewPathWatcher, the ones about reading files, the channels and the tick have no effect.
+func NewVirtualPathWatcher(virtualPath string, extra *filenode.ExtraPayload, opts ...Option) (*VirtualTree, *EventTransaction, error) {
 	path := connector.NewVirtualPath(virtualPath, true)
+	cfg := newConfig(opts)
+	if err := cfg.validate(); err != nil {
+		return nil, nil, err
+	}
 
 	root := filenode.FileNode{
 		Name: path.Name(),
@@ -144,11 +232,13 @@ func NewVirtualPathWatcher(virtualPath string, extra *filenode.ExtraPayload) (*V
 			IsDir: true,
 		},
 	}
+	root.SetOptions(cfg.treeOptions())
 
 	tw := VirtualTree{
 		FileTree:   &root,
 		ParentPath: path.ParentPath(),
 		Path:       path,
+		logger:     cfg.logger,
 	}
 	e := event.Event{FromPath: path, Type: event.Create}
 
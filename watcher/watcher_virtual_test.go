@@ -1,6 +1,7 @@
 package watcher
 
 import (
+	"errors"
 	"github.com/ayhanozemre/fs-shadow/event"
 	"github.com/ayhanozemre/fs-shadow/filenode"
 	connector "github.com/ayhanozemre/fs-shadow/path"
@@ -90,8 +91,26 @@ func Test_VirtualWatcherFunctionality(t *testing.T) {
 
 	// Remove
 	_, err = tw.Remove(renameFilePath)
+	assert.True(t, errors.Is(err, filenode.ErrNotFound), "moved file node removed")
+	movedFilePath := connector.NewVirtualPath(filepath.Join(testRoot, "folder", "file-rename.txt"), false)
+	_, err = tw.Remove(movedFilePath)
 	assert.Equal(t, nil, err, "file node remove error")
-	assert.Equal(t, 1, len(root.Subs), "file node not removed")
+	assert.Equal(t, 1, len(root.Subs), "file node remove error")
+	assert.Equal(t, 0, len(root.Subs[0].Subs), "file node not removed")
+
+	// Unhandled
+	_, err = tw.Handler(event.Event{FromPath: newFolder, Type: event.Overflow}, nil)
+	var opErr *filenode.OpError
+	assert.True(t, errors.Is(err, ErrUnhandledEvent), "invalid error: %v", err)
+	assert.True(t, errors.As(err, &opErr) && opErr.Path == "fs-shadow/folder", "invalid op error: %v", err)
+}
+
+func Test_WatchError(t *testing.T) {
+	cause := errors.New("fsnotify failure")
+	err := watchFailed("rename", connector.NewVirtualPath("fs-shadow/folder", true), cause)
+	assert.True(t, errors.Is(err, ErrWatchList), "invalid error: %v", err)
+	assert.True(t, errors.Is(err, cause), "cause not unwrapped: %v", err)
+	assert.Equal(t, "rename fs-shadow/folder: watch list not updated: fsnotify failure", err.Error(), "invalid message")
 }
 
 func Test_Restore(t *testing.T) {
@@ -113,3 +132,150 @@ func TestVirtualTree_SearchByPath(t *testing.T) {
 	assert.NotNil(t, node, "search by name error")
 
 }
+
+func Test_VirtualWatcherStats(t *testing.T) {
+	root := "fs-shadow"
+	tw, _, err := NewVirtualPathWatcher(root, &filenode.ExtraPayload{UUID: uuid.NewString(), IsDir: true})
+	assert.Equal(t, nil, err, "watcher creation error")
+
+	folder := connector.NewVirtualPath(filepath.Join(root, "folder"), true)
+	file := connector.NewVirtualPath(filepath.Join(root, "file.txt"), false)
+	fileUUID := uuid.NewString()
+	_, err = tw.Handler(event.Event{FromPath: folder, Type: event.Create}, &filenode.ExtraPayload{UUID: uuid.NewString(), IsDir: true})
+	assert.Equal(t, nil, err, "folder creation error")
+	_, err = tw.Handler(event.Event{FromPath: file, Type: event.Create}, &filenode.ExtraPayload{UUID: fileUUID, Size: 10, ModifiedAt: 100})
+	assert.Equal(t, nil, err, "file creation error")
+	assert.Equal(t, filenode.Stats{TotalBytes: 10, FileCount: 1, DirCount: 1, NewestModifiedAt: 100}, tw.FileTree.Stats, "create:invalid stats")
+
+	_, err = tw.Handler(event.Event{FromPath: file, Type: event.Write}, &filenode.ExtraPayload{UUID: fileUUID, Size: 30, ModifiedAt: 200})
+	assert.Equal(t, nil, err, "file write error")
+	assert.Equal(t, filenode.Stats{TotalBytes: 30, FileCount: 1, DirCount: 1, NewestModifiedAt: 200}, tw.FileTree.Stats, "write:invalid stats")
+
+	_, err = tw.Handler(event.Event{FromPath: file, ToPath: folder, Type: event.Move}, nil)
+	assert.Equal(t, nil, err, "file move error")
+	assert.Equal(t, int64(30), tw.SearchByPath("fs-shadow/folder").Stats.TotalBytes, "move:invalid folder stats")
+	assert.Equal(t, int64(30), tw.FileTree.Stats.TotalBytes, "move:invalid root stats")
+
+	_, err = tw.Handler(event.Event{FromPath: connector.NewVirtualPath(filepath.Join(root, "folder", "file.txt"), false), Type: event.Remove}, nil)
+	assert.Equal(t, nil, err, "file remove error")
+	assert.Equal(t, filenode.Stats{DirCount: 1}, tw.FileTree.Stats, "remove:invalid stats")
+}
+
+func Test_VirtualWatcherSnapshot(t *testing.T) {
+	root := "fs-shadow"
+	tw, _, err := NewVirtualPathWatcher(root, &filenode.ExtraPayload{UUID: uuid.NewString(), IsDir: true})
+	assert.Equal(t, nil, err, "watcher creation error")
+	file := connector.NewVirtualPath(filepath.Join(root, "file.txt"), false)
+	_, err = tw.Handler(event.Event{FromPath: file, Type: event.Create}, &filenode.ExtraPayload{UUID: uuid.NewString()})
+	assert.Equal(t, nil, err, "file creation error")
+
+	snap := tw.Snapshot()
+	_, err = tw.Handler(event.Event{FromPath: file, Type: event.Remove}, nil)
+	assert.Equal(t, nil, err, "file remove error")
+	assert.Nil(t, tw.SearchByPath("fs-shadow/file.txt"), "file not removed")
+	assert.NotNil(t, snap.Search("fs-shadow/file.txt"), "snapshot changed")
+}
+
+func Test_VirtualWatcherChmod(t *testing.T) {
+	root := "fs-shadow"
+	tw, _, err := NewVirtualPathWatcher(root, &filenode.ExtraPayload{UUID: uuid.NewString(), IsDir: true})
+	assert.Equal(t, nil, err, "watcher creation error")
+	file := connector.NewVirtualPath(filepath.Join(root, "file.txt"), false)
+	fileUUID := uuid.NewString()
+	_, err = tw.Handler(event.Event{FromPath: file, Type: event.Create}, &filenode.ExtraPayload{UUID: fileUUID, Mode: 0644})
+	assert.Equal(t, nil, err, "file creation error")
+
+	txn, err := tw.Handler(event.Event{FromPath: file, Type: event.Chmod}, &filenode.ExtraPayload{UUID: fileUUID, Mode: 0600})
+	assert.Equal(t, nil, err, "file chmod error")
+	assert.Equal(t, event.Chmod, txn.Type, "invalid event type")
+	assert.Equal(t, filenode.FileMode(0644), txn.OldMode, "invalid old mode")
+	assert.Equal(t, filenode.FileMode(0600), tw.SearchByUUID(fileUUID).Meta.Mode, "mode not updated")
+
+	b, err := txn.Encode()
+	assert.Equal(t, nil, err, "encode error")
+	decoded := EventTransaction{}
+	assert.Equal(t, nil, decoded.Decode(b), "decode error")
+	assert.Equal(t, *txn, decoded, "transaction changed in encoding")
+}
+
+func Test_VirtualWatcherOptions(t *testing.T) {
+	root := "fs-shadow"
+	_, _, err := NewVirtualWatcher(root, &filenode.ExtraPayload{}, WithHasher("unknown"))
+	assert.NotEqual(t, nil, err, "unknown hasher accepted")
+
+	tw, _, err := NewVirtualPathWatcher(root, &filenode.ExtraPayload{UUID: uuid.NewString()},
+		WithExclude("**/.git"), WithMaxDepth(1))
+	assert.Equal(t, nil, err, "watcher creation error")
+
+	create := func(p string) (*EventTransaction, error) {
+		e := event.Event{FromPath: connector.NewVirtualPath(filepath.Join(root, p), true), Type: event.Create}
+		return tw.Handler(e, &filenode.ExtraPayload{UUID: uuid.NewString()})
+	}
+	txn, err := create(".git")
+	assert.Equal(t, nil, err, "excluded create error")
+	assert.Nil(t, txn, "excluded folder created")
+	txn, err = create("docs")
+	assert.Equal(t, nil, err, "folder creation error")
+	assert.Equal(t, "docs", txn.Name, "invalid create name")
+	txn, err = create("docs/deep")
+	assert.Equal(t, nil, err, "deep create error")
+	assert.Nil(t, txn, "folder below max depth created")
+
+	// a move into an excluded folder removes the node
+	e := event.Event{
+		FromPath: connector.NewVirtualPath(filepath.Join(root, "docs"), true),
+		ToPath:   connector.NewVirtualPath(filepath.Join(root, ".git"), true),
+		Type:     event.Rename,
+	}
+	txn, err = tw.Handler(e)
+	assert.Equal(t, nil, err, "rename error")
+	assert.Equal(t, event.Remove, txn.Type, "invalid event type")
+	assert.Equal(t, 0, len(tw.FileTree.Subs), "file node not removed")
+}
+
+func Test_VirtualWatcherTransactionFields(t *testing.T) {
+	root := "fs-shadow"
+	tw, rootTxn, err := NewVirtualPathWatcher(root, &filenode.ExtraPayload{UUID: uuid.NewString()})
+	assert.Equal(t, nil, err, "watcher creation error")
+	assert.Equal(t, uint64(1), rootTxn.Seq, "invalid root sequence number")
+	assert.Equal(t, root, rootTxn.Path, "invalid root path")
+
+	handle := func(op event.Type, from string, to string, isDir bool, extra *filenode.ExtraPayload) (*EventTransaction, error) {
+		e := event.Event{FromPath: connector.NewVirtualPath(filepath.Join(root, from), isDir), Type: op}
+		if to != "" {
+			e.ToPath = connector.NewVirtualPath(filepath.Join(root, to), isDir)
+		}
+		if extra == nil {
+			return tw.Handler(e)
+		}
+		return tw.Handler(e, extra)
+	}
+	folder, err := handle(event.Create, "folder", "", true, &filenode.ExtraPayload{UUID: uuid.NewString(), IsDir: true})
+	assert.Equal(t, nil, err, "folder creation error")
+	fileUUID := uuid.NewString()
+	file, err := handle(event.Create, "file.txt", "", false, &filenode.ExtraPayload{UUID: fileUUID, Sum: "one"})
+	assert.Equal(t, nil, err, "file creation error")
+	assert.Equal(t, filepath.Join(root, "file.txt"), file.Path, "invalid create path")
+
+	txn, err := handle(event.Write, "file.txt", "", false, &filenode.ExtraPayload{UUID: fileUUID, Sum: "two"})
+	assert.Equal(t, nil, err, "file write error")
+	assert.Equal(t, "one", txn.PrevSum, "invalid previous sum")
+
+	txn, err = handle(event.Rename, "file.txt", "file-rename.txt", false, nil)
+	assert.Equal(t, nil, err, "file rename error")
+	assert.Equal(t, filepath.Join(root, "file.txt"), txn.OldPath, "invalid old path")
+	assert.Equal(t, filepath.Join(root, "file-rename.txt"), txn.Path, "invalid rename path")
+	assert.Equal(t, rootTxn.UUID, txn.OldParentUUID, "invalid old parent")
+
+	txn, err = handle(event.Move, "file-rename.txt", "folder", false, nil)
+	assert.Equal(t, nil, err, "file move error")
+	assert.Equal(t, filepath.Join(root, "file-rename.txt"), txn.OldPath, "invalid old path")
+	assert.Equal(t, filepath.Join(root, "folder", "file-rename.txt"), txn.Path, "invalid move path")
+	assert.Equal(t, rootTxn.UUID, txn.OldParentUUID, "invalid old parent")
+	assert.Equal(t, folder.UUID, txn.ParentUUID, "invalid new parent")
+
+	txn, err = handle(event.Remove, "folder/file-rename.txt", "", false, nil)
+	assert.Equal(t, nil, err, "file remove error")
+	assert.Equal(t, filepath.Join(root, "folder", "file-rename.txt"), txn.Path, "invalid remove path")
+	assert.Equal(t, uint64(7), txn.Seq, "invalid sequence number")
+}
@@ -3,13 +3,14 @@ package watcher
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/ayhanozemre/fs-shadow/event"
 	"github.com/ayhanozemre/fs-shadow/filenode"
 	"github.com/ayhanozemre/fs-shadow/path"
+	"github.com/ayhanozemre/fs-shadow/utils"
 	"github.com/fsnotify/fsnotify"
 	log "github.com/sirupsen/logrus"
+	"os"
 	"sync"
 	"time"
 )
@@ -28,6 +29,25 @@ type TreeWatcher struct {
 
 	sync.Mutex
 	EventManager event.EventHandler
+
+	// progress counts the work of the scans, it is shared with the options of the tree.
+	progress  *filenode.ScanProgress
+	hashCache *utils.HashCache
+	// sums queues the nodes whose sums were deferred, it is nil when sums are computed right away.
+	sums *sumQueue
+	// tick is the interval the events gathered by the EventManager are processed at.
+	tick   time.Duration
+	logger log.FieldLogger
+	life   lifecycle
+	// stopping is done when the watcher is being stopped, Watch returns then.
+	stopping <-chan struct{}
+	// outbox sends the transactions and errors, see WithOverflowPolicy.
+	outbox *outbox
+	// workers counts the running sum workers, the channels are closed once they return.
+	workers    sync.WaitGroup
+	sumWorkers int
+	// scanTxns sends the nodes found by the scans as Create transactions, see WithScanTransactions.
+	scanTxns bool
 }
 
 func (tw *TreeWatcher) GetEvents() <-chan *EventTransaction {
@@ -39,32 +59,60 @@ func (tw *TreeWatcher) GetErrors() <-chan error {
 }
 
 func (tw *TreeWatcher) Restore(tree *filenode.FileNode) {
+	tw.Lock()
+	defer tw.Unlock()
+	tree.Reindex()
+	tree.SetOptions(tw.FileTree.Options())
 	tw.FileTree = tree
+	tw.sums.push(pendingSums(tree)...)
 }
 
 func (tw *TreeWatcher) SearchByPath(path string) *filenode.FileNode {
+	tw.Lock()
+	defer tw.Unlock()
 	return tw.FileTree.Search(path)
 }
 
 func (tw *TreeWatcher) SearchByUUID(uuid string) *filenode.FileNode {
+	tw.Lock()
+	defer tw.Unlock()
 	return tw.FileTree.SearchByUUID(uuid)
 }
 
+func (tw *TreeWatcher) Query(p filenode.Predicate) []filenode.Match {
+	tw.Lock()
+	defer tw.Unlock()
+	return tw.FileTree.Query(p)
+}
+
+// Snapshot returns a read-only view of the tree that can be used without holding the lock of the watcher.
+func (tw *TreeWatcher) Snapshot() *filenode.FileNode {
+	tw.Lock()
+	defer tw.Unlock()
+	return tw.FileTree.Snapshot()
+}
+
+func (tw *TreeWatcher) Overflows() int64 {
+	return tw.outbox.Overflows()
+}
+
+// ScanProgress returns the counters of the scans, they can be read while a scan holds the lock of the watcher.
+func (tw *TreeWatcher) ScanProgress() *filenode.ScanProgress {
+	return tw.progress
+}
+
 func (tw *TreeWatcher) PrintTree(label string) {
 	bannerStartLine := fmt.Sprintf("----------------%s-----------------------", label)
 	bannerEndLine := fmt.Sprintf("----------------%s-----------------------\n\n", label)
 	fmt.Println(bannerStartLine)
 	//a, _ := json.Marshal(tw.FileTree)
-	a, _ := json.MarshalIndent(tw.FileTree, "", "  ")
+	a, _ := json.MarshalIndent(tw.Snapshot(), "", "  ")
 	fmt.Println(string(a))
 	fmt.Println(bannerEndLine)
 }
 
-func (tw *TreeWatcher) Close() {
-	err := tw.Watcher.Close()
-	if err != nil {
-		log.Error(err)
-	}
+func (tw *TreeWatcher) Close() error {
+	return tw.Stop()
 }
 
 func (tw *TreeWatcher) Remove(path connector.Path) (*filenode.FileNode, error) {
@@ -76,7 +124,7 @@ func (tw *TreeWatcher) Remove(path connector.Path) (*filenode.FileNode, error) {
 
 	err = tw.removeWatcherPath(path.String())
 	if err != nil {
-		return nil, errors.New("path not deleted in watchlist")
+		return nil, watchFailed("remove", eventPath, err)
 	}
 
 	return node, err
@@ -99,9 +147,42 @@ func (tw *TreeWatcher) Write(path connector.Path) (*filenode.FileNode, error) {
 	return nil, nil
 }
 
+// Chmod refreshes the permission, ownership and timestamps of the node, the content isn't read again.
+func (tw *TreeWatcher) Chmod(path connector.Path) (*filenode.FileNode, error) {
+	return tw.FileTree.UpdateAttrs(path.ExcludePath(tw.ParentPath), path)
+}
+
+// UpgradeSum replaces the weak sum of the file at path with a full one, see filenode.MetaData.WeakSum. The change is
+// returned as a SumUpdated transaction, a file that already had a full sum gives none. The file is read without the
+// lock of the watcher.
+func (tw *TreeWatcher) UpgradeSum(path connector.Path) (*EventTransaction, error) {
+	tree := func() *filenode.FileNode { return tw.FileTree }
+	return upgradeSum(&tw.Mutex, tree, tw.ParentPath, path)
+}
+
+// UpgradeSums upgrades every weak sum of the tree and sends the changes to the events, it returns the number of sums
+// upgraded. It reads the files one at a time between the events, so it is meant to be run in the background. It returns
+// ErrStopped once the watcher has stopped.
+func (tw *TreeWatcher) UpgradeSums() (int, error) {
+	tree := func() *filenode.FileNode { return tw.FileTree }
+	return upgradeSums(&tw.Mutex, tree, tw.Path, tw.ParentPath, tw.outbox.send, tw.outbox.isClosed)
+}
+
+// startSums runs the workers that compute the deferred sums, see WithDeferredSums.
+func (tw *TreeWatcher) startSums(workers int) {
+	tree := func() *filenode.FileNode { return tw.FileTree }
+	for i := 0; i < workers; i++ {
+		tw.workers.Add(1)
+		go func() {
+			defer tw.workers.Done()
+			resolveSums(tw.sums, &tw.Mutex, tree, tw.ParentPath, tw.outbox.send, tw.outbox.sendError)
+		}()
+	}
+}
+
 func (tw *TreeWatcher) Create(path connector.Path, extra *filenode.ExtraPayload) (*filenode.FileNode, error) {
 	if !path.Exists() {
-		return nil, errors.New("file path does not exist")
+		return nil, &filenode.OpError{Op: "create", Path: path.String(), Err: os.ErrNotExist}
 	}
 
 	eventPath := path.ExcludePath(tw.ParentPath)
@@ -115,7 +196,7 @@ func (tw *TreeWatcher) Create(path connector.Path, extra *filenode.ExtraPayload)
 					if p.IsDir() {
 						err := tw.Watcher.Add(p.String())
 						if err != nil {
-							tw.Errors <- err
+							tw.outbox.sendError(watchFailed("watch", p.ExcludePath(tw.ParentPath), err))
 							return
 						}
 					}
@@ -142,11 +223,11 @@ func (tw *TreeWatcher) Rename(fromPath connector.Path, toPath connector.Path) (*
 	if toPath.IsDir() {
 		err = tw.removeWatcherPath(fromPath.String())
 		if err != nil {
-			return nil, errors.New("path not deleted in watchlist")
+			return nil, watchFailed("rename", fromPath.ExcludePath(tw.ParentPath), err)
 		}
 		err = tw.Watcher.Add(toPath.String())
 		if err != nil {
-			return nil, err
+			return nil, watchFailed("rename", toPath.ExcludePath(tw.ParentPath), err)
 		}
 	}
 	return node, err
@@ -159,6 +240,14 @@ func (tw *TreeWatcher) Handler(e event.Event, extras ...*filenode.ExtraPayload)
 	var err error
 	var node *filenode.FileNode
 	var extra *filenode.ExtraPayload
+	var oldMeta filenode.MetaData
+	var oldChunks []utils.Chunk
+
+	e, ok := filterEvent(tw.FileTree.Options(), tw.Path, e)
+	if !ok {
+		return nil, nil
+	}
+	before := priorOf(tw.FileTree, e.FromPath.ExcludePath(tw.ParentPath))
 
 	if len(extras) > 0 {
 		extra = extras[0]
@@ -167,10 +256,32 @@ func (tw *TreeWatcher) Handler(e event.Event, extras ...*filenode.ExtraPayload)
 	switch e.Type {
 	case event.Remove:
 		node, err = tw.Remove(e.FromPath)
+		if err == nil {
+			forgetSums(tw.hashCache, node)
+		}
 		break
 	case event.Write:
+		if e.FromPath.IsDir() {
+			// a write on a folder only means its entries changed, their own events take care of it
+			return nil, nil
+		}
+		if old := tw.FileTree.Search(e.FromPath.ExcludePath(tw.ParentPath).String()); old != nil {
+			oldChunks = old.Chunks
+		}
 		node, err = tw.Write(e.FromPath)
 		break
+	case event.Chmod:
+		old := tw.FileTree.Search(e.FromPath.ExcludePath(tw.ParentPath).String())
+		if old == nil || !e.FromPath.Exists() {
+			// the file is on its way in or out, the events that follow take care of it
+			return nil, nil
+		}
+		oldMeta = old.Meta
+		node, err = tw.Chmod(e.FromPath)
+		if err == nil && !attrsChanged(oldMeta, node.Meta) {
+			return nil, nil
+		}
+		break
 	case event.Create:
 		node, err = tw.Create(e.FromPath, extra)
 		break
@@ -181,8 +292,7 @@ func (tw *TreeWatcher) Handler(e event.Event, extras ...*filenode.ExtraPayload)
 		node, err = tw.Move(e.FromPath, e.ToPath)
 		break
 	default:
-		errorMsg := fmt.Sprintf("unhandled event: op:%s, path:%s", e.Type, e.FromPath)
-		err = errors.New(errorMsg)
+		err = unhandled(e, e.FromPath.ExcludePath(tw.ParentPath))
 		break
 	}
 	if err != nil {
@@ -190,75 +300,139 @@ func (tw *TreeWatcher) Handler(e event.Event, extras ...*filenode.ExtraPayload)
 	}
 
 	et := makeEventTransaction(*node, e.Type)
+	before.fill(et, e)
+	if e.Type == event.Chmod {
+		et.OldMode = oldMeta.FileMode()
+	}
+	if e.Type == event.Write && !node.Meta.SumPending {
+		et.ChunkDiff = diffChunks(oldChunks, node.Chunks)
+	}
+	if e.Type == event.Create || e.Type == event.Write {
+		tw.sums.push(pendingSums(node)...)
+	}
 	return et, err
 }
 
+// Watch appends the events of the fsnotify watcher to the EventManager until it is closed. A watcher replaced by a
+// rename is closed, so the Watch that reads it returns.
 func (tw *TreeWatcher) Watch() {
+	watcher := tw.Watcher
 	for {
 		select {
-
-		case e, ok := <-tw.Watcher.Events:
+		case <-tw.stopping:
+			return
+		case e, ok := <-watcher.Events:
 			if !ok {
 				return
 			}
 			var sum string
 			path := connector.NewFSPath(e.Name)
 			eventPath := path.ExcludePath(tw.ParentPath)
+			tw.Lock()
 			node := tw.FileTree.Search(eventPath.ParentPath().String())
 			if node != nil {
 				sum = node.Meta.Sum
 			}
+			tw.Unlock()
 			tw.EventManager.Append(e, sum)
-		case err, ok := <-tw.Watcher.Errors:
-			tw.Errors <- err
+		case err, ok := <-watcher.Errors:
 			if !ok {
 				return
 			}
+			tw.outbox.sendError(err)
 		}
 	}
 }
 
-func (tw *TreeWatcher) Start() {
-	tw.IgniterReloadCtx, tw.IgniterReloadFunc = context.WithCancel(context.Background())
-	// EventManager's working range
-	ticker := time.NewTicker(2 * time.Second)
-
-	go tw.start(ticker)
-	go tw.Watch()
+func (tw *TreeWatcher) Start(ctx context.Context) error {
+	return tw.life.start(ctx, tw.run)
 }
 
-func (tw *TreeWatcher) start(ticker *time.Ticker) {
+// run processes the events gathered on every tick until ctx is done, then drains them. Watch is started again on
+// the fsnotify watcher that replaces the one closed by a rename.
+func (tw *TreeWatcher) run(ctx context.Context) {
+	tw.IgniterReloadCtx, tw.IgniterReloadFunc = context.WithCancel(context.Background())
+	// EventManager's working range
+	if tw.scanTxns {
+		publishScan(tw.Snapshot(), tw.outbox.send)
+	}
+	// the sums of the scan are sent after its nodes
+	tw.startSums(tw.sumWorkers)
+	ticker := time.NewTicker(tw.tick)
+	tw.stopping = ctx.Done()
+	watching := tw.watch()
 	for {
 		select {
+		case <-ctx.Done():
+			ticker.Stop()
+			tw.drain(watching)
+			return
 		case <-tw.IgniterReloadCtx.Done():
 			tw.IgniterReloadCtx, tw.IgniterReloadFunc = context.WithCancel(context.Background())
-			tw.Start()
-			return
-		case _ = <-ticker.C:
-			if tw.EventManager.StackLength() > 0 {
-				newEvents := tw.EventManager.Process()
-				for _, e := range newEvents {
-					txn, err := tw.Handler(e)
-					if err != nil {
-						tw.Errors <- err
-					}
-					tw.Events <- *txn
+			<-watching
+			watching = tw.watch()
+		case <-ticker.C:
+			tw.process()
+		}
+	}
+}
+
+// watch runs Watch on the current fsnotify watcher, the returned channel is closed when it returns.
+func (tw *TreeWatcher) watch() chan struct{} {
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		tw.Watch()
+	}()
+	return watching
+}
 
+// process sends the transactions of the events gathered so far, it returns the number of events processed.
+func (tw *TreeWatcher) process() int {
+	if tw.EventManager.StackLength() == 0 {
+		return 0
+	}
+	newEvents := tw.EventManager.Process()
+	for _, e := range newEvents {
+		txn, err := tw.Handler(e)
+		if err != nil {
+			tw.outbox.sendError(err)
+			continue
+		}
+		if txn != nil {
+			tw.outbox.send(txn)
+			if tw.scanTxns && txn.Type == event.Create && txn.Meta.IsDir {
+				for _, sub := range createTransactions(tw.Snapshot().SearchByUUID(txn.UUID), txn.Path) {
+					tw.outbox.send(sub)
 				}
 			}
 		}
 	}
+	flushHashCache(tw.hashCache, tw.outbox.sendError)
+	return len(newEvents)
 }
 
-func (tw *TreeWatcher) Stop() {
-	err := tw.Watcher.Close()
-	if err != nil {
-		log.Error(err)
+// drain waits for Watch and the sum workers to return, sends the transactions of the events left, closes the fsnotify
+// watcher and then the channels. The events that can't be made sense of on their own are dropped.
+func (tw *TreeWatcher) drain(watching chan struct{}) {
+	<-watching
+	tw.sums.close()
+	tw.workers.Wait()
+	// Process stops after every Create, so it's called until no event is left that it can make sense of
+	for tw.process() > 0 {
+	}
+	tw.outbox.close()
+	if err := tw.Watcher.Close(); err != nil {
+		tw.logger.Error(err)
 	}
 	close(tw.Events)
 	close(tw.Errors)
 }
 
+func (tw *TreeWatcher) Stop() error {
+	return tw.life.stop()
+}
+
 func (tw *TreeWatcher) removeWatcherPath(fsPath string) error {
 	/*
 		When you see this function, why use watcher.Remove?
@@ -287,12 +461,17 @@ func (tw *TreeWatcher) removeWatcherPath(fsPath string) error {
 	return nil
 }
 
-func NewPathWatcher(fsPath string) (*TreeWatcher, *EventTransaction, error) {
+func NewPathWatcher(fsPath string, opts ...Option) (*TreeWatcher, *EventTransaction, error) {
 	var err error
 	var watcher *fsnotify.Watcher
 	path := connector.NewFSPath(fsPath)
 	if !path.IsDir() {
-		err = errors.New("input path is not directory")
+		err = &filenode.OpError{Op: "watch", Path: fsPath, Err: filenode.ErrNotDirectory}
+		return nil, nil, err
+	}
+
+	cfg := newConfig(opts)
+	if err = cfg.validate(); err != nil {
 		return nil, nil, err
 	}
 
@@ -306,25 +485,43 @@ func NewPathWatcher(fsPath string) (*TreeWatcher, *EventTransaction, error) {
 		Subs: []*filenode.FileNode{},
 		Meta: filenode.MetaData{
 			IsDir: true,
+			Type:  filenode.TypeDir,
 		},
 	}
+	root.SetOptions(cfg.treeOptions())
 
+	events, errs := cfg.channelSizes(10)
 	tw := TreeWatcher{
 		FileTree:     &root,
 		ParentPath:   path.ParentPath(),
 		Path:         path,
 		Watcher:      watcher,
 		EventManager: event.NewEventHandler(),
-		Events:       make(chan EventTransaction, 10),
-		Errors:       make(chan error, 10),
+		progress:     cfg.progress,
+		hashCache:    cfg.hashCache,
+		sums:         cfg.sumQueue(),
+		tick:         cfg.tick,
+		logger:       cfg.logger,
+		sumWorkers:   cfg.sumWorkers,
+		scanTxns:     cfg.scanTxns,
+		life:         lifecycle{timeout: cfg.drain},
+		Events:       make(chan EventTransaction, events),
+		Errors:       make(chan error, errs),
 	}
 
+	tree := func() *filenode.FileNode { return tw.FileTree }
+	deliver := func(txn *EventTransaction) { tw.Events <- *txn }
+	tw.outbox = newOutbox(cfg.overflow, events, &tw.Mutex, tree, deliver, tw.Errors)
 	e := event.Event{FromPath: path, Type: event.Create}
 	txn, err := tw.Handler(e)
 	if err != nil {
-		tw.Errors <- err
+		tw.outbox.sendError(err)
+		tw.outbox.close()
+		return nil, nil, err
+	}
+	flushHashCache(tw.hashCache, tw.outbox.sendError)
+	if err = tw.Start(context.Background()); err != nil {
 		return nil, nil, err
 	}
-	tw.Start()
 	return &tw, txn, nil
 }